@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Developer-s-Foundry/df-2.0-aima-auth-service/database/postgres"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Types of the events recorded in the audit log. Logins are told apart by the
+// credential that completed them.
+const (
+	authEventRegister       = "register"
+	authEventLogin          = "login"
+	authEventLoginMFA       = "login_mfa"
+	authEventLoginMagicLink = "login_magic_link"
+	authEventLoginEmailOTP  = "login_email_otp"
+	authEventLoginPasskey   = "login_passkey"
+	authEventLogout         = "logout"
+	authEventPasswordChange = "password_change"
+	authEventPasswordForgot = "password_forgot"
+	authEventPasswordReset  = "password_reset"
+)
+
+// Outcomes of an audit log event. A login that still needs a second factor
+// ends as a challenge; the second step records its own event.
+const (
+	authOutcomeSuccess   = "success"
+	authOutcomeFailure   = "failure"
+	authOutcomeChallenge = "challenge"
+)
+
+// Reasons recorded with failures and challenges.
+const (
+	authReasonUnknownUser        = "unknown_user"
+	authReasonUserExists         = "user_exists"
+	authReasonInvalidCredentials = "invalid_credentials"
+	authReasonInvalidToken       = "invalid_token"
+	authReasonAccountLocked      = "account_locked"
+	authReasonEmailUnverified    = "email_unverified"
+	authReasonMFARequired        = "mfa_required"
+	authReasonPasswordRejected   = "password_rejected"
+)
+
+const (
+	defaultAuthEventPageSize = 50
+	maxAuthEventPageSize     = 200
+	// maxAuthEventFieldLength caps what a client controlled value, such as
+	// the user agent, may take up in the audit log.
+	maxAuthEventFieldLength = 512
+)
+
+// authEventRetention is how long audit log entries are kept before cleanup
+// drops them. It is loaded from AUTH_EVENT_RETENTION at startup.
+var authEventRetention = 90 * 24 * time.Hour
+
+func loadAuthEventRetention() (time.Duration, error) {
+	v := os.Getenv("AUTH_EVENT_RETENTION")
+	if v == "" {
+		return authEventRetention, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return authEventRetention, fmt.Errorf("invalid AUTH_EVENT_RETENTION %q", v)
+	}
+	return d, nil
+}
+
+// recordAuthEvent adds an event about user to the audit log, along with where
+// the request came from. Users that could not be looked up are passed with
+// only the email they were asked for. A failed write is logged and never
+// fails the request.
+func (h *AuthHandler) recordAuthEvent(r *http.Request, eventType string, user *postgres.User, outcome, reason string) {
+	clientIP, _ := clientIPKey(r)
+	e := postgres.AuthEvent{
+		Type:        eventType,
+		UserID:      user.UserID,
+		Email:       auditField(user.Email),
+		Outcome:     outcome,
+		Reason:      reason,
+		ClientIP:    auditField(clientIP),
+		UserAgent:   auditField(r.UserAgent()),
+		ServiceName: auditField(r.Header.Get("X-Service-Name")),
+		RequestID:   auditField(r.Header.Get("X-Request-ID")),
+	}
+
+	// the event is kept even if the client hangs up
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 5*time.Second)
+	defer cancel()
+	if err := h.DB.InsertAuthEvent(ctx, e); err != nil {
+		log.Printf("unable to record %s %s event for %q: %v", eventType, outcome, e.Email, err)
+	}
+}
+
+// auditField makes a client supplied value safe to store: invalid UTF-8 is
+// dropped and the value is cut to maxAuthEventFieldLength bytes.
+func auditField(v string) string {
+	if len(v) > maxAuthEventFieldLength {
+		v = v[:maxAuthEventFieldLength]
+	}
+	return strings.ToValidUTF8(v, "")
+}
+
+// ListAuthEvents returns audit log entries, newest first. The query string
+// may filter by type, user_id, email, outcome and client_ip, and bound the
+// time with since and until (RFC 3339). A page holds limit entries; when
+// more remain, next_cursor is passed as cursor to get the next page.
+func (h *AuthHandler) ListAuthEvents(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	query := r.URL.Query()
+
+	filter := postgres.AuthEventFilter{
+		Type:     query.Get("type"),
+		UserID:   query.Get("user_id"),
+		Outcome:  query.Get("outcome"),
+		ClientIP: query.Get("client_ip"),
+		Limit:    defaultAuthEventPageSize,
+	}
+	if email := query.Get("email"); email != "" {
+		filter.Email = lookupEmail(email)
+	}
+
+	times := []struct {
+		name string
+		dst  *time.Time
+	}{
+		{"since", &filter.Since},
+		{"until", &filter.Until},
+	}
+	for _, t := range times {
+		v := query.Get(t.name)
+		if v == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeErrorResponse(w, fmt.Sprintf("%s must be an RFC 3339 time", t.name), http.StatusBadRequest)
+			return
+		}
+		*t.dst = parsed
+	}
+
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxAuthEventPageSize {
+			writeErrorResponse(w, fmt.Sprintf("limit must be between 1 and %d", maxAuthEventPageSize), http.StatusBadRequest)
+			return
+		}
+		filter.Limit = n
+	}
+
+	if v := query.Get("cursor"); v != "" {
+		before, err := decodeAuthEventCursor(v)
+		if err != nil {
+			writeErrorResponse(w, "invalid cursor", http.StatusBadRequest)
+			return
+		}
+		filter.Before = before
+	}
+
+	// one extra entry tells whether another page follows
+	pageSize := filter.Limit
+	filter.Limit++
+	events, err := h.DB.GetAuthEvents(r.Context(), filter)
+	if err != nil {
+		log.Printf("unable to get auth events from db: %v", err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	var nextCursor string
+	if len(events) > pageSize {
+		events = events[:pageSize]
+		nextCursor = encodeAuthEventCursor(events[pageSize-1].ID)
+	}
+	if events == nil {
+		events = []postgres.AuthEvent{}
+	}
+
+	response := struct {
+		Events     []postgres.AuthEvent `json:"events"`
+		NextCursor string               `json:"next_cursor,omitempty"`
+		StatusCode int                  `json:"status_code"`
+	}{
+		Events:     events,
+		NextCursor: nextCursor,
+		StatusCode: http.StatusOK,
+	}
+	writeToJson(w, response, http.StatusOK)
+}
+
+// encodeAuthEventCursor turns the ID of the last entry of a page into the
+// opaque cursor of the next one.
+func encodeAuthEventCursor(id int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(id, 10)))
+}
+
+func decodeAuthEventCursor(cursor string) (int64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
+	}
+	id, err := strconv.ParseInt(string(raw), 10, 64)
+	if err != nil || id < 1 {
+		return 0, fmt.Errorf("invalid cursor %q", cursor)
+	}
+	return id, nil
+}
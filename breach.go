@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Developer-s-Foundry/df-2.0-aima-auth-service/database/postgres"
+	"github.com/Developer-s-Foundry/df-2.0-aima-auth-service/database/rabbitmq"
+)
+
+// breachIndexMagic starts a binary breach index, a sorted run of big-endian
+// uint64 SHA-1 prefixes written by WriteBreachIndex.
+var breachIndexMagic = []byte("AIMASBP1")
+
+// BreachedPasswords is a local copy of a breach corpus such as Have I Been
+// Pwned's Pwned Passwords. Only the first 8 bytes of each SHA-1 are kept, so
+// a password costs 8 bytes of memory and a lookup is a binary search, while
+// false positives stay at about n in 2^64.
+type BreachedPasswords struct {
+	prefixes []uint64
+}
+
+// LoadBreachedPasswords reads either a binary index or a text list with one
+// hex SHA-1 per line, optionally followed by :count as in the Pwned Passwords
+// downloads. Hashes seen fewer than minCount times are skipped, which keeps
+// memory down on the full corpus.
+func LoadBreachedPasswords(path string, minCount int) (*BreachedPasswords, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open breached password list: %w", err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReaderSize(f, 1<<20)
+	magic, err := r.Peek(len(breachIndexMagic))
+	if err == nil && bytes.Equal(magic, breachIndexMagic) {
+		return readBreachIndex(r)
+	}
+	return readBreachList(r, minCount)
+}
+
+func readBreachIndex(r *bufio.Reader) (*BreachedPasswords, error) {
+	if _, err := r.Discard(len(breachIndexMagic)); err != nil {
+		return nil, fmt.Errorf("failed to read breach index: %w", err)
+	}
+
+	var b BreachedPasswords
+	buf := make([]byte, 8)
+	for {
+		_, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read breach index: %w", err)
+		}
+		prefix := binary.BigEndian.Uint64(buf)
+		if n := len(b.prefixes); n > 0 && prefix <= b.prefixes[n-1] {
+			return nil, errors.New("breach index is not sorted")
+		}
+		b.prefixes = append(b.prefixes, prefix)
+	}
+	return &b, nil
+}
+
+func readBreachList(r io.Reader, minCount int) (*BreachedPasswords, error) {
+	var b BreachedPasswords
+	sorted := true
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		digest, count, hasCount := strings.Cut(text, ":")
+		if len(digest) != 2*sha1.Size {
+			return nil, fmt.Errorf("breached password list line %d: expected a SHA-1 hash", line)
+		}
+		if hasCount {
+			n, err := strconv.Atoi(count)
+			if err != nil {
+				return nil, fmt.Errorf("breached password list line %d: invalid count", line)
+			}
+			if n < minCount {
+				continue
+			}
+		}
+
+		prefix, err := strconv.ParseUint(digest[:16], 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("breached password list line %d: expected a SHA-1 hash", line)
+		}
+		if n := len(b.prefixes); n > 0 && prefix < b.prefixes[n-1] {
+			sorted = false
+		}
+		b.prefixes = append(b.prefixes, prefix)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read breached password list: %w", err)
+	}
+
+	if !sorted {
+		slices.Sort(b.prefixes)
+	}
+	b.prefixes = slices.Clip(slices.Compact(b.prefixes))
+	return &b, nil
+}
+
+// WriteBreachIndex writes the list in the binary format, which loads much
+// faster than the text lists.
+func (b *BreachedPasswords) WriteBreachIndex(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(breachIndexMagic); err != nil {
+		return err
+	}
+	buf := make([]byte, 8)
+	for _, prefix := range b.prefixes {
+		binary.BigEndian.PutUint64(buf, prefix)
+		if _, err := bw.Write(buf); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// Contains reports whether password appears in the list. A nil list contains
+// nothing.
+func (b *BreachedPasswords) Contains(password string) bool {
+	if b == nil {
+		return false
+	}
+	digest := sha1.Sum([]byte(password))
+	_, found := slices.BinarySearch(b.prefixes, binary.BigEndian.Uint64(digest[:8]))
+	return found
+}
+
+func (b *BreachedPasswords) Len() int {
+	if b == nil {
+		return 0
+	}
+	return len(b.prefixes)
+}
+
+// checkBreachedPassword flags the account when the password it just logged in
+// with is in the breach list, and asks the owner to change it the first time.
+// Failures are only logged, a login is never refused here.
+func (h *AuthHandler) checkBreachedPassword(ctx context.Context, user *postgres.User, password string) {
+	if !passwordPolicy.CheckBreachedAtLogin || user.PasswordBreachedAt != nil || !passwordPolicy.Breached.Contains(password) {
+		return
+	}
+
+	flaggedAt, err := h.DB.FlagBreachedPassword(ctx, user.UserID)
+	if err != nil {
+		log.Printf("unable to flag breached password of user %s: %v", user.UserID, err)
+		return
+	}
+	if flaggedAt == nil {
+		return
+	}
+	user.PasswordBreachedAt = flaggedAt
+
+	userData := map[string]interface{}{
+		"data": map[string]string{
+			"type":      rabbitmq.NotifyPasswordBreached,
+			"email":     user.Email,
+			"id":        user.UserID,
+			"timestamp": time.Now().String(),
+		},
+		"queue_name":    rabbitmq.NotificationQueue,
+		"exchange_name": rabbitmq.NotificationExchange,
+	}
+
+	go h.RabbMQ.PublishNotification(userData)
+}
+
+// loadBreachedPasswords loads BREACHED_PASSWORDS_FILE, if set.
+// BREACHED_PASSWORDS_MIN_COUNT drops hashes of text lists seen fewer times.
+func loadBreachedPasswords() (*BreachedPasswords, error) {
+	path := os.Getenv("BREACHED_PASSWORDS_FILE")
+	if path == "" {
+		return nil, nil
+	}
+
+	minCount, err := breachedPasswordsMinCount()
+	if err != nil {
+		return nil, err
+	}
+	return LoadBreachedPasswords(path, minCount)
+}
+
+func breachedPasswordsMinCount() (int, error) {
+	v := os.Getenv("BREACHED_PASSWORDS_MIN_COUNT")
+	if v == "" {
+		return 1, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid BREACHED_PASSWORDS_MIN_COUNT %q", v)
+	}
+	return n, nil
+}
+
+// buildBreachIndex converts a text list into a binary index, applying
+// BREACHED_PASSWORDS_MIN_COUNT. It backs the breach-index command.
+func buildBreachIndex(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: breach-index <list> <index>")
+	}
+	minCount, err := breachedPasswordsMinCount()
+	if err != nil {
+		return err
+	}
+	list, err := LoadBreachedPasswords(args[0], minCount)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(args[1])
+	if err != nil {
+		return fmt.Errorf("failed to create breach index: %w", err)
+	}
+	if err := list.WriteBreachIndex(out); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to write breach index: %w", err)
+	}
+	return out.Close()
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/Developer-s-Foundry/df-2.0-aima-auth-service/database/postgres"
+)
+
+const cleanupInterval = time.Hour
+
+// runCleanup periodically deletes short-lived rows, such as MFA challenges,
+// once they have expired, until ctx is cancelled.
+func runCleanup(ctx context.Context, db *postgres.PostgresConn) {
+	jobs := []struct {
+		name string
+		run  func(context.Context) (int64, error)
+	}{
+		{"mfa challenges", db.DeleteExpiredMFAChallenges},
+		{"webauthn challenges", db.DeleteExpiredWebAuthnChallenges},
+		{"magic link redemptions", db.DeleteExpiredMagicLinkRedemptions},
+		{"email otps", db.DeleteExpiredEmailOTPs},
+		{"rate limit counters", db.DeleteExpiredRateLimitCounters},
+		{"sent outbox events", func(ctx context.Context) (int64, error) {
+			return db.DeleteSentOutboxEvents(ctx, time.Now().Add(-outboxRetention))
+		}},
+		{"auth events", func(ctx context.Context) (int64, error) {
+			return db.DeleteAuthEvents(ctx, time.Now().Add(-authEventRetention))
+		}},
+	}
+
+	ticker := time.NewTicker(cleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, job := range jobs {
+				deleted, err := job.run(ctx)
+				if err != nil {
+					log.Printf("[Cleanup] Failed to delete expired %s: %v", job.name, err)
+					continue
+				}
+				if deleted > 0 {
+					log.Printf("[Cleanup] Deleted %d expired %s", deleted, job.name)
+				}
+			}
+		case <-ctx.Done():
+			log.Println("[Cleanup] Context cancelled, stopping cleanup")
+			return
+		}
+	}
+}
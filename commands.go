@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/Developer-s-Foundry/df-2.0-aima-auth-service/database/postgres"
+)
+
+// runCommand runs the command named by the first argument instead of the
+// server:
+//
+//	breach-index <list> <index>   build a binary breached password index
+//	migrate up                    apply pending migrations
+//	migrate down [n|all]          revert the latest n (default 1) migrations
+//	migrate status                list migrations and when they were applied
+func runCommand(name string, args []string) error {
+	switch name {
+	case "breach-index":
+		return buildBreachIndex(args)
+	case "migrate":
+		return migrate(args)
+	default:
+		return fmt.Errorf("unknown command %q", name)
+	}
+}
+
+func migrate(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: migrate up|down [n|all]|status")
+	}
+
+	db, err := connectPostgresFromEnv()
+	if err != nil {
+		return err
+	}
+	defer db.Conn.Close()
+	ctx := context.Background()
+
+	switch args[0] {
+	case "up":
+		applied, err := db.MigrateUp(ctx)
+		for _, m := range applied {
+			log.Printf("Applied migration %04d_%s", m.Version, m.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			log.Println("Database schema is up to date")
+		}
+		return err
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if args[1] == "all" {
+				steps = postgres.LatestSchemaVersion()
+			} else if steps, err = strconv.Atoi(args[1]); err != nil || steps <= 0 {
+				return fmt.Errorf("invalid number of migrations %q", args[1])
+			}
+		}
+		reverted, err := db.MigrateDown(ctx, steps)
+		for _, m := range reverted {
+			log.Printf("Reverted migration %04d_%s", m.Version, m.Name)
+		}
+		return err
+
+	case "status":
+		statuses, err := db.MigrationStatuses(ctx)
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = "applied " + s.AppliedAt.Local().Format("2006-01-02 15:04:05")
+			}
+			name := s.Name
+			if s.Version > postgres.LatestSchemaVersion() {
+				name += " (unknown to this binary)"
+			}
+			fmt.Fprintf(os.Stdout, "%04d  %-40s %s\n", s.Version, name, applied)
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+}
+
+// migrateOnStartup applies pending migrations unless DB_AUTO_MIGRATE is false,
+// in which case it refuses to start on a schema that is behind.
+func migrateOnStartup(db *postgres.PostgresConn) error {
+	ctx := context.Background()
+
+	auto := true
+	if v := os.Getenv("DB_AUTO_MIGRATE"); v != "" {
+		parsed, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid DB_AUTO_MIGRATE %q", v)
+		}
+		auto = parsed
+	}
+
+	if !auto {
+		pending, err := db.PendingMigrations(ctx)
+		if err != nil {
+			return err
+		}
+		if len(pending) > 0 {
+			return fmt.Errorf("%d database migrations are pending, run `migrate up` first", len(pending))
+		}
+		return nil
+	}
+
+	applied, err := db.MigrateUp(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to migrate database: %w", err)
+	}
+	for _, m := range applied {
+		log.Printf("Applied migration %04d_%s", m.Version, m.Name)
+	}
+	return nil
+}
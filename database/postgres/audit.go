@@ -0,0 +1,107 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+func (p *PostgresConn) InsertAuthEvent(ctx context.Context, e AuthEvent) error {
+	_, err := p.Conn.Exec(ctx, `
+		INSERT INTO auth_events (type, user_id, email, outcome, reason, client_ip, user_agent, service_name, request_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	`, e.Type, e.UserID, e.Email, e.Outcome, e.Reason, e.ClientIP, e.UserAgent, e.ServiceName, e.RequestID)
+	if err != nil {
+		return fmt.Errorf("failed to insert auth event: %w", err)
+	}
+	return nil
+}
+
+// GetAuthEvents returns up to f.Limit audit log entries matching f, newest
+// first.
+func (p *PostgresConn) GetAuthEvents(ctx context.Context, f AuthEventFilter) ([]AuthEvent, error) {
+	var conditions []string
+	var args []interface{}
+	where := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if f.Type != "" {
+		where("type = $%d", f.Type)
+	}
+	if f.UserID != "" {
+		where("user_id = $%d", f.UserID)
+	}
+	if f.Email != "" {
+		where("email = $%d", f.Email)
+	}
+	if f.Outcome != "" {
+		where("outcome = $%d", f.Outcome)
+	}
+	if f.ClientIP != "" {
+		where("client_ip = $%d", f.ClientIP)
+	}
+	if !f.Since.IsZero() {
+		where("created_at >= $%d", f.Since)
+	}
+	if !f.Until.IsZero() {
+		where("created_at < $%d", f.Until)
+	}
+	if f.Before > 0 {
+		where("id < $%d", f.Before)
+	}
+
+	query := `
+		SELECT id, type, user_id, email, outcome, reason, client_ip, user_agent, service_name, request_id, created_at
+		FROM auth_events
+	`
+	if len(conditions) > 0 {
+		query += "WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, f.Limit)
+	query += fmt.Sprintf(" ORDER BY id DESC LIMIT $%d", len(args))
+
+	rows, err := p.Conn.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve auth events: %w", err)
+	}
+	defer rows.Close()
+
+	var events []AuthEvent
+	for rows.Next() {
+		var e AuthEvent
+		err := rows.Scan(
+			&e.ID,
+			&e.Type,
+			&e.UserID,
+			&e.Email,
+			&e.Outcome,
+			&e.Reason,
+			&e.ClientIP,
+			&e.UserAgent,
+			&e.ServiceName,
+			&e.RequestID,
+			&e.CreatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan auth event: %w", err)
+		}
+		events = append(events, e)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to retrieve auth events: %w", err)
+	}
+	return events, nil
+}
+
+// DeleteAuthEvents drops audit log entries recorded before the given time.
+func (p *PostgresConn) DeleteAuthEvents(ctx context.Context, before time.Time) (int64, error) {
+	result, err := p.Conn.Exec(ctx, `DELETE FROM auth_events WHERE created_at < $1`, before)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete auth events: %w", err)
+	}
+	return result.RowsAffected(), nil
+}
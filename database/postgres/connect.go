@@ -46,13 +46,15 @@ func ConnectPostgres(uri, password, port, host, database, user, sslmode string)
 
 	conn := NewPostgresConn(pgx)
 
-	err = conn.Create()
-
+	// a binary older than the schema could write rows newer code cannot read,
+	// so it must not run at all
+	pending, err := conn.PendingMigrations(ctx)
 	if err != nil {
-		log.Printf("unable to create table: %v", err)
+		log.Printf("unable to check database schema: %v", err)
+		pgx.Close()
 		return nil, err
 	}
 
-	log.Println("user table create successfully")
+	log.Printf("Database schema checked, %d of %d migrations pending", len(pending), len(migrations))
 	return conn, nil
 }
@@ -1,30 +1,205 @@
 package postgres
 
 import (
-	"context"
 	"time"
 )
 
 type User struct {
-	UserID         string    `json:"userId"`
-	Email          string    `json:"email"`
-	HashedPassword string    `json:"hashedPassword"`
-	CreatedAt      time.Time `json:"created_at"`
-	UpdatedAt      time.Time `json:"updated_at,omitempty"`
-}
-
-func (p *PostgresConn) Create() error {
-	query := `
-		CREATE TABLE IF NOT EXISTS users (
-			userId TEXT PRIMARY KEY,
-			email VARCHAR(100) NOT NULL,
-			hashedPassword TEXT NOT NULL,
-			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
-			updated_at TIMESTAMPTZ DEFAULT NOW()
-	)	
-	`
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	_, err := p.Conn.Exec(ctx, query)
-	return err
+	UserID          string     `json:"userId"`
+	Email           string     `json:"email"`
+	HashedPassword  string     `json:"hashedPassword"`
+	EmailVerified   bool       `json:"email_verified"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at,omitempty"`
+	// PasswordBreachedAt is when the current password was found in a breach
+	// corpus at login. Setting a new password clears it.
+	PasswordBreachedAt *time.Time `json:"password_breached_at,omitempty"`
+	// Username is optional and unique regardless of case.
+	Username *string `json:"username,omitempty"`
+}
+
+type EmailVerificationToken struct {
+	TokenHash string     `json:"-"`
+	UserID    string     `json:"user_id"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	CreatedAt time.Time  `json:"created_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+}
+
+type RefreshToken struct {
+	ID        string     `json:"id"`
+	UserID    string     `json:"user_id"`
+	FamilyID  string     `json:"family_id"`
+	TokenHash string     `json:"-"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	CreatedAt time.Time  `json:"created_at"`
+	RotatedAt *time.Time `json:"rotated_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+const (
+	SigningKeyPending  = "pending"
+	SigningKeyActive   = "active"
+	SigningKeyRetiring = "retiring"
+	SigningKeyRetired  = "retired"
+)
+
+// SigningKey is a JWT signing key. PrivateKey holds the PKCS #8 encoding
+// encrypted with the service master key and is cleared once the key retires.
+// A pending key is published but only becomes active after ActivateAfter.
+type SigningKey struct {
+	KID           string     `json:"kid"`
+	Algorithm     string     `json:"algorithm"`
+	PrivateKey    []byte     `json:"-"`
+	State         string     `json:"state"`
+	CreatedAt     time.Time  `json:"created_at"`
+	ActivateAfter *time.Time `json:"activate_after,omitempty"`
+	RetiringAt    *time.Time `json:"retiring_at,omitempty"`
+	RetireAfter   *time.Time `json:"retire_after,omitempty"`
+	RetiredAt     *time.Time `json:"retired_at,omitempty"`
+}
+
+type PasswordResetToken struct {
+	TokenHash string     `json:"-"`
+	UserID    string     `json:"user_id"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	CreatedAt time.Time  `json:"created_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+}
+
+// SessionRevocation invalidates every access token of UserID issued before
+// RevokedBefore.
+type SessionRevocation struct {
+	UserID        string    `json:"user_id"`
+	RevokedBefore time.Time `json:"revoked_before"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// TOTPCredential is a user's RFC 6238 authenticator. Secret is encrypted with
+// the service master key; the authenticator is only enabled once confirmed.
+type TOTPCredential struct {
+	UserID       string     `json:"user_id"`
+	Secret       []byte     `json:"-"`
+	ConfirmedAt  *time.Time `json:"confirmed_at,omitempty"`
+	LastUsedStep int64      `json:"-"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// MFAChallenge is handed out by login when a second factor is required and
+// redeemed, once, together with that factor.
+type MFAChallenge struct {
+	TokenHash  string     `json:"-"`
+	UserID     string     `json:"user_id"`
+	Nonce      string     `json:"nonce,omitempty"`
+	Attempts   int        `json:"attempts"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ConsumedAt *time.Time `json:"consumed_at,omitempty"`
+}
+
+const (
+	WebAuthnCeremonyRegistration = "registration"
+	WebAuthnCeremonyLogin        = "login"
+	WebAuthnCeremonyMFA          = "mfa"
+)
+
+// WebAuthnCredential is a passkey registered by a user. ID is the base64url
+// credential ID and PublicKey the COSE key taken from the attestation.
+type WebAuthnCredential struct {
+	ID         string     `json:"id"`
+	UserID     string     `json:"user_id"`
+	Name       string     `json:"name"`
+	PublicKey  []byte     `json:"-"`
+	SignCount  int64      `json:"sign_count"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// WebAuthnChallenge is the server side of a registration or authentication
+// ceremony. UserID is empty for passwordless logins, where the user is only
+// known once the authenticator answers.
+type WebAuthnChallenge struct {
+	ChallengeHash string    `json:"-"`
+	UserID        string    `json:"user_id,omitempty"`
+	Ceremony      string    `json:"ceremony"`
+	Nonce         string    `json:"nonce,omitempty"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// EmailOTP is the pending email login code of a user. Requesting a new code
+// replaces the previous one.
+type EmailOTP struct {
+	UserID    string    `json:"user_id"`
+	CodeHash  string    `json:"-"`
+	Attempts  int       `json:"attempts"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AccountLockout tracks failed logins of a user. Lockouts counts how often
+// the account was locked in a row and drives the escalating lock duration.
+type AccountLockout struct {
+	UserID         string     `json:"user_id"`
+	FailedAttempts int        `json:"failed_attempts"`
+	Lockouts       int        `json:"lockouts"`
+	LockedUntil    *time.Time `json:"locked_until,omitempty"`
+	LastFailedAt   *time.Time `json:"last_failed_at,omitempty"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+type RevokedToken struct {
+	JTI       string    `json:"jti"`
+	UserID    string    `json:"user_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+	RevokedAt time.Time `json:"revoked_at"`
+}
+
+// OutboxEvent is a RabbitMQ message stored in the same transaction as the
+// change it announces and published afterwards by the outbox relay. Payload
+// may carry tokens, so it is stored encrypted by the service and erased once
+// the event is sent.
+type OutboxEvent struct {
+	ID         int64      `json:"id"`
+	Exchange   string     `json:"exchange"`
+	RoutingKey string     `json:"routing_key"`
+	Payload    []byte     `json:"-"`
+	Attempts   int        `json:"attempts"`
+	LastError  string     `json:"last_error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	SentAt     *time.Time `json:"sent_at,omitempty"`
+	DeadAt     *time.Time `json:"dead_at,omitempty"`
+}
+
+// AuthEvent is an entry of the audit log, recording who attempted a
+// registration, login, logout or password change, from where and how it
+// ended. Fields that were not known at the time are left empty.
+type AuthEvent struct {
+	ID          int64     `json:"id"`
+	Type        string    `json:"type"`
+	UserID      string    `json:"user_id,omitempty"`
+	Email       string    `json:"email,omitempty"`
+	Outcome     string    `json:"outcome"`
+	Reason      string    `json:"reason,omitempty"`
+	ClientIP    string    `json:"client_ip,omitempty"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+	ServiceName string    `json:"service_name,omitempty"`
+	RequestID   string    `json:"request_id,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// AuthEventFilter selects audit log entries. Empty fields match everything.
+// Since is inclusive and Until exclusive. Entries come newest first, and
+// Before, when set, skips to those with a lower ID than it.
+type AuthEventFilter struct {
+	Type     string
+	UserID   string
+	Email    string
+	Outcome  string
+	ClientIP string
+	Since    time.Time
+	Until    time.Time
+	Before   int64
+	Limit    int
 }
@@ -2,26 +2,364 @@ package postgres
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
 )
 
-func (p *PostgresConn) InsertUser(u User) error {
+// uniqueViolation is the SQLSTATE of a unique constraint or index violation.
+const uniqueViolation = "23505"
+
+var ErrUserExists = errors.New("user already exists")
+
+// InsertUser creates a user together with its first email verification
+// token, if any, and the outbox events announcing it, in one transaction.
+// Email must already be normalized; addresses that only differ in case still
+// collide on the unique index.
+func (p *PostgresConn) InsertUser(u User, verification *EmailVerificationToken, events ...OutboxEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := p.Conn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin user insert: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
 	query := `
 		INSERT INTO users (userId, email, hashedPassword)
 		VALUES ($1, $2, $3)
 		RETURNING created_at, updated_at
 	`
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	err := p.Conn.QueryRow(
+	err = tx.QueryRow(
 		ctx, query, u.UserID,
 		u.Email, u.HashedPassword,
 	).Scan(&u.CreatedAt, &u.UpdatedAt)
 
 	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+			return ErrUserExists
+		}
 		return fmt.Errorf("failed to insert user: %w", err)
 	}
 
+	if verification != nil {
+		_, err = tx.Exec(ctx, `
+			INSERT INTO email_verification_tokens (token_hash, user_id, expires_at)
+			VALUES ($1, $2, $3)
+		`, verification.TokenHash, verification.UserID, verification.ExpiresAt)
+		if err != nil {
+			return fmt.Errorf("failed to insert email verification token: %w", err)
+		}
+	}
+
+	if err := insertOutboxEvents(ctx, tx, events); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit user insert: %w", err)
+	}
+	return nil
+}
+
+func (p *PostgresConn) InsertRefreshToken(ctx context.Context, t RefreshToken) error {
+	query := `
+		INSERT INTO refresh_tokens (id, user_id, family_id, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`
+	_, err := p.Conn.Exec(ctx, query, t.ID, t.UserID, t.FamilyID, t.TokenHash, t.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert refresh token: %w", err)
+	}
+
+	return nil
+}
+
+// Revoke rejects the access token identified by jti until expiresAt, after
+// which it would be rejected anyway.
+func (p *PostgresConn) Revoke(ctx context.Context, jti, userID string, expiresAt time.Time) error {
+	query := `
+		INSERT INTO revoked_tokens (jti, user_id, expires_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (jti) DO NOTHING
+	`
+	_, err := p.Conn.Exec(ctx, query, jti, userID, expiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert revoked token: %w", err)
+	}
+
+	return nil
+}
+
+// RevokeSessions rejects every access token of the user issued before
+// revokedBefore. An earlier cutoff never replaces a later one.
+func (p *PostgresConn) RevokeSessions(ctx context.Context, userID string, revokedBefore time.Time) error {
+	if _, err := p.Conn.Exec(ctx, upsertSessionRevocationQuery, userID, revokedBefore); err != nil {
+		return fmt.Errorf("failed to revoke sessions: %w", err)
+	}
+
+	return nil
+}
+
+// InsertActiveSigningKey stores k as the active signing key unless another
+// replica already created one, in which case it reports false.
+func (p *PostgresConn) InsertActiveSigningKey(ctx context.Context, k SigningKey) (bool, error) {
+	query := `
+		INSERT INTO signing_keys (kid, algorithm, private_key, state)
+		VALUES ($1, $2, $3, 'active')
+		ON CONFLICT DO NOTHING
+	`
+	result, err := p.Conn.Exec(ctx, query, k.KID, k.Algorithm, k.PrivateKey)
+	if err != nil {
+		return false, fmt.Errorf("failed to insert signing key: %w", err)
+	}
+
+	return result.RowsAffected() == 1, nil
+}
+
+// InsertPendingSigningKey stores k as the next signing key, to be activated
+// after activateAfter, unless a pending key exists already, in which case it
+// reports false.
+func (p *PostgresConn) InsertPendingSigningKey(ctx context.Context, k SigningKey, activateAfter time.Time) (bool, error) {
+	query := `
+		INSERT INTO signing_keys (kid, algorithm, private_key, state, activate_after)
+		VALUES ($1, $2, $3, 'pending', $4)
+		ON CONFLICT DO NOTHING
+	`
+	result, err := p.Conn.Exec(ctx, query, k.KID, k.Algorithm, k.PrivateKey, activateAfter)
+	if err != nil {
+		return false, fmt.Errorf("failed to insert signing key: %w", err)
+	}
+
+	return result.RowsAffected() == 1, nil
+}
+
+// InsertEmailVerificationToken stores t together with events, which carry
+// the token to the user, so that neither exists without the other.
+func (p *PostgresConn) InsertEmailVerificationToken(ctx context.Context, t EmailVerificationToken, events ...OutboxEvent) error {
+	tx, err := p.Conn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin email verification token insert: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+		INSERT INTO email_verification_tokens (token_hash, user_id, expires_at)
+		VALUES ($1, $2, $3)
+	`
+	_, err = tx.Exec(ctx, query, t.TokenHash, t.UserID, t.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert email verification token: %w", err)
+	}
+
+	if err := insertOutboxEvents(ctx, tx, events); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit email verification token insert: %w", err)
+	}
+	return nil
+}
+
+// InsertPasswordResetToken stores t together with events, which carry the
+// token to the user, so that neither exists without the other.
+func (p *PostgresConn) InsertPasswordResetToken(ctx context.Context, t PasswordResetToken, events ...OutboxEvent) error {
+	tx, err := p.Conn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin password reset token insert: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+		INSERT INTO password_reset_tokens (token_hash, user_id, expires_at)
+		VALUES ($1, $2, $3)
+	`
+	_, err = tx.Exec(ctx, query, t.TokenHash, t.UserID, t.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert password reset token: %w", err)
+	}
+
+	if err := insertOutboxEvents(ctx, tx, events); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit password reset token insert: %w", err)
+	}
+	return nil
+}
+
+// upsertSessionRevocationQuery records that every access token of the user
+// issued before $2 is invalid. An earlier cutoff never replaces a later one.
+// It runs in the transactions that make the revocation necessary.
+const upsertSessionRevocationQuery = `
+	INSERT INTO session_revocations (user_id, revoked_before)
+	VALUES ($1, $2)
+	ON CONFLICT (user_id) DO UPDATE
+	SET revoked_before = GREATEST(session_revocations.revoked_before, EXCLUDED.revoked_before),
+		updated_at = NOW()
+`
+
+var ErrTOTPAlreadyEnabled = errors.New("totp is already enabled")
+
+// UpsertPendingTOTP stores a new, unconfirmed TOTP secret for the user,
+// replacing any earlier unconfirmed one. It fails with ErrTOTPAlreadyEnabled
+// when the user already has a confirmed authenticator.
+func (p *PostgresConn) UpsertPendingTOTP(ctx context.Context, userID string, secret []byte) error {
+	query := `
+		INSERT INTO totp_credentials (user_id, secret)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET secret = EXCLUDED.secret, last_used_step = 0, created_at = NOW()
+		WHERE totp_credentials.confirmed_at IS NULL
+	`
+	result, err := p.Conn.Exec(ctx, query, userID, secret)
+	if err != nil {
+		return fmt.Errorf("failed to store totp secret: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrTOTPAlreadyEnabled
+	}
+
+	return nil
+}
+
+func (p *PostgresConn) InsertMFAChallenge(ctx context.Context, c MFAChallenge) error {
+	query := `
+		INSERT INTO mfa_challenges (token_hash, user_id, nonce, expires_at)
+		VALUES ($1, $2, $3, $4)
+	`
+	_, err := p.Conn.Exec(ctx, query, c.TokenHash, c.UserID, c.Nonce, c.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert mfa challenge: %w", err)
+	}
+
+	return nil
+}
+
+// ReplaceRecoveryCodes discards every recovery code of the user, used or not,
+// and stores codeHashes as the new set.
+func (p *PostgresConn) ReplaceRecoveryCodes(ctx context.Context, userID string, codeHashes []string) error {
+	tx, err := p.Conn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin recovery code replacement: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+
+	for _, codeHash := range codeHashes {
+		_, err := tx.Exec(ctx, `
+			INSERT INTO mfa_recovery_codes (user_id, code_hash)
+			VALUES ($1, $2)
+		`, userID, codeHash)
+		if err != nil {
+			return fmt.Errorf("failed to insert recovery code: %w", err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit recovery codes: %w", err)
+	}
+	return nil
+}
+
+var ErrWebAuthnCredentialExists = errors.New("webauthn credential is already registered")
+
+func (p *PostgresConn) InsertWebAuthnCredential(ctx context.Context, c WebAuthnCredential) error {
+	query := `
+		INSERT INTO webauthn_credentials (id, user_id, name, public_key, sign_count)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (id) DO NOTHING
+	`
+	result, err := p.Conn.Exec(ctx, query, c.ID, c.UserID, c.Name, c.PublicKey, c.SignCount)
+	if err != nil {
+		return fmt.Errorf("failed to insert webauthn credential: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrWebAuthnCredentialExists
+	}
+
+	return nil
+}
+
+func (p *PostgresConn) InsertWebAuthnChallenge(ctx context.Context, c WebAuthnChallenge) error {
+	query := `
+		INSERT INTO webauthn_challenges (challenge_hash, user_id, ceremony, nonce, expires_at)
+		VALUES ($1, NULLIF($2, ''), $3, $4, $5)
+	`
+	_, err := p.Conn.Exec(ctx, query, c.ChallengeHash, c.UserID, c.Ceremony, c.Nonce, c.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert webauthn challenge: %w", err)
+	}
+
+	return nil
+}
+
+var ErrMagicLinkUsed = errors.New("magic link has already been used")
+
+// RedeemMagicLink records that the magic link jti has been used. Links are
+// stateless until then; the row only has to outlive the link's expiry.
+func (p *PostgresConn) RedeemMagicLink(ctx context.Context, jti, userID string, expiresAt time.Time) error {
+	query := `
+		INSERT INTO magic_link_redemptions (jti, user_id, expires_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (jti) DO NOTHING
+	`
+	result, err := p.Conn.Exec(ctx, query, jti, userID, expiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to redeem magic link: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrMagicLinkUsed
+	}
+
+	return nil
+}
+
+var ErrEmailOTPCooldown = errors.New("an email otp was sent too recently")
+
+// UpsertEmailOTP stores c as the user's only valid login code, invalidating
+// any earlier one. It fails with ErrEmailOTPCooldown, leaving the current
+// code in place, when that code was created less than cooldown ago.
+// UpsertEmailOTP replaces the user's login code unless the current one is
+// younger than cooldown, and stores events, which carry the code, with it.
+// Nothing is stored when it fails with ErrEmailOTPCooldown.
+func (p *PostgresConn) UpsertEmailOTP(ctx context.Context, c EmailOTP, cooldown time.Duration, events ...OutboxEvent) error {
+	tx, err := p.Conn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin email otp upsert: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+		INSERT INTO email_otps (user_id, code_hash, expires_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE
+		SET code_hash = EXCLUDED.code_hash, attempts = 0, expires_at = EXCLUDED.expires_at, created_at = NOW()
+		WHERE email_otps.created_at <= NOW() - $4 * INTERVAL '1 second'
+	`
+	result, err := tx.Exec(ctx, query, c.UserID, c.CodeHash, c.ExpiresAt, cooldown.Seconds())
+	if err != nil {
+		return fmt.Errorf("failed to store email otp: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrEmailOTPCooldown
+	}
+
+	if err := insertOutboxEvents(ctx, tx, events); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit email otp upsert: %w", err)
+	}
 	return nil
 }
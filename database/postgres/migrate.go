@@ -0,0 +1,314 @@
+package postgres
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Migrations live in migrations/ as NNNN_name.up.sql and NNNN_name.down.sql.
+// Every schema change gets a new pair; applied files must never be edited.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is the advisory lock key that keeps replicas starting at the
+// same time from migrating concurrently.
+const migrationLockID = 7_261_930_401
+
+var ErrSchemaTooNew = errors.New("database schema is newer than this binary")
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+}
+
+// migrations is every embedded migration, ordered by version.
+var migrations = mustLoadMigrations(migrationFiles)
+
+func mustLoadMigrations(files fs.FS) []Migration {
+	loaded, err := loadMigrations(files)
+	if err != nil {
+		panic(err)
+	}
+	return loaded
+}
+
+func loadMigrations(files fs.FS) ([]Migration, error) {
+	entries, err := fs.Glob(files, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		base := path.Base(entry)
+		stem, direction, ok := strings.Cut(strings.TrimSuffix(base, ".sql"), ".")
+		number, name, found := strings.Cut(stem, "_")
+		version, err := strconv.Atoi(number)
+		if !ok || !found || err != nil || version <= 0 || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("invalid migration file name %q", base)
+		}
+
+		body, err := fs.ReadFile(files, entry)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %q: %w", base, err)
+		}
+
+		m, exists := byVersion[version]
+		if !exists {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if m.Name != name {
+			return nil, fmt.Errorf("migration %d has files named %q and %q", version, m.Name, name)
+		}
+		if direction == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	loaded := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+		loaded = append(loaded, *m)
+	}
+	slices.SortFunc(loaded, func(a, b Migration) int { return a.Version - b.Version })
+	return loaded, nil
+}
+
+// LatestSchemaVersion is the version of the newest migration built in.
+func LatestSchemaVersion() int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+func createMigrationsTable(ctx context.Context, conn *pgxpool.Conn) error {
+	_, err := conn.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version BIGINT PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+	return nil
+}
+
+// withMigrationLock runs fn on a single connection holding the migration
+// advisory lock, waiting for any other replica that holds it.
+func (p *PostgresConn) withMigrationLock(ctx context.Context, fn func(conn *pgxpool.Conn) error) error {
+	conn, err := p.Conn.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, migrationLockID); err != nil {
+		return fmt.Errorf("failed to take migration lock: %w", err)
+	}
+	defer func() {
+		// the lock belongs to the session, so it must be released even if ctx
+		// is done
+		unlockCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if _, err := conn.Exec(unlockCtx, `SELECT pg_advisory_unlock($1)`, migrationLockID); err != nil {
+			conn.Conn().Close(unlockCtx)
+		}
+	}()
+
+	if err := createMigrationsTable(ctx, conn); err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+func appliedMigrations(ctx context.Context, conn *pgxpool.Conn) (map[int]MigrationStatus, error) {
+	rows, err := conn.Query(ctx, `SELECT version, name, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := map[int]MigrationStatus{}
+	for rows.Next() {
+		var s MigrationStatus
+		var appliedAt time.Time
+		if err := rows.Scan(&s.Version, &s.Name, &appliedAt); err != nil {
+			return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+		}
+		s.AppliedAt = &appliedAt
+		applied[s.Version] = s
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+	return applied, nil
+}
+
+func checkSchemaNotNewer(applied map[int]MigrationStatus) error {
+	latest := LatestSchemaVersion()
+	for version := range applied {
+		if version > latest {
+			return fmt.Errorf("%w: migration %d is applied, the latest known is %d", ErrSchemaTooNew, version, latest)
+		}
+	}
+	return nil
+}
+
+func runMigration(ctx context.Context, conn *pgxpool.Conn, m Migration, up bool) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin migration %d: %w", m.Version, err)
+	}
+	defer tx.Rollback(ctx)
+
+	script, record, args := m.Up, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, []any{m.Version, m.Name}
+	if !up {
+		script, record, args = m.Down, `DELETE FROM schema_migrations WHERE version = $1`, []any{m.Version}
+	}
+
+	// the simple protocol allows several statements in one script
+	if _, err := tx.Exec(ctx, script, pgx.QueryExecModeSimpleProtocol); err != nil {
+		return fmt.Errorf("migration %d_%s failed: %w", m.Version, m.Name, err)
+	}
+	if _, err := tx.Exec(ctx, record, args...); err != nil {
+		return fmt.Errorf("failed to record migration %d: %w", m.Version, err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit migration %d: %w", m.Version, err)
+	}
+	return nil
+}
+
+// MigrateUp applies every migration that has not been applied yet, in order,
+// each in its own transaction. It returns the migrations it applied.
+func (p *PostgresConn) MigrateUp(ctx context.Context) ([]Migration, error) {
+	var done []Migration
+	err := p.withMigrationLock(ctx, func(conn *pgxpool.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if err := checkSchemaNotNewer(applied); err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			if err := runMigration(ctx, conn, m, true); err != nil {
+				return err
+			}
+			done = append(done, m)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// MigrateDown reverts the latest steps applied migrations, newest first. It
+// returns the migrations it reverted.
+func (p *PostgresConn) MigrateDown(ctx context.Context, steps int) ([]Migration, error) {
+	var done []Migration
+	err := p.withMigrationLock(ctx, func(conn *pgxpool.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if err := checkSchemaNotNewer(applied); err != nil {
+			return err
+		}
+
+		for i := len(migrations) - 1; i >= 0 && len(done) < steps; i-- {
+			m := migrations[i]
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+			if err := runMigration(ctx, conn, m, false); err != nil {
+				return err
+			}
+			done = append(done, m)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// MigrationStatuses lists every known migration with when it was applied, plus
+// any applied migration this binary does not know.
+func (p *PostgresConn) MigrationStatuses(ctx context.Context) ([]MigrationStatus, error) {
+	var statuses []MigrationStatus
+	err := p.withMigrationLock(ctx, func(conn *pgxpool.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+			s := MigrationStatus{Version: m.Version, Name: m.Name}
+			if a, ok := applied[m.Version]; ok {
+				s.AppliedAt = a.AppliedAt
+				delete(applied, m.Version)
+			}
+			statuses = append(statuses, s)
+		}
+		for _, a := range applied {
+			statuses = append(statuses, a)
+		}
+		slices.SortFunc(statuses, func(a, b MigrationStatus) int { return a.Version - b.Version })
+		return nil
+	})
+	return statuses, err
+}
+
+// PendingMigrations returns the known migrations not applied yet. It fails
+// with ErrSchemaTooNew when the database has migrations this binary does not
+// know.
+func (p *PostgresConn) PendingMigrations(ctx context.Context) ([]Migration, error) {
+	var pending []Migration
+	err := p.withMigrationLock(ctx, func(conn *pgxpool.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if err := checkSchemaNotNewer(applied); err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; !ok {
+				pending = append(pending, m)
+			}
+		}
+		return nil
+	})
+	return pending, err
+}
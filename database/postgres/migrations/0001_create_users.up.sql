@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS users (
+	userId TEXT PRIMARY KEY,
+	email VARCHAR(100) NOT NULL,
+	hashedPassword TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	updated_at TIMESTAMPTZ DEFAULT NOW()
+);
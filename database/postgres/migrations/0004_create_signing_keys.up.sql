@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS signing_keys (
+	kid TEXT PRIMARY KEY,
+	algorithm TEXT NOT NULL,
+	private_key BYTEA,
+	state TEXT NOT NULL CHECK (state IN ('active', 'retiring', 'retired')),
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	retiring_at TIMESTAMPTZ,
+	retire_after TIMESTAMPTZ,
+	retired_at TIMESTAMPTZ
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS signing_keys_single_active_idx ON signing_keys (state) WHERE state = 'active';
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS totp_credentials (
+	user_id TEXT PRIMARY KEY REFERENCES users(userId) ON DELETE CASCADE,
+	secret BYTEA NOT NULL,
+	confirmed_at TIMESTAMPTZ,
+	last_used_step BIGINT NOT NULL DEFAULT 0,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS mfa_challenges (
+	token_hash TEXT PRIMARY KEY,
+	user_id TEXT NOT NULL REFERENCES users(userId) ON DELETE CASCADE,
+	nonce TEXT NOT NULL DEFAULT '',
+	attempts INT NOT NULL DEFAULT 0,
+	expires_at TIMESTAMPTZ NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	consumed_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS mfa_challenges_expires_at_idx ON mfa_challenges (expires_at);
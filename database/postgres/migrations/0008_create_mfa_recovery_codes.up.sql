@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+	user_id TEXT NOT NULL REFERENCES users(userId) ON DELETE CASCADE,
+	code_hash TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	used_at TIMESTAMPTZ,
+	PRIMARY KEY (user_id, code_hash)
+);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS magic_link_redemptions (
+	jti TEXT PRIMARY KEY,
+	user_id TEXT NOT NULL REFERENCES users(userId) ON DELETE CASCADE,
+	expires_at TIMESTAMPTZ NOT NULL,
+	redeemed_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS magic_link_redemptions_expires_at_idx ON magic_link_redemptions (expires_at);
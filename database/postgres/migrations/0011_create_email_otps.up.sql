@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS email_otps (
+	user_id TEXT PRIMARY KEY REFERENCES users(userId) ON DELETE CASCADE,
+	code_hash TEXT NOT NULL,
+	attempts INT NOT NULL DEFAULT 0,
+	expires_at TIMESTAMPTZ NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS email_otps_expires_at_idx ON email_otps (expires_at);
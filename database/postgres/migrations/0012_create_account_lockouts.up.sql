@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS account_lockouts (
+	user_id TEXT PRIMARY KEY REFERENCES users(userId) ON DELETE CASCADE,
+	failed_attempts INT NOT NULL DEFAULT 0,
+	lockouts INT NOT NULL DEFAULT 0,
+	locked_until TIMESTAMPTZ,
+	last_failed_at TIMESTAMPTZ,
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
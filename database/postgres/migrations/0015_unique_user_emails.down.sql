@@ -0,0 +1,3 @@
+-- lowercased addresses are left as they are, and the column stays wide
+-- enough for addresses stored since
+DROP INDEX IF EXISTS users_email_lower_idx;
@@ -0,0 +1,5 @@
+-- addresses used to be stored as entered; duplicates left over from that
+-- must be merged by hand before the unique index can be built
+UPDATE users SET email = LOWER(TRIM(email)) WHERE email <> LOWER(TRIM(email));
+ALTER TABLE users ALTER COLUMN email TYPE VARCHAR(254);
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_lower_idx ON users (LOWER(email));
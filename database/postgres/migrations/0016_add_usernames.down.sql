@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS users_username_lower_idx;
+ALTER TABLE users DROP COLUMN IF EXISTS username;
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS auth_events (
+	id BIGSERIAL PRIMARY KEY,
+	type TEXT NOT NULL,
+	user_id TEXT NOT NULL DEFAULT '',
+	email TEXT NOT NULL DEFAULT '',
+	outcome TEXT NOT NULL,
+	reason TEXT NOT NULL DEFAULT '',
+	client_ip TEXT NOT NULL DEFAULT '',
+	user_agent TEXT NOT NULL DEFAULT '',
+	service_name TEXT NOT NULL DEFAULT '',
+	request_id TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS auth_events_created_at_idx ON auth_events (created_at);
+CREATE INDEX IF NOT EXISTS auth_events_user_id_idx ON auth_events (user_id, id) WHERE user_id <> '';
+CREATE INDEX IF NOT EXISTS auth_events_email_idx ON auth_events (email, id) WHERE email <> '';
+CREATE INDEX IF NOT EXISTS auth_events_client_ip_idx ON auth_events (client_ip, id) WHERE client_ip <> '';
+CREATE INDEX IF NOT EXISTS auth_events_type_idx ON auth_events (type, id);
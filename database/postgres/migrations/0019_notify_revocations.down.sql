@@ -0,0 +1,4 @@
+DROP TRIGGER IF EXISTS session_revocations_notify ON session_revocations;
+DROP TRIGGER IF EXISTS revoked_tokens_notify ON revoked_tokens;
+DROP FUNCTION IF EXISTS notify_session_revocation();
+DROP FUNCTION IF EXISTS notify_token_revocation();
@@ -0,0 +1,32 @@
+-- Replicas LISTEN on token_revocations to apply revocations as soon as they
+-- are committed instead of waiting for their next sync.
+CREATE OR REPLACE FUNCTION notify_token_revocation() RETURNS trigger AS $$
+BEGIN
+	PERFORM pg_notify('token_revocations', json_build_object(
+		'jti', NEW.jti,
+		'user_id', NEW.user_id,
+		'expires_at', NEW.expires_at
+	)::text);
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION notify_session_revocation() RETURNS trigger AS $$
+BEGIN
+	PERFORM pg_notify('token_revocations', json_build_object(
+		'user_id', NEW.user_id,
+		'revoked_before', NEW.revoked_before
+	)::text);
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS revoked_tokens_notify ON revoked_tokens;
+CREATE TRIGGER revoked_tokens_notify
+	AFTER INSERT ON revoked_tokens
+	FOR EACH ROW EXECUTE FUNCTION notify_token_revocation();
+
+DROP TRIGGER IF EXISTS session_revocations_notify ON session_revocations;
+CREATE TRIGGER session_revocations_notify
+	AFTER INSERT OR UPDATE ON session_revocations
+	FOR EACH ROW EXECUTE FUNCTION notify_session_revocation();
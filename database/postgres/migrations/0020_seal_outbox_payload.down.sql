@@ -0,0 +1,12 @@
+-- Sealed payloads cannot be read back as JSON. Refuse while unsent events
+-- still hold one rather than dropping them; let the relay drain the outbox
+-- first. Sent events have no payload left to lose.
+DO $$
+BEGIN
+	IF EXISTS (SELECT 1 FROM outbox WHERE sent_at IS NULL AND payload IS NOT NULL) THEN
+		RAISE EXCEPTION 'outbox still holds unsent events, relay them before reverting 0020';
+	END IF;
+END
+$$;
+
+ALTER TABLE outbox ALTER COLUMN payload TYPE JSONB USING NULL;
@@ -0,0 +1,3 @@
+-- Payloads are sealed with AUTH_MASTER_KEY by the service from now on. Rows
+-- still waiting hold plain JSON, which the relay publishes as it is.
+ALTER TABLE outbox ALTER COLUMN payload TYPE BYTEA USING convert_to(payload::text, 'UTF8');
@@ -0,0 +1,6 @@
+-- a pending key has never signed a token and can be dropped
+DELETE FROM signing_keys WHERE state = 'pending';
+DROP INDEX IF EXISTS signing_keys_single_pending_idx;
+ALTER TABLE signing_keys DROP COLUMN IF EXISTS activate_after;
+ALTER TABLE signing_keys DROP CONSTRAINT IF EXISTS signing_keys_state_check;
+ALTER TABLE signing_keys ADD CONSTRAINT signing_keys_state_check CHECK (state IN ('active', 'retiring', 'retired'));
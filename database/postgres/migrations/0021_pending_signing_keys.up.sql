@@ -0,0 +1,8 @@
+-- A rotation first adds the next key as pending. It is published in the JWKS
+-- but only starts signing after activate_after, once cached copies of the
+-- JWKS have had time to pick it up.
+ALTER TABLE signing_keys DROP CONSTRAINT IF EXISTS signing_keys_state_check;
+ALTER TABLE signing_keys ADD CONSTRAINT signing_keys_state_check CHECK (state IN ('pending', 'active', 'retiring', 'retired'));
+ALTER TABLE signing_keys ADD COLUMN IF NOT EXISTS activate_after TIMESTAMPTZ;
+
+CREATE UNIQUE INDEX IF NOT EXISTS signing_keys_single_pending_idx ON signing_keys (state) WHERE state = 'pending';
@@ -0,0 +1,4 @@
+-- Dead events become pending again and are retried
+DROP INDEX IF EXISTS outbox_unsent_idx;
+CREATE INDEX IF NOT EXISTS outbox_unsent_idx ON outbox (id) WHERE sent_at IS NULL;
+ALTER TABLE outbox DROP COLUMN IF EXISTS dead_at;
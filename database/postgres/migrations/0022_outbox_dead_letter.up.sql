@@ -0,0 +1,7 @@
+-- An event that still fails after the relay's maximum number of attempts is
+-- set aside with dead_at, so that it no longer holds up the events behind it.
+-- Clearing dead_at puts it back in line.
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS dead_at TIMESTAMPTZ;
+
+DROP INDEX IF EXISTS outbox_unsent_idx;
+CREATE INDEX IF NOT EXISTS outbox_unsent_idx ON outbox (id) WHERE sent_at IS NULL AND dead_at IS NULL;
@@ -0,0 +1,140 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// outboxLockID is the advisory lock key that lets only one replica relay the
+// outbox at a time, so that no event is published by two replicas at once.
+const outboxLockID = 7_261_930_402
+
+func insertOutboxEvents(ctx context.Context, tx pgx.Tx, events []OutboxEvent) error {
+	for _, e := range events {
+		_, err := tx.Exec(ctx, `
+			INSERT INTO outbox (exchange, routing_key, payload)
+			VALUES ($1, $2, $3)
+		`, e.Exchange, e.RoutingKey, e.Payload)
+		if err != nil {
+			return fmt.Errorf("failed to insert outbox event: %w", err)
+		}
+	}
+	return nil
+}
+
+// InsertOutboxEvents stores events that are not part of a larger change.
+func (p *PostgresConn) InsertOutboxEvents(ctx context.Context, events ...OutboxEvent) error {
+	tx, err := p.Conn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin outbox insert: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := insertOutboxEvents(ctx, tx, events); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit outbox insert: %w", err)
+	}
+	return nil
+}
+
+// RelayOutboxEvents hands the unsent events with the lowest ids, up to limit,
+// to publish and marks each one sent as soon as publish succeeds. Ids follow
+// insertion, not commit, so events of concurrent transactions may go out in
+// either order. A failure is recorded against the event and stops the batch,
+// unless it was the event's maxAttempts-th attempt: then the event is marked
+// dead and skipped from now on, so it cannot hold up the rest forever. If
+// another replica is relaying already it does nothing. It returns how many
+// events were sent.
+func (p *PostgresConn) RelayOutboxEvents(ctx context.Context, limit, maxAttempts int, publish func(OutboxEvent) error) (int, error) {
+	conn, err := p.Conn.Acquire(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	defer conn.Release()
+
+	var locked bool
+	if err := conn.QueryRow(ctx, `SELECT pg_try_advisory_lock($1)`, outboxLockID).Scan(&locked); err != nil {
+		return 0, fmt.Errorf("failed to take outbox lock: %w", err)
+	}
+	if !locked {
+		return 0, nil
+	}
+	defer func() {
+		unlockCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if _, err := conn.Exec(unlockCtx, `SELECT pg_advisory_unlock($1)`, outboxLockID); err != nil {
+			conn.Conn().Close(unlockCtx)
+		}
+	}()
+
+	rows, err := conn.Query(ctx, `
+		SELECT id, exchange, routing_key, payload, attempts, last_error, created_at
+		FROM outbox
+		WHERE sent_at IS NULL AND dead_at IS NULL
+		ORDER BY id
+		LIMIT $1
+	`, limit)
+	if err != nil {
+		return 0, fmt.Errorf("failed to retrieve outbox events: %w", err)
+	}
+	defer rows.Close()
+
+	var events []OutboxEvent
+	for rows.Next() {
+		var e OutboxEvent
+		if err := rows.Scan(&e.ID, &e.Exchange, &e.RoutingKey, &e.Payload, &e.Attempts, &e.LastError, &e.CreatedAt); err != nil {
+			return 0, fmt.Errorf("failed to scan outbox event: %w", err)
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to retrieve outbox events: %w", err)
+	}
+
+	sent := 0
+	for _, e := range events {
+		if err := publish(e); err != nil {
+			var dead bool
+			recordErr := conn.QueryRow(ctx, `
+				UPDATE outbox
+				SET attempts = attempts + 1, last_error = $2,
+					dead_at = CASE WHEN attempts + 1 >= $3 THEN NOW() END
+				WHERE id = $1
+				RETURNING dead_at IS NOT NULL
+			`, e.ID, err.Error(), maxAttempts).Scan(&dead)
+			if recordErr != nil {
+				return sent, fmt.Errorf("failed to record outbox event failure: %w", recordErr)
+			}
+			if dead {
+				continue
+			}
+			return sent, fmt.Errorf("failed to publish outbox event %d: %w", e.ID, err)
+		}
+
+		_, err := conn.Exec(ctx, `
+			UPDATE outbox
+			SET sent_at = NOW(), payload = NULL, attempts = attempts + 1, last_error = ''
+			WHERE id = $1
+		`, e.ID)
+		if err != nil {
+			return sent, fmt.Errorf("failed to mark outbox event %d as sent: %w", e.ID, err)
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// DeleteSentOutboxEvents drops events sent before the given time.
+func (p *PostgresConn) DeleteSentOutboxEvents(ctx context.Context, before time.Time) (int64, error) {
+	result, err := p.Conn.Exec(ctx, `DELETE FROM outbox WHERE sent_at < $1`, before)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete sent outbox events: %w", err)
+	}
+	return result.RowsAffected(), nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/jackc/pgx/v5"
 )
@@ -12,9 +13,9 @@ var ErrInvalidUser = errors.New("user do not exists ")
 
 func (p *PostgresConn) GetUser(ctx context.Context, email string) (*User, error) {
 	query := `
-		SELECT userId, email, hashedPassword, created_at, updated_at
+		SELECT userId, email, hashedPassword, email_verified, email_verified_at, created_at, updated_at, password_breached_at, username
 		FROM users
-		WHERE email = $1
+		WHERE LOWER(email) = LOWER($1)
 	`
 
 	u := &User{}
@@ -22,8 +23,12 @@ func (p *PostgresConn) GetUser(ctx context.Context, email string) (*User, error)
 		&u.UserID,
 		&u.Email,
 		&u.HashedPassword,
+		&u.EmailVerified,
+		&u.EmailVerifiedAt,
 		&u.CreatedAt,
 		&u.UpdatedAt,
+		&u.PasswordBreachedAt,
+		&u.Username,
 	)
 
 	if err != nil {
@@ -34,3 +39,396 @@ func (p *PostgresConn) GetUser(ctx context.Context, email string) (*User, error)
 	}
 	return u, nil
 }
+
+func (p *PostgresConn) GetUserByID(ctx context.Context, userID string) (*User, error) {
+	query := `
+		SELECT userId, email, hashedPassword, email_verified, email_verified_at, created_at, updated_at, password_breached_at, username
+		FROM users
+		WHERE userId = $1
+	`
+
+	u := &User{}
+	err := p.Conn.QueryRow(ctx, query, userID).Scan(
+		&u.UserID,
+		&u.Email,
+		&u.HashedPassword,
+		&u.EmailVerified,
+		&u.EmailVerifiedAt,
+		&u.CreatedAt,
+		&u.UpdatedAt,
+		&u.PasswordBreachedAt,
+		&u.Username,
+	)
+
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, ErrInvalidUser
+		}
+		return nil, fmt.Errorf("failed to retrieve user: %w", err)
+	}
+	return u, nil
+}
+
+func (p *PostgresConn) GetUserByUsername(ctx context.Context, username string) (*User, error) {
+	query := `
+		SELECT userId, email, hashedPassword, email_verified, email_verified_at, created_at, updated_at, password_breached_at, username
+		FROM users
+		WHERE LOWER(username) = LOWER($1)
+	`
+
+	u := &User{}
+	err := p.Conn.QueryRow(ctx, query, username).Scan(
+		&u.UserID,
+		&u.Email,
+		&u.HashedPassword,
+		&u.EmailVerified,
+		&u.EmailVerifiedAt,
+		&u.CreatedAt,
+		&u.UpdatedAt,
+		&u.PasswordBreachedAt,
+		&u.Username,
+	)
+
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, ErrInvalidUser
+		}
+		return nil, fmt.Errorf("failed to retrieve user: %w", err)
+	}
+	return u, nil
+}
+
+var ErrInvalidRefreshToken = errors.New("refresh token does not exist")
+
+func (p *PostgresConn) GetRefreshToken(ctx context.Context, tokenHash string) (*RefreshToken, error) {
+	query := `
+		SELECT id, user_id, family_id, token_hash, expires_at, created_at, rotated_at, revoked_at
+		FROM refresh_tokens
+		WHERE token_hash = $1
+	`
+
+	t := &RefreshToken{}
+	err := p.Conn.QueryRow(ctx, query, tokenHash).Scan(
+		&t.ID,
+		&t.UserID,
+		&t.FamilyID,
+		&t.TokenHash,
+		&t.ExpiresAt,
+		&t.CreatedAt,
+		&t.RotatedAt,
+		&t.RevokedAt,
+	)
+
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, ErrInvalidRefreshToken
+		}
+		return nil, fmt.Errorf("failed to retrieve refresh token: %w", err)
+	}
+	return t, nil
+}
+
+// IsRevoked reports whether the access token with the given jti, issued to
+// userID at issuedAt, was revoked by Revoke or RevokeSessions.
+func (p *PostgresConn) IsRevoked(ctx context.Context, jti, userID string, issuedAt time.Time) (bool, error) {
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM revoked_tokens WHERE jti = $1 AND expires_at > NOW()
+		) OR EXISTS (
+			SELECT 1 FROM session_revocations WHERE user_id = $2 AND revoked_before > $3
+		)
+	`
+
+	var revoked bool
+	if err := p.Conn.QueryRow(ctx, query, jti, userID, issuedAt).Scan(&revoked); err != nil {
+		return false, fmt.Errorf("failed to check token revocation: %w", err)
+	}
+	return revoked, nil
+}
+
+// GetRevokedTokensSince returns the still-unexpired revocations recorded after
+// since, so that each replica can keep its in-memory revocation list in sync.
+func (p *PostgresConn) GetRevokedTokensSince(ctx context.Context, since time.Time) ([]RevokedToken, error) {
+	query := `
+		SELECT jti, user_id, expires_at, revoked_at
+		FROM revoked_tokens
+		WHERE revoked_at > $1 AND expires_at > NOW()
+		ORDER BY revoked_at
+	`
+
+	rows, err := p.Conn.Query(ctx, query, since)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve revoked tokens: %w", err)
+	}
+	defer rows.Close()
+
+	var tokens []RevokedToken
+	for rows.Next() {
+		var t RevokedToken
+		if err := rows.Scan(&t.JTI, &t.UserID, &t.ExpiresAt, &t.RevokedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan revoked token: %w", err)
+		}
+		tokens = append(tokens, t)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to retrieve revoked tokens: %w", err)
+	}
+	return tokens, nil
+}
+
+// GetSigningKeys returns the pending key, the active key and every retiring
+// key that tokens may still be verified with.
+func (p *PostgresConn) GetSigningKeys(ctx context.Context) ([]SigningKey, error) {
+	query := `
+		SELECT kid, algorithm, private_key, state, created_at, activate_after, retiring_at, retire_after, retired_at
+		FROM signing_keys
+		WHERE state IN ('pending', 'active', 'retiring')
+		ORDER BY created_at
+	`
+
+	rows, err := p.Conn.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve signing keys: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []SigningKey
+	for rows.Next() {
+		var k SigningKey
+		err := rows.Scan(
+			&k.KID,
+			&k.Algorithm,
+			&k.PrivateKey,
+			&k.State,
+			&k.CreatedAt,
+			&k.ActivateAfter,
+			&k.RetiringAt,
+			&k.RetireAfter,
+			&k.RetiredAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan signing key: %w", err)
+		}
+		keys = append(keys, k)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to retrieve signing keys: %w", err)
+	}
+	return keys, nil
+}
+
+// GetLastEmailVerificationSentAt returns when the newest verification token
+// for userID was created, or the zero time if none was ever sent.
+func (p *PostgresConn) GetLastEmailVerificationSentAt(ctx context.Context, userID string) (time.Time, error) {
+	query := `
+		SELECT MAX(created_at)
+		FROM email_verification_tokens
+		WHERE user_id = $1
+	`
+
+	var sentAt *time.Time
+	if err := p.Conn.QueryRow(ctx, query, userID).Scan(&sentAt); err != nil {
+		return time.Time{}, fmt.Errorf("failed to retrieve email verification token: %w", err)
+	}
+	if sentAt == nil {
+		return time.Time{}, nil
+	}
+	return *sentAt, nil
+}
+
+func (p *PostgresConn) GetSessionRevocationsSince(ctx context.Context, since time.Time) ([]SessionRevocation, error) {
+	query := `
+		SELECT user_id, revoked_before, updated_at
+		FROM session_revocations
+		WHERE updated_at > $1
+		ORDER BY updated_at
+	`
+
+	rows, err := p.Conn.Query(ctx, query, since)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve session revocations: %w", err)
+	}
+	defer rows.Close()
+
+	var revocations []SessionRevocation
+	for rows.Next() {
+		var s SessionRevocation
+		if err := rows.Scan(&s.UserID, &s.RevokedBefore, &s.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan session revocation: %w", err)
+		}
+		revocations = append(revocations, s)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to retrieve session revocations: %w", err)
+	}
+	return revocations, nil
+}
+
+var ErrTOTPNotFound = errors.New("totp is not set up")
+
+func (p *PostgresConn) GetTOTP(ctx context.Context, userID string) (*TOTPCredential, error) {
+	query := `
+		SELECT user_id, secret, confirmed_at, last_used_step, created_at
+		FROM totp_credentials
+		WHERE user_id = $1
+	`
+
+	c := &TOTPCredential{}
+	err := p.Conn.QueryRow(ctx, query, userID).Scan(
+		&c.UserID,
+		&c.Secret,
+		&c.ConfirmedAt,
+		&c.LastUsedStep,
+		&c.CreatedAt,
+	)
+
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, ErrTOTPNotFound
+		}
+		return nil, fmt.Errorf("failed to retrieve totp: %w", err)
+	}
+	return c, nil
+}
+
+var ErrInvalidMFAChallenge = errors.New("mfa challenge does not exist")
+
+func (p *PostgresConn) GetMFAChallenge(ctx context.Context, tokenHash string) (*MFAChallenge, error) {
+	query := `
+		SELECT token_hash, user_id, nonce, attempts, expires_at, created_at, consumed_at
+		FROM mfa_challenges
+		WHERE token_hash = $1
+	`
+
+	c := &MFAChallenge{}
+	err := p.Conn.QueryRow(ctx, query, tokenHash).Scan(
+		&c.TokenHash,
+		&c.UserID,
+		&c.Nonce,
+		&c.Attempts,
+		&c.ExpiresAt,
+		&c.CreatedAt,
+		&c.ConsumedAt,
+	)
+
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, ErrInvalidMFAChallenge
+		}
+		return nil, fmt.Errorf("failed to retrieve mfa challenge: %w", err)
+	}
+	return c, nil
+}
+
+func (p *PostgresConn) CountUnusedRecoveryCodes(ctx context.Context, userID string) (int, error) {
+	query := `
+		SELECT COUNT(*)
+		FROM mfa_recovery_codes
+		WHERE user_id = $1 AND used_at IS NULL
+	`
+
+	var count int
+	if err := p.Conn.QueryRow(ctx, query, userID).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count recovery codes: %w", err)
+	}
+	return count, nil
+}
+
+var ErrWebAuthnCredentialNotFound = errors.New("webauthn credential does not exist")
+
+func (p *PostgresConn) GetWebAuthnCredential(ctx context.Context, id string) (*WebAuthnCredential, error) {
+	query := `
+		SELECT id, user_id, name, public_key, sign_count, created_at, last_used_at
+		FROM webauthn_credentials
+		WHERE id = $1
+	`
+
+	c := &WebAuthnCredential{}
+	err := p.Conn.QueryRow(ctx, query, id).Scan(
+		&c.ID,
+		&c.UserID,
+		&c.Name,
+		&c.PublicKey,
+		&c.SignCount,
+		&c.CreatedAt,
+		&c.LastUsedAt,
+	)
+
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, ErrWebAuthnCredentialNotFound
+		}
+		return nil, fmt.Errorf("failed to retrieve webauthn credential: %w", err)
+	}
+	return c, nil
+}
+
+func (p *PostgresConn) GetWebAuthnCredentials(ctx context.Context, userID string) ([]WebAuthnCredential, error) {
+	query := `
+		SELECT id, user_id, name, public_key, sign_count, created_at, last_used_at
+		FROM webauthn_credentials
+		WHERE user_id = $1
+		ORDER BY created_at
+	`
+
+	rows, err := p.Conn.Query(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve webauthn credentials: %w", err)
+	}
+	defer rows.Close()
+
+	var credentials []WebAuthnCredential
+	for rows.Next() {
+		var c WebAuthnCredential
+		if err := rows.Scan(&c.ID, &c.UserID, &c.Name, &c.PublicKey, &c.SignCount, &c.CreatedAt, &c.LastUsedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan webauthn credential: %w", err)
+		}
+		credentials = append(credentials, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to retrieve webauthn credentials: %w", err)
+	}
+	return credentials, nil
+}
+
+// GetLockedUntil returns when the user's account lock ends, or nil when the
+// account has never been locked.
+func (p *PostgresConn) GetLockedUntil(ctx context.Context, userID string) (*time.Time, error) {
+	var lockedUntil *time.Time
+	err := p.Conn.QueryRow(ctx, `SELECT locked_until FROM account_lockouts WHERE user_id = $1`, userID).Scan(&lockedUntil)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to retrieve account lock: %w", err)
+	}
+	return lockedUntil, nil
+}
+
+func (p *PostgresConn) GetPasswordResetToken(ctx context.Context, tokenHash string) (*PasswordResetToken, error) {
+	query := `
+		SELECT token_hash, user_id, expires_at, created_at, used_at
+		FROM password_reset_tokens
+		WHERE token_hash = $1
+	`
+
+	t := &PasswordResetToken{}
+	err := p.Conn.QueryRow(ctx, query, tokenHash).Scan(
+		&t.TokenHash,
+		&t.UserID,
+		&t.ExpiresAt,
+		&t.CreatedAt,
+		&t.UsedAt,
+	)
+
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, ErrInvalidResetToken
+		}
+		return nil, fmt.Errorf("failed to retrieve password reset token: %w", err)
+	}
+	return t, nil
+}
@@ -0,0 +1,58 @@
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// revocationChannel is notified by triggers on revoked_tokens and
+// session_revocations whenever a row is written.
+const revocationChannel = "token_revocations"
+
+// RevocationNotice announces a revocation committed by any replica. JTI is
+// set for a single revoked token and empty for a session cutoff, which only
+// carries RevokedBefore.
+type RevocationNotice struct {
+	JTI           string    `json:"jti"`
+	UserID        string    `json:"user_id"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	RevokedBefore time.Time `json:"revoked_before"`
+}
+
+// ListenRevocations passes every revocation committed from now on to handle,
+// until ctx is cancelled or the connection fails. listening is called once
+// notifications are being received, so that the caller can catch up on
+// anything committed before without leaving a gap.
+func (p *PostgresConn) ListenRevocations(ctx context.Context, listening func(), handle func(RevocationNotice)) error {
+	conn, err := p.Conn.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	// a connection that is still listening must not go back to the pool
+	defer func() {
+		closeCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn.Conn().Close(closeCtx)
+		conn.Release()
+	}()
+
+	if _, err := conn.Exec(ctx, "LISTEN "+revocationChannel); err != nil {
+		return fmt.Errorf("failed to listen for revocations: %w", err)
+	}
+	listening()
+
+	for {
+		notification, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to wait for revocations: %w", err)
+		}
+
+		var notice RevocationNotice
+		if err := json.Unmarshal([]byte(notification.Payload), &notice); err != nil {
+			continue
+		}
+		handle(notice)
+	}
+}
@@ -5,35 +5,738 @@ import (
 	"errors"
 	"fmt"
 	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 )
 
 var ErrUsernameTaken = errors.New("username is already taken")
 
-func (p *PostgresConn) UpdateUsername(context context.Context, userID, newUsername string) error {
+// UpdateUsername sets the user's username, or removes it when newUsername is
+// empty. It returns the previous username, empty if there was none.
+func (p *PostgresConn) UpdateUsername(ctx context.Context, userID, newUsername string) (string, error) {
 	query := `
-		UPDATE users
+		UPDATE users AS u
 		SET
-			username   = $1,
-			updated_at = $2
-		WHERE user_id = $3
+			username   = NULLIF($1, ''),
+			updated_at = NOW()
+		FROM users AS old
+		WHERE u.userId = $2 AND old.userId = u.userId
+		RETURNING COALESCE(old.username, '')
+	`
+
+	var previous string
+	err := p.Conn.QueryRow(ctx, query, newUsername, userID).Scan(&previous)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+			return "", ErrUsernameTaken
+		}
+		if err == pgx.ErrNoRows {
+			return "", ErrInvalidUser
+		}
+		return "", fmt.Errorf("failed to update username: %w", err)
+	}
+
+	return previous, nil
+}
+
+var ErrRefreshTokenReused = errors.New("refresh token has already been used")
+
+// RotateRefreshToken marks the token identified by oldID as rotated and stores
+// its replacement in the same transaction. ErrRefreshTokenReused is returned
+// when the old token was already rotated or revoked, which callers must treat
+// as a replay of a stolen token.
+func (p *PostgresConn) RotateRefreshToken(ctx context.Context, oldID string, next RefreshToken) error {
+	tx, err := p.Conn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin refresh token rotation: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	result, err := tx.Exec(ctx, `
+		UPDATE refresh_tokens
+		SET rotated_at = NOW()
+		WHERE id = $1 AND rotated_at IS NULL AND revoked_at IS NULL
+	`, oldID)
+	if err != nil {
+		return fmt.Errorf("failed to rotate refresh token: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrRefreshTokenReused
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO refresh_tokens (id, user_id, family_id, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`, next.ID, next.UserID, next.FamilyID, next.TokenHash, next.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert rotated refresh token: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit refresh token rotation: %w", err)
+	}
+	return nil
+}
+
+func (p *PostgresConn) RevokeRefreshTokenFamily(ctx context.Context, familyID string) error {
+	query := `
+		UPDATE refresh_tokens
+		SET revoked_at = NOW()
+		WHERE family_id = $1 AND revoked_at IS NULL
+	`
+
+	if _, err := p.Conn.Exec(ctx, query, familyID); err != nil {
+		return fmt.Errorf("failed to revoke refresh token family: %w", err)
+	}
+	return nil
+}
+
+func (p *PostgresConn) DeleteExpiredRevokedTokens(ctx context.Context) (int64, error) {
+	result, err := p.Conn.Exec(ctx, `DELETE FROM revoked_tokens WHERE expires_at <= NOW()`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired revoked tokens: %w", err)
+	}
+	return result.RowsAffected(), nil
+}
+
+var ErrSigningKeyRotated = errors.New("signing key was already rotated")
+
+// RotateSigningKey moves currentKID into the retiring state, where it keeps
+// verifying tokens until retireAfter, and makes the pending key nextKID the
+// active key. It returns ErrSigningKeyRotated if currentKID is no longer the
+// active key or nextKID is not a pending key due for activation, which
+// happens when another replica rotated first.
+func (p *PostgresConn) RotateSigningKey(ctx context.Context, currentKID, nextKID string, retireAfter time.Time) error {
+	tx, err := p.Conn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin signing key rotation: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	result, err := tx.Exec(ctx, `
+		UPDATE signing_keys
+		SET state = 'retiring', retiring_at = NOW(), retire_after = $2
+		WHERE kid = $1 AND state = 'active'
+	`, currentKID, retireAfter)
+	if err != nil {
+		return fmt.Errorf("failed to retire signing key: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrSigningKeyRotated
+	}
+
+	result, err = tx.Exec(ctx, `
+		UPDATE signing_keys
+		SET state = 'active'
+		WHERE kid = $1 AND state = 'pending' AND activate_after <= NOW()
+	`, nextKID)
+	if err != nil {
+		return fmt.Errorf("failed to activate signing key: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrSigningKeyRotated
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit signing key rotation: %w", err)
+	}
+	return nil
+}
+
+// RetireSigningKeys retires every key whose grace period is over and erases
+// its private key material.
+func (p *PostgresConn) RetireSigningKeys(ctx context.Context) (int64, error) {
+	query := `
+		UPDATE signing_keys
+		SET state = 'retired', retired_at = NOW(), private_key = NULL
+		WHERE state = 'retiring' AND retire_after <= NOW()
+	`
+
+	result, err := p.Conn.Exec(ctx, query)
+	if err != nil {
+		return 0, fmt.Errorf("failed to retire signing keys: %w", err)
+	}
+	return result.RowsAffected(), nil
+}
+
+var ErrInvalidVerificationToken = errors.New("verification token is invalid or expired")
+
+// VerifyEmail burns the verification token and marks its user's email as
+// verified. Every other outstanding token of that user is burned as well.
+func (p *PostgresConn) VerifyEmail(ctx context.Context, tokenHash string) (string, error) {
+	tx, err := p.Conn.Begin(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to begin email verification: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var userID string
+	err = tx.QueryRow(ctx, `
+		UPDATE email_verification_tokens
+		SET used_at = NOW()
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+		RETURNING user_id
+	`, tokenHash).Scan(&userID)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return "", ErrInvalidVerificationToken
+		}
+		return "", fmt.Errorf("failed to use verification token: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE email_verification_tokens
+		SET used_at = NOW()
+		WHERE user_id = $1 AND used_at IS NULL
+	`, userID)
+	if err != nil {
+		return "", fmt.Errorf("failed to burn verification tokens: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE users
+		SET email_verified = TRUE, email_verified_at = NOW(), updated_at = NOW()
+		WHERE userId = $1
+	`, userID)
+	if err != nil {
+		return "", fmt.Errorf("failed to mark email as verified: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return "", fmt.Errorf("failed to commit email verification: %w", err)
+	}
+	return userID, nil
+}
+
+// DeleteSessionRevocationsBefore drops cutoffs older than before; every token
+// they could reject has expired by then.
+func (p *PostgresConn) DeleteSessionRevocationsBefore(ctx context.Context, before time.Time) (int64, error) {
+	result, err := p.Conn.Exec(ctx, `DELETE FROM session_revocations WHERE revoked_before < $1`, before)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete session revocations: %w", err)
+	}
+	return result.RowsAffected(), nil
+}
+
+var ErrInvalidResetToken = errors.New("password reset token is invalid or expired")
+
+// ResetPassword burns the reset token, stores the new password hash, revokes
+// every refresh token of the user and every access token issued before
+// revokedBefore in one transaction. It returns the ID of the user whose
+// password was reset.
+func (p *PostgresConn) ResetPassword(ctx context.Context, tokenHash, hashedPassword string, revokedBefore time.Time) (string, error) {
+	tx, err := p.Conn.Begin(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to begin password reset: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var userID string
+	err = tx.QueryRow(ctx, `
+		UPDATE password_reset_tokens
+		SET used_at = NOW()
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+		RETURNING user_id
+	`, tokenHash).Scan(&userID)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return "", ErrInvalidResetToken
+		}
+		return "", fmt.Errorf("failed to use password reset token: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE password_reset_tokens
+		SET used_at = NOW()
+		WHERE user_id = $1 AND used_at IS NULL
+	`, userID)
+	if err != nil {
+		return "", fmt.Errorf("failed to burn password reset tokens: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE users
+		SET hashedPassword = $1, password_breached_at = NULL, updated_at = NOW()
+		WHERE userId = $2
+	`, hashedPassword, userID)
+	if err != nil {
+		return "", fmt.Errorf("failed to update password: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE refresh_tokens
+		SET revoked_at = NOW()
+		WHERE user_id = $1 AND revoked_at IS NULL
+	`, userID)
+	if err != nil {
+		return "", fmt.Errorf("failed to revoke refresh tokens: %w", err)
+	}
+
+	if _, err := tx.Exec(ctx, upsertSessionRevocationQuery, userID, revokedBefore); err != nil {
+		return "", fmt.Errorf("failed to insert session revocation: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return "", fmt.Errorf("failed to commit password reset: %w", err)
+	}
+	return userID, nil
+}
+
+func (p *PostgresConn) UpdatePassword(ctx context.Context, userID, hashedPassword string) error {
+	query := `
+		UPDATE users
+		SET hashedPassword = $1, password_breached_at = NULL, updated_at = NOW()
+		WHERE userId = $2
+	`
+
+	result, err := p.Conn.Exec(ctx, query, hashedPassword, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update password: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrInvalidUser
+	}
+	return nil
+}
+
+// UpdatePasswordAndRevokeSessions stores the new password hash, revokes every
+// refresh token of the user and every access token issued before
+// revokedBefore in one transaction.
+func (p *PostgresConn) UpdatePasswordAndRevokeSessions(ctx context.Context, userID, hashedPassword string, revokedBefore time.Time) error {
+	tx, err := p.Conn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin password change: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	result, err := tx.Exec(ctx, `
+		UPDATE users
+		SET hashedPassword = $1, password_breached_at = NULL, updated_at = NOW()
+		WHERE userId = $2
+	`, hashedPassword, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update password: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrInvalidUser
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE refresh_tokens
+		SET revoked_at = NOW()
+		WHERE user_id = $1 AND revoked_at IS NULL
+	`, userID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke refresh tokens: %w", err)
+	}
+
+	if _, err := tx.Exec(ctx, upsertSessionRevocationQuery, userID, revokedBefore); err != nil {
+		return fmt.Errorf("failed to insert session revocation: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit password change: %w", err)
+	}
+	return nil
+}
+
+// UpgradePasswordHash replaces a password hash with a stronger hash of the
+// same password. It does nothing if the password changed since oldHash was
+// read.
+func (p *PostgresConn) UpgradePasswordHash(ctx context.Context, userID, oldHash, newHash string) error {
+	query := `
+		UPDATE users
+		SET hashedPassword = $1
+		WHERE userId = $2 AND hashedPassword = $3
 	`
 
-	result, err := p.Conn.Exec(
-		context,
-		query,
-		newUsername,
-		time.Now().UTC(),
-		userID,
+	if _, err := p.Conn.Exec(ctx, query, newHash, userID, oldHash); err != nil {
+		return fmt.Errorf("failed to upgrade password hash: %w", err)
+	}
+	return nil
+}
+
+// FlagBreachedPassword marks the user's current password as breached. It
+// returns when the flag was set, or nil if it already was, so that the owner
+// is told only once.
+func (p *PostgresConn) FlagBreachedPassword(ctx context.Context, userID string) (*time.Time, error) {
+	query := `
+		UPDATE users
+		SET password_breached_at = NOW()
+		WHERE userId = $1 AND password_breached_at IS NULL
+		RETURNING password_breached_at
+	`
+
+	var flaggedAt time.Time
+	err := p.Conn.QueryRow(ctx, query, userID).Scan(&flaggedAt)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to flag breached password: %w", err)
+	}
+	return &flaggedAt, nil
+}
+
+func (p *PostgresConn) RevokeUserRefreshTokens(ctx context.Context, userID string) error {
+	query := `
+		UPDATE refresh_tokens
+		SET revoked_at = NOW()
+		WHERE user_id = $1 AND revoked_at IS NULL
+	`
+
+	if _, err := p.Conn.Exec(ctx, query, userID); err != nil {
+		return fmt.Errorf("failed to revoke refresh tokens: %w", err)
+	}
+	return nil
+}
+
+var ErrTOTPCodeReused = errors.New("totp code has already been used")
+
+// ConfirmTOTP enables the user's pending authenticator. step is the time step
+// of the code that confirmed it, which may not be used again.
+func (p *PostgresConn) ConfirmTOTP(ctx context.Context, userID string, step int64) error {
+	query := `
+		UPDATE totp_credentials
+		SET confirmed_at = NOW(), last_used_step = $2
+		WHERE user_id = $1 AND confirmed_at IS NULL
+	`
+
+	result, err := p.Conn.Exec(ctx, query, userID, step)
+	if err != nil {
+		return fmt.Errorf("failed to confirm totp: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrTOTPNotFound
+	}
+	return nil
+}
+
+// UseTOTPStep records step as the last used time step. It returns
+// ErrTOTPCodeReused when a code of the same or a later step was already
+// accepted, so every code works at most once.
+func (p *PostgresConn) UseTOTPStep(ctx context.Context, userID string, step int64) error {
+	query := `
+		UPDATE totp_credentials
+		SET last_used_step = $2
+		WHERE user_id = $1 AND confirmed_at IS NOT NULL AND last_used_step < $2
+	`
+
+	result, err := p.Conn.Exec(ctx, query, userID, step)
+	if err != nil {
+		return fmt.Errorf("failed to use totp code: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrTOTPCodeReused
+	}
+	return nil
+}
+
+func (p *PostgresConn) DeleteTOTP(ctx context.Context, userID string) error {
+	if _, err := p.Conn.Exec(ctx, `DELETE FROM totp_credentials WHERE user_id = $1`, userID); err != nil {
+		return fmt.Errorf("failed to delete totp: %w", err)
+	}
+	return nil
+}
+
+// ClaimMFAChallengeAttempt counts an attempt against the challenge and
+// returns it so the second factor can be checked. Counting before comparing
+// keeps concurrent guesses within maxAttempts. It returns
+// ErrInvalidMFAChallenge when the challenge does not exist, was consumed, has
+// expired or its attempts are used up.
+func (p *PostgresConn) ClaimMFAChallengeAttempt(ctx context.Context, tokenHash string, maxAttempts int) (*MFAChallenge, error) {
+	query := `
+		UPDATE mfa_challenges
+		SET attempts = attempts + 1
+		WHERE token_hash = $1 AND consumed_at IS NULL AND expires_at > NOW() AND attempts < $2
+		RETURNING token_hash, user_id, nonce, attempts, expires_at, created_at, consumed_at
+	`
+
+	c := &MFAChallenge{}
+	err := p.Conn.QueryRow(ctx, query, tokenHash, maxAttempts).Scan(
+		&c.TokenHash,
+		&c.UserID,
+		&c.Nonce,
+		&c.Attempts,
+		&c.ExpiresAt,
+		&c.CreatedAt,
+		&c.ConsumedAt,
 	)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, ErrInvalidMFAChallenge
+		}
+		return nil, fmt.Errorf("failed to claim mfa attempt: %w", err)
+	}
+	return c, nil
+}
 
+// ConsumeMFAChallenge marks the challenge as redeemed. It returns
+// ErrInvalidMFAChallenge if it was already consumed or has expired.
+func (p *PostgresConn) ConsumeMFAChallenge(ctx context.Context, tokenHash string) error {
+	query := `
+		UPDATE mfa_challenges
+		SET consumed_at = NOW()
+		WHERE token_hash = $1 AND consumed_at IS NULL AND expires_at > NOW()
+	`
+
+	result, err := p.Conn.Exec(ctx, query, tokenHash)
 	if err != nil {
-		return fmt.Errorf("failed to update username: %w", err)
+		return fmt.Errorf("failed to consume mfa challenge: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrInvalidMFAChallenge
 	}
+	return nil
+}
 
-	rowsAffected := result.RowsAffected()
-	if rowsAffected == 0 {
-		return fmt.Errorf("no user found with ID %s to update", userID)
+func (p *PostgresConn) DeleteExpiredMFAChallenges(ctx context.Context) (int64, error) {
+	result, err := p.Conn.Exec(ctx, `DELETE FROM mfa_challenges WHERE expires_at <= NOW()`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired mfa challenges: %w", err)
 	}
+	return result.RowsAffected(), nil
+}
+
+var ErrInvalidRecoveryCode = errors.New("recovery code is invalid or already used")
 
+// UseRecoveryCode burns the matching unused recovery code of the user.
+func (p *PostgresConn) UseRecoveryCode(ctx context.Context, userID, codeHash string) error {
+	query := `
+		UPDATE mfa_recovery_codes
+		SET used_at = NOW()
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+	`
+
+	result, err := p.Conn.Exec(ctx, query, userID, codeHash)
+	if err != nil {
+		return fmt.Errorf("failed to use recovery code: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrInvalidRecoveryCode
+	}
 	return nil
 }
+
+func (p *PostgresConn) DeleteRecoveryCodes(ctx context.Context, userID string) error {
+	if _, err := p.Conn.Exec(ctx, `DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+	return nil
+}
+
+var ErrInvalidWebAuthnChallenge = errors.New("webauthn challenge is invalid or has expired")
+
+// ConsumeWebAuthnChallenge deletes and returns the unexpired challenge of the
+// given ceremony, so every challenge can be answered at most once.
+func (p *PostgresConn) ConsumeWebAuthnChallenge(ctx context.Context, challengeHash, ceremony string) (*WebAuthnChallenge, error) {
+	query := `
+		DELETE FROM webauthn_challenges
+		WHERE challenge_hash = $1 AND ceremony = $2 AND expires_at > NOW()
+		RETURNING challenge_hash, COALESCE(user_id, ''), ceremony, nonce, expires_at, created_at
+	`
+
+	c := &WebAuthnChallenge{}
+	err := p.Conn.QueryRow(ctx, query, challengeHash, ceremony).Scan(
+		&c.ChallengeHash,
+		&c.UserID,
+		&c.Ceremony,
+		&c.Nonce,
+		&c.ExpiresAt,
+		&c.CreatedAt,
+	)
+
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, ErrInvalidWebAuthnChallenge
+		}
+		return nil, fmt.Errorf("failed to consume webauthn challenge: %w", err)
+	}
+	return c, nil
+}
+
+var ErrWebAuthnSignCount = errors.New("webauthn signature counter did not increase")
+
+// UpdateWebAuthnSignCount records a successful assertion. Authenticators that
+// keep a counter must report a larger value each time; a counter that goes
+// backwards points to a cloned authenticator and fails with
+// ErrWebAuthnSignCount. Authenticators without a counter always report zero.
+func (p *PostgresConn) UpdateWebAuthnSignCount(ctx context.Context, id string, signCount int64) error {
+	query := `
+		UPDATE webauthn_credentials
+		SET sign_count = $2, last_used_at = NOW()
+		WHERE id = $1 AND (sign_count < $2 OR (sign_count = 0 AND $2 = 0))
+	`
+
+	result, err := p.Conn.Exec(ctx, query, id, signCount)
+	if err != nil {
+		return fmt.Errorf("failed to update webauthn sign count: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrWebAuthnSignCount
+	}
+	return nil
+}
+
+func (p *PostgresConn) DeleteWebAuthnCredential(ctx context.Context, userID, id string) error {
+	result, err := p.Conn.Exec(ctx, `DELETE FROM webauthn_credentials WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete webauthn credential: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrWebAuthnCredentialNotFound
+	}
+	return nil
+}
+
+func (p *PostgresConn) DeleteExpiredWebAuthnChallenges(ctx context.Context) (int64, error) {
+	result, err := p.Conn.Exec(ctx, `DELETE FROM webauthn_challenges WHERE expires_at <= NOW()`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired webauthn challenges: %w", err)
+	}
+	return result.RowsAffected(), nil
+}
+
+func (p *PostgresConn) DeleteExpiredMagicLinkRedemptions(ctx context.Context) (int64, error) {
+	result, err := p.Conn.Exec(ctx, `DELETE FROM magic_link_redemptions WHERE expires_at <= NOW()`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired magic link redemptions: %w", err)
+	}
+	return result.RowsAffected(), nil
+}
+
+var ErrInvalidEmailOTP = errors.New("email otp is invalid or has expired")
+
+// ClaimEmailOTPAttempt counts an attempt against the user's login code and
+// returns its hash for comparison. Counting before comparing keeps concurrent
+// guesses within maxAttempts. It returns ErrInvalidEmailOTP when there is no
+// code, it has expired or its attempts are used up.
+func (p *PostgresConn) ClaimEmailOTPAttempt(ctx context.Context, userID string, maxAttempts int) (string, error) {
+	query := `
+		UPDATE email_otps
+		SET attempts = attempts + 1
+		WHERE user_id = $1 AND expires_at > NOW() AND attempts < $2
+		RETURNING code_hash
+	`
+
+	var codeHash string
+	if err := p.Conn.QueryRow(ctx, query, userID, maxAttempts).Scan(&codeHash); err != nil {
+		if err == pgx.ErrNoRows {
+			return "", ErrInvalidEmailOTP
+		}
+		return "", fmt.Errorf("failed to claim email otp attempt: %w", err)
+	}
+	return codeHash, nil
+}
+
+// ConsumeEmailOTP deletes the login code so it cannot be used again. It
+// returns ErrInvalidEmailOTP if the code was replaced or used meanwhile.
+func (p *PostgresConn) ConsumeEmailOTP(ctx context.Context, userID, codeHash string) error {
+	result, err := p.Conn.Exec(ctx, `DELETE FROM email_otps WHERE user_id = $1 AND code_hash = $2`, userID, codeHash)
+	if err != nil {
+		return fmt.Errorf("failed to consume email otp: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrInvalidEmailOTP
+	}
+	return nil
+}
+
+func (p *PostgresConn) DeleteExpiredEmailOTPs(ctx context.Context) (int64, error) {
+	result, err := p.Conn.Exec(ctx, `DELETE FROM email_otps WHERE expires_at <= NOW()`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired email otps: %w", err)
+	}
+	return result.RowsAffected(), nil
+}
+
+// RecordFailedLogin passes the failed login history of the user to record,
+// with the row locked, and stores what record leaves in it. record returns the
+// end of the lock the failure causes, or nil, which RecordFailedLogin returns.
+func (p *PostgresConn) RecordFailedLogin(ctx context.Context, userID string, record func(l *AccountLockout, now time.Time) *time.Time) (*time.Time, error) {
+	tx, err := p.Conn.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin failed login update: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO account_lockouts (user_id)
+		VALUES ($1)
+		ON CONFLICT (user_id) DO NOTHING
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record failed login: %w", err)
+	}
+
+	var l AccountLockout
+	err = tx.QueryRow(ctx, `
+		SELECT failed_attempts, lockouts, locked_until, last_failed_at
+		FROM account_lockouts
+		WHERE user_id = $1
+		FOR UPDATE
+	`, userID).Scan(&l.FailedAttempts, &l.Lockouts, &l.LockedUntil, &l.LastFailedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record failed login: %w", err)
+	}
+
+	now := time.Now()
+	lockedUntil := record(&l, now)
+
+	_, err = tx.Exec(ctx, `
+		UPDATE account_lockouts
+		SET failed_attempts = $2, lockouts = $3, locked_until = COALESCE($4, locked_until), last_failed_at = $5, updated_at = NOW()
+		WHERE user_id = $1
+	`, userID, l.FailedAttempts, l.Lockouts, lockedUntil, now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record failed login: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit failed login: %w", err)
+	}
+	return lockedUntil, nil
+}
+
+// ResetFailedLogins forgets the failed logins and lock history of the user,
+// after a successful login or when an administrator unlocks the account.
+func (p *PostgresConn) ResetFailedLogins(ctx context.Context, userID string) error {
+	if _, err := p.Conn.Exec(ctx, `DELETE FROM account_lockouts WHERE user_id = $1`, userID); err != nil {
+		return fmt.Errorf("failed to reset failed logins: %w", err)
+	}
+	return nil
+}
+
+// HitRateLimit counts a request for key in the fixed window starting at
+// windowStart and returns the counts of that window and of the one before it.
+func (p *PostgresConn) HitRateLimit(ctx context.Context, key string, windowStart time.Time, window time.Duration) (int64, int64, error) {
+	query := `
+		WITH hit AS (
+			INSERT INTO rate_limit_counters (key, window_start, count, expires_at)
+			VALUES ($1, $2, 1, $3)
+			ON CONFLICT (key, window_start) DO UPDATE
+			SET count = rate_limit_counters.count + 1
+			RETURNING count
+		)
+		SELECT
+			(SELECT count FROM hit),
+			COALESCE((SELECT count FROM rate_limit_counters WHERE key = $1 AND window_start = $4), 0)
+	`
+
+	var current, previous int64
+	err := p.Conn.QueryRow(ctx, query, key, windowStart, windowStart.Add(2*window), windowStart.Add(-window)).Scan(&current, &previous)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to count rate limited request: %w", err)
+	}
+	return current, previous, nil
+}
+
+func (p *PostgresConn) DeleteExpiredRateLimitCounters(ctx context.Context) (int64, error) {
+	result, err := p.Conn.Exec(ctx, `DELETE FROM rate_limit_counters WHERE expires_at <= NOW()`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired rate limit counters: %w", err)
+	}
+	return result.RowsAffected(), nil
+}
@@ -9,6 +9,15 @@ import (
 
 const (
 	NotifyUserSuccessfulSignUp = "auth_welcome_mail"
+	NotifyEmailVerification    = "auth_email_verification"
+	NotifyPasswordReset        = "auth_password_reset"
+	NotifyPasswordChanged      = "auth_password_changed"
+	NotifyRecoveryCodeUsed     = "auth_mfa_recovery_code_used"
+	NotifyMagicLink            = "auth_magic_link"
+	NotifyEmailOTP             = "auth_email_otp"
+	NotifyAccountLocked        = "auth_account_locked"
+	NotifyPasswordBreached     = "auth_password_breached"
+	NotifyUsernameChanged      = "auth_username_changed"
 	AuthUser                   = "user_registration_info"
 )
 
@@ -83,24 +83,10 @@ func (p *RabbitMQ) Publish(exchange, routingKey string, data interface{}) error
 	}
 
 	for attempt := 0; attempt < 5; attempt++ {
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		err = ch.PublishWithContext(
-			ctx,
-			exchange,
-			routingKey,
-			false,
-			false,
-			amqp.Publishing{
-				ContentType:  "application/json",
-				Body:         body,
-				DeliveryMode: amqp.Persistent,
-				Timestamp:    time.Now(),
-			},
-		)
-		cancel()
-
+		err = p.PublishOnce(exchange, routingKey, body)
 		if err == nil {
-			log.Printf("[Publisher] Published to %s (key=%s): %s", exchange, routingKey, string(body))
+			// bodies carry tokens and codes, only the type is logged
+			log.Printf("[Publisher] Published %s to %s (key=%s)", messageType(data), exchange, routingKey)
 			return nil
 		}
 
@@ -112,6 +98,60 @@ func (p *RabbitMQ) Publish(exchange, routingKey string, data interface{}) error
 	return fmt.Errorf("failed to publish message after retries: %w", err)
 }
 
+// messageType returns the type of an event built as {"data": {"type": ...}}.
+func messageType(data interface{}) string {
+	if m, ok := data.(map[string]interface{}); ok {
+		if d, ok := m["data"].(map[string]string); ok && d["type"] != "" {
+			return d["type"]
+		}
+	}
+	return "message"
+}
+
+// PublishOnce makes a single attempt to publish an already encoded JSON body,
+// leaving retries to the caller. It only returns nil once the broker has
+// confirmed the message, so a message it reports as published is not lost if
+// the connection drops right after.
+func (p *RabbitMQ) PublishOnce(exchange, routingKey string, body []byte) error {
+	ch := p.Channel()
+	if ch == nil {
+		return fmt.Errorf("RabbitMQ channel not ready")
+	}
+
+	// a no-op once the channel is in confirm mode
+	if err := ch.Confirm(false); err != nil {
+		return fmt.Errorf("failed to enable publisher confirms: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	confirmation, err := ch.PublishWithDeferredConfirmWithContext(
+		ctx,
+		exchange,
+		routingKey,
+		false,
+		false,
+		amqp.Publishing{
+			ContentType:  "application/json",
+			Body:         body,
+			DeliveryMode: amqp.Persistent,
+			Timestamp:    time.Now(),
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to wait for publisher confirm: %w", err)
+	}
+	if !acked {
+		return fmt.Errorf("broker rejected message to %s (key=%s)", exchange, routingKey)
+	}
+	return nil
+}
+
 func (p *RabbitMQ) PublishNotification(data interface{}) error {
 	err := p.Publish(NotificationExchange, NotificationQueue, data)
 	if err != nil {
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	maxEmailLength      = 254
+	maxEmailLocalLength = 64
+	maxDomainLength     = 253
+	maxDomainLabel      = 63
+)
+
+var ErrInvalidEmail = errors.New("invalid email address")
+
+// normalizeEmail validates an address and returns the form it is stored and
+// looked up in: NFC normalized and lowercased, with an internationalized
+// domain converted to its ASCII (punycode) form. Quoted local parts and IP
+// literal domains are not accepted.
+func normalizeEmail(email string) (string, error) {
+	email = norm.NFC.String(strings.TrimSpace(email))
+	at := strings.LastIndexByte(email, '@')
+	if at <= 0 || at == len(email)-1 {
+		return "", ErrInvalidEmail
+	}
+
+	local := strings.ToLower(email[:at])
+	if !validEmailLocal(local) {
+		return "", ErrInvalidEmail
+	}
+
+	domain, err := asciiDomain(email[at+1:])
+	if err != nil {
+		return "", err
+	}
+
+	normalized := local + "@" + domain
+	if len(normalized) > maxEmailLength {
+		return "", ErrInvalidEmail
+	}
+	return normalized, nil
+}
+
+// lookupEmail is the form of a submitted address to look an account up by.
+// Invalid addresses are passed on trimmed and lowercased, so that they find
+// nothing rather than being rejected in a way that differs from an unknown
+// account.
+func lookupEmail(email string) string {
+	if normalized, err := normalizeEmail(email); err == nil {
+		return normalized
+	}
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// validEmailLocal accepts the dot-atom form of RFC 5322, extended with the
+// UTF-8 letters and digits of RFC 6531.
+func validEmailLocal(local string) bool {
+	if len(local) > maxEmailLocalLength || !utf8.ValidString(local) {
+		return false
+	}
+	if strings.HasPrefix(local, ".") || strings.HasSuffix(local, ".") || strings.Contains(local, "..") {
+		return false
+	}
+	for _, r := range local {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case strings.ContainsRune(".!#$%&'*+/=?^_`{|}~-", r):
+		case r >= utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// asciiDomain maps domain roughly as UTS #46 does, with NFKC and lowercasing,
+// and converts its non-ASCII labels to punycode, checking the result against
+// the hostname rules of RFC 1123.
+func asciiDomain(domain string) (string, error) {
+	domain = strings.ToLower(norm.NFKC.String(domain))
+	// NFKC maps the fullwidth full stops, but not the ideographic one
+	domain = strings.ReplaceAll(domain, "。", ".")
+
+	labels := strings.Split(domain, ".")
+	if len(labels) < 2 {
+		return "", ErrInvalidEmail
+	}
+	for i, label := range labels {
+		if label == "" || utf8.RuneCountInString(label) > maxDomainLabel {
+			return "", ErrInvalidEmail
+		}
+
+		ascii := true
+		for _, r := range label {
+			if r >= utf8.RuneSelf {
+				if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsMark(r) {
+					return "", ErrInvalidEmail
+				}
+				ascii = false
+			}
+		}
+		if !ascii {
+			label = punycodeEncode(label)
+		}
+
+		if !validHostLabel(label) {
+			return "", ErrInvalidEmail
+		}
+		labels[i] = label
+	}
+
+	// an all-numeric top-level domain would make the domain look like an IP
+	if strings.Trim(labels[len(labels)-1], "0123456789") == "" {
+		return "", ErrInvalidEmail
+	}
+
+	domain = strings.Join(labels, ".")
+	if len(domain) > maxDomainLength {
+		return "", ErrInvalidEmail
+	}
+	return domain, nil
+}
+
+func validHostLabel(label string) bool {
+	if len(label) == 0 || len(label) > maxDomainLabel || label[0] == '-' || label[len(label)-1] == '-' {
+		return false
+	}
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// Bootstring parameters for punycode, from RFC 3492.
+const (
+	punycodeBase        = 36
+	punycodeTMin        = 1
+	punycodeTMax        = 26
+	punycodeSkew        = 38
+	punycodeDamp        = 700
+	punycodeInitialBias = 72
+	punycodeInitialN    = 128
+)
+
+// punycodeEncode encodes a lowercase label with the ACE prefix, as in RFC
+// 3492. Labels are at most 63 characters, so the arithmetic cannot overflow.
+func punycodeEncode(label string) string {
+	runes := []rune(label)
+
+	var out []byte
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			out = append(out, byte(r))
+		}
+	}
+	basic := len(out)
+	if basic > 0 {
+		out = append(out, '-')
+	}
+
+	n, delta, bias := rune(punycodeInitialN), 0, punycodeInitialBias
+	for handled := basic; handled < len(runes); {
+		next := unicode.MaxRune + 1
+		for _, r := range runes {
+			if r >= n && r < next {
+				next = r
+			}
+		}
+		delta += int(next-n) * (handled + 1)
+		n = next
+
+		for _, r := range runes {
+			if r < n {
+				delta++
+			}
+			if r != n {
+				continue
+			}
+
+			q := delta
+			for k := punycodeBase; ; k += punycodeBase {
+				t := min(max(k-bias, punycodeTMin), punycodeTMax)
+				if q < t {
+					break
+				}
+				out = append(out, punycodeDigit(t+(q-t)%(punycodeBase-t)))
+				q = (q - t) / (punycodeBase - t)
+			}
+			out = append(out, punycodeDigit(q))
+			bias = punycodeAdapt(delta, handled+1, handled == basic)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+	return "xn--" + string(out)
+}
+
+func punycodeAdapt(delta, points int, first bool) int {
+	if first {
+		delta /= punycodeDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / points
+
+	k := 0
+	for delta > (punycodeBase-punycodeTMin)*punycodeTMax/2 {
+		delta /= punycodeBase - punycodeTMin
+		k += punycodeBase
+	}
+	return k + (punycodeBase-punycodeTMin+1)*delta/(delta+punycodeSkew)
+}
+
+func punycodeDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/Developer-s-Foundry/df-2.0-aima-auth-service/database/postgres"
+	"github.com/Developer-s-Foundry/df-2.0-aima-auth-service/database/rabbitmq"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	emailOTPDigits      = 6
+	emailOTPTTL         = 10 * time.Minute
+	emailOTPCooldown    = time.Minute
+	maxEmailOTPAttempts = 5
+)
+
+// generateEmailOTP returns a uniformly random code of emailOTPDigits digits.
+func generateEmailOTP() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1_000_000))
+	if err != nil {
+		return "", fmt.Errorf("failed to generate email otp: %w", err)
+	}
+	return fmt.Sprintf("%0*d", emailOTPDigits, n.Int64()), nil
+}
+
+// hashEmailOTP binds the code to its user. A keyed hash is used because a
+// million possible codes are trivial to brute force from a plain digest.
+func hashEmailOTP(userID, code string) (string, error) {
+	return keyedHash("email-otp:" + userID + ":" + code)
+}
+
+// RequestEmailOTP mails a one-time login code to the account owner, replacing
+// any code sent before. Like ForgotPassword it answers 202 whether or not the
+// account exists, and sends at most one code per cooldown period.
+func (h *AuthHandler) RequestEmailOTP(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var body struct {
+		Email string `json:"email"`
+	}
+
+	if err := readFromJson(r, &body); err != nil || body.Email == "" {
+		writeErrorResponse(w, "email is required", http.StatusBadRequest)
+		return
+	}
+
+	response := struct {
+		ExpiresIn  int    `json:"expires_in"`
+		Message    string `json:"message"`
+		StatusCode int    `json:"status_code"`
+	}{
+		ExpiresIn:  int(emailOTPTTL.Seconds()),
+		Message:    "If an account exists for this email, a login code has been sent",
+		StatusCode: http.StatusAccepted,
+	}
+
+	user, err := h.DB.GetUser(r.Context(), lookupEmail(body.Email))
+	if err != nil {
+		if !errors.Is(err, postgres.ErrInvalidUser) {
+			log.Printf("unable to get user from db: %v", err)
+		}
+		writeToJson(w, response, http.StatusAccepted)
+		return
+	}
+
+	code, err := generateEmailOTP()
+	if err != nil {
+		log.Printf("error generating email otp %v", err)
+		writeToJson(w, response, http.StatusAccepted)
+		return
+	}
+
+	codeHash, err := hashEmailOTP(user.UserID, code)
+	if err != nil {
+		log.Printf("error hashing email otp %v", err)
+		writeToJson(w, response, http.StatusAccepted)
+		return
+	}
+
+	expiresAt := time.Now().Add(emailOTPTTL)
+	userData := map[string]interface{}{
+		"data": map[string]string{
+			"type":       rabbitmq.NotifyEmailOTP,
+			"email":      user.Email,
+			"id":         user.UserID,
+			"code":       code,
+			"expires_at": expiresAt.String(),
+			"timestamp":  time.Now().String(),
+		},
+		"queue_name":    rabbitmq.NotificationQueue,
+		"exchange_name": rabbitmq.NotificationExchange,
+	}
+
+	notification, err := newOutboxEvent(rabbitmq.NotificationExchange, rabbitmq.NotificationQueue, userData)
+	if err != nil {
+		log.Printf("error encoding email otp notification %v", err)
+		writeToJson(w, response, http.StatusAccepted)
+		return
+	}
+
+	// the code is committed with its mail and sent by the outbox relay, so
+	// it never reaches the broker or the logs in the clear. No mail is
+	// queued while the cooldown keeps the current code.
+	err = h.DB.UpsertEmailOTP(r.Context(), postgres.EmailOTP{
+		UserID:    user.UserID,
+		CodeHash:  codeHash,
+		ExpiresAt: expiresAt,
+	}, emailOTPCooldown, notification)
+	if err != nil && !errors.Is(err, postgres.ErrEmailOTPCooldown) {
+		log.Printf("unable to store email otp for user %s: %v", user.UserID, err)
+	}
+
+	writeToJson(w, response, http.StatusAccepted)
+}
+
+// VerifyEmailOTP exchanges an email and the code sent to it for the same
+// response Login gives after a correct password. A code allows
+// maxEmailOTPAttempts guesses and is deleted once it has been used. Wrong
+// codes count against the account like wrong passwords.
+func (h *AuthHandler) VerifyEmailOTP(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var body struct {
+		Email string `json:"email"`
+		Code  string `json:"code"`
+		Nonce string `json:"nonce"`
+	}
+
+	if err := readFromJson(r, &body); err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body.Email == "" || body.Code == "" {
+		writeErrorResponse(w, "email and code are required", http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.DB.GetUser(r.Context(), lookupEmail(body.Email))
+	if err != nil {
+		if errors.Is(err, postgres.ErrInvalidUser) {
+			h.recordAuthEvent(r, authEventLoginEmailOTP, &postgres.User{Email: lookupEmail(body.Email)}, authOutcomeFailure, authReasonUnknownUser)
+			writeErrorResponse(w, "login code is invalid or has expired", http.StatusUnauthorized)
+			return
+		}
+		log.Printf("unable to get user from db: %v", err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	lockedUntil, err := h.accountLockedUntil(r.Context(), user.UserID)
+	if err != nil {
+		log.Printf("unable to check lockout of user %s: %v", user.UserID, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if lockedUntil != nil {
+		h.recordAuthEvent(r, authEventLoginEmailOTP, user, authOutcomeFailure, authReasonAccountLocked)
+		writeAccountLocked(w, *lockedUntil)
+		return
+	}
+
+	storedHash, err := h.DB.ClaimEmailOTPAttempt(r.Context(), user.UserID, maxEmailOTPAttempts)
+	if err != nil {
+		if errors.Is(err, postgres.ErrInvalidEmailOTP) {
+			h.recordAuthEvent(r, authEventLoginEmailOTP, user, authOutcomeFailure, authReasonInvalidToken)
+			writeErrorResponse(w, "login code is invalid or has expired", http.StatusUnauthorized)
+			return
+		}
+		log.Printf("unable to check email otp for user %s: %v", user.UserID, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	codeHash, err := hashEmailOTP(user.UserID, body.Code)
+	if err != nil {
+		log.Printf("error hashing email otp %v", err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(codeHash), []byte(storedHash)) != 1 {
+		h.recordAuthEvent(r, authEventLoginEmailOTP, user, authOutcomeFailure, authReasonInvalidCredentials)
+		if lockedUntil := h.recordFailedLogin(r.Context(), user); lockedUntil != nil {
+			writeAccountLocked(w, *lockedUntil)
+			return
+		}
+		writeErrorResponse(w, "login code is invalid or has expired", http.StatusUnauthorized)
+		return
+	}
+
+	if err := h.DB.ConsumeEmailOTP(r.Context(), user.UserID, codeHash); err != nil {
+		if errors.Is(err, postgres.ErrInvalidEmailOTP) {
+			h.recordAuthEvent(r, authEventLoginEmailOTP, user, authOutcomeFailure, authReasonInvalidToken)
+			writeErrorResponse(w, "login code is invalid or has expired", http.StatusUnauthorized)
+			return
+		}
+		log.Printf("unable to consume email otp for user %s: %v", user.UserID, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if !user.EmailVerified && emailVerificationPolicy() == VerificationPolicyBlock {
+		h.recordAuthEvent(r, authEventLoginEmailOTP, user, authOutcomeFailure, authReasonEmailUnverified)
+		writeErrorResponse(w, "email address has not been verified", http.StatusForbidden)
+		return
+	}
+
+	mfaRequired, err := h.startMFAChallenge(w, r, user, body.Nonce)
+	if err != nil {
+		log.Printf("MFA challenge error for user %s: %v", user.UserID, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if mfaRequired {
+		h.recordAuthEvent(r, authEventLoginEmailOTP, user, authOutcomeChallenge, authReasonMFARequired)
+		return
+	}
+
+	h.writeLoginResponse(w, r, user, authEventLoginEmailOTP, body.Nonce)
+}
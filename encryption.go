@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// masterKey encrypts secrets that have to be stored in Postgres, such as
+// signing keys. It is loaded from AUTH_MASTER_KEY at startup.
+var masterKey []byte
+
+func loadMasterKey() ([]byte, error) {
+	encoded := os.Getenv("AUTH_MASTER_KEY")
+	if encoded == "" {
+		return nil, errors.New("missing AUTH_MASTER_KEY environment variable")
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("AUTH_MASTER_KEY is not valid base64: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, errors.New("AUTH_MASTER_KEY must decode to 32 bytes")
+	}
+	return key, nil
+}
+
+// sealSecret encrypts plaintext with AES-256-GCM under the master key. The
+// associated data binds the ciphertext to the row it is stored in, so it
+// cannot be swapped onto another record.
+func sealSecret(plaintext, associatedData []byte) ([]byte, error) {
+	aead, err := masterAEAD()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, associatedData), nil
+}
+
+func openSecret(ciphertext, associatedData []byte) ([]byte, error) {
+	aead, err := masterAEAD()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, sealed, associatedData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt secret: %w", err)
+	}
+	return plaintext, nil
+}
+
+func masterAEAD() (cipher.AEAD, error) {
+	if len(masterKey) == 0 {
+		return nil, errors.New("master key not loaded")
+	}
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// keyedHash returns the hex HMAC-SHA256 of data under a key derived from the
+// master key. Unlike hashToken it is fit for low-entropy secrets such as short
+// codes, whose plain digests could be brute forced from a database dump.
+func keyedHash(data string) (string, error) {
+	if len(masterKey) == 0 {
+		return "", errors.New("master key not loaded")
+	}
+	key, err := hkdf.Key(sha256.New, masterKey, nil, "aimas keyed hash", 32)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
@@ -11,85 +11,69 @@ import (
 	"github.com/julienschmidt/httprouter"
 )
 
-var ErrUsernameTaken = errors.New("username already exists")
-
 func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 
 	var user struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		Nonce    string `json:"nonce"`
 	}
 
 	if err := readFromJson(r, &user); err != nil {
-		respErr := map[string]string{
-			"error":  err.Error(),
-			"status": http.StatusText(http.StatusBadRequest),
-		}
-		writeToJson(w, respErr, http.StatusBadRequest)
+		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	existingUser, err := h.DB.GetUser(r.Context(), user.Email)
-	if err != nil && !errors.Is(err, postgres.ErrInvalidUser) {
-		log.Printf("unable to get user from db: %v", err)
-		respErr := map[string]string{
-			"error":  "internal server error",
-			"status": http.StatusText(http.StatusInternalServerError),
-		}
-		writeToJson(w, respErr, http.StatusInternalServerError)
+	email, err := normalizeEmail(user.Email)
+	if err != nil {
+		writeErrorResponse(w, "invalid email address", http.StatusBadRequest)
 		return
 	}
 
-	if existingUser != nil {
-		respErr := map[string]string{
-			"error":  "user already exists",
-			"status": http.StatusText(http.StatusConflict),
-		}
-		writeToJson(w, respErr, http.StatusConflict)
+	if !acceptPassword(w, user.Password, email) {
+		h.recordAuthEvent(r, authEventRegister, &postgres.User{Email: email}, authOutcomeFailure, authReasonPasswordRejected)
+		return
+	}
+
+	hashedPassword, err := hashPassword(user.Password)
+	if err != nil {
+		log.Printf("error hashing password %v", err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	hashedPassword, _ := hashPassword(user.Password)
 	usr := postgres.User{
 		UserID:         generateUuid(),
-		Email:          user.Email,
+		Email:          email,
 		HashedPassword: hashedPassword,
 	}
 
-	if err := h.DB.InsertUser(usr); err != nil {
-		log.Printf("failed to create user %s: %v", usr.Email, err)
-		respErr := map[string]string{
-			"error":  "internal server error",
-			"status": http.StatusText(http.StatusInternalServerError),
-		}
-		writeToJson(w, respErr, http.StatusInternalServerError)
-		return
-	}
-
-	token, err := generateJWToken(usr.UserID)
-
+	verificationToken, verification, err := newEmailVerificationToken(usr.UserID)
 	if err != nil {
-		log.Printf("error generating jwt token %v", err)
-		respErr := map[string]string{
-			"error":  "internal server error",
-			"status": http.StatusText(http.StatusInternalServerError),
-		}
-		writeToJson(w, respErr, http.StatusInternalServerError)
+		log.Printf("error issuing verification token %v", err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
 
 	userData := map[string]interface{}{
 		"data": map[string]string{
-			"type":      rabbitmq.NotifyUserSuccessfulSignUp,
-			"email":     usr.Email,
-			"id":        usr.UserID,
-			"timestamp": time.Now().String(),
+			"type":               rabbitmq.NotifyUserSuccessfulSignUp,
+			"email":              usr.Email,
+			"id":                 usr.UserID,
+			"verification_token": verificationToken,
+			"verification_url":   emailVerificationURL(verificationToken),
+			"timestamp":          time.Now().String(),
 		},
 		"queue_name":    rabbitmq.NotificationQueue,
 		"exchange_name": rabbitmq.NotificationExchange,
 	}
 
 	// publish to user notification
-	go h.RabbMQ.PublishNotification(userData)
+	notification, err := newOutboxEvent(rabbitmq.NotificationExchange, rabbitmq.NotificationQueue, userData)
+	if err != nil {
+		log.Printf("error encoding sign up notification %v", err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
 
 	userData = map[string]interface{}{
 		"data": map[string]string{
@@ -103,89 +87,152 @@ func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request, _ httprou
 	}
 
 	//publish to user management
-	go h.RabbMQ.PublishUserManagement(userData)
+	management, err := newOutboxEvent(rabbitmq.UserExchange, rabbitmq.UserQueue, userData)
+	if err != nil {
+		log.Printf("error encoding sign up event %v", err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// the unique index on the address settles concurrent registrations. The
+	// events are committed with the user and sent by the outbox relay, so
+	// they survive a broker outage or a restart.
+	if err := h.DB.InsertUser(usr, &verification, notification, management); err != nil {
+		if errors.Is(err, postgres.ErrUserExists) {
+			h.recordAuthEvent(r, authEventRegister, &postgres.User{Email: usr.Email}, authOutcomeFailure, authReasonUserExists)
+			writeErrorResponse(w, "user already exists", http.StatusConflict)
+			return
+		}
+		log.Printf("failed to create user %s: %v", usr.Email, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	h.recordAuthEvent(r, authEventRegister, &usr, authOutcomeSuccess, "")
 
 	response := struct {
-		UserId     string `json:"userId"`
-		Email      string `json:"email"`
-		Message    string `json:"message"`
-		Token      string `json:"token"`
-		StatusCode int    `json:"status_code"`
+		UserId        string `json:"userId"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+		Message       string `json:"message"`
+		Token         string `json:"token,omitempty"`
+		RefreshToken  string `json:"refresh_token,omitempty"`
+		IDToken       string `json:"id_token,omitempty"`
+		StatusCode    int    `json:"status_code"`
 	}{
 
 		StatusCode: http.StatusCreated,
 		UserId:     usr.UserID,
 		Email:      usr.Email,
-		Token:      token,
 		Message:    "User created successfully",
 	}
+
+	if emailVerificationPolicy() == VerificationPolicyBlock {
+		response.Message = "User created successfully, verify your email address to log in"
+		writeToJson(w, response, http.StatusCreated)
+		return
+	}
+
+	token, err := generateJWToken(&usr)
+
+	if err != nil {
+		log.Printf("error generating jwt token %v", err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	refreshToken, err := h.issueRefreshToken(r.Context(), usr.UserID, "")
+	if err != nil {
+		log.Printf("error issuing refresh token %v", err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	idToken, err := generateIDToken(&usr, user.Nonce, time.Now())
+	if err != nil {
+		log.Printf("error generating id token %v", err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response.Token = token
+	response.RefreshToken = refreshToken
+	response.IDToken = idToken
 	writeToJson(w, response, http.StatusCreated)
 }
 
 func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	var authUser struct {
 		Email    string `json:"email"`
+		Username string `json:"username"`
 		Password string `json:"password"`
+		Nonce    string `json:"nonce"`
 	}
 
 	if err := readFromJson(r, &authUser); err != nil {
 		writeToJson(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
-	existingUser, err := h.DB.GetUser(r.Context(), authUser.Email)
+	// email may also hold a username, for clients with a single login field
+	if authUser.Email == "" {
+		authUser.Email = authUser.Username
+	}
+	existingUser, err := h.findLoginUser(r, authUser.Email)
 
 	if err != nil {
 		log.Printf("DB error for user %s: %v", authUser.Email, err)
 		if errors.Is(err, postgres.ErrInvalidUser) {
-			respErr := map[string]string{
-				"error":  "email or password does not exists",
-				"status": http.StatusText(http.StatusBadRequest),
-			}
-			writeToJson(w, respErr, http.StatusBadRequest)
+			h.recordAuthEvent(r, authEventLogin, &postgres.User{Email: lookupEmail(authUser.Email)}, authOutcomeFailure, authReasonUnknownUser)
+			writeErrorResponse(w, "email or password does not exists", http.StatusBadRequest)
 		} else {
-			respErr := map[string]string{
-				"error":  "an internal server error occured",
-				"status": http.StatusText(http.StatusInternalServerError),
-			}
-			writeToJson(w, respErr, http.StatusInternalServerError)
+			writeErrorResponse(w, "an internal server error occured", http.StatusInternalServerError)
 		}
 		return
 	}
 
-	if !checkPasswordHash(authUser.Password, existingUser.HashedPassword) {
-		respErr := map[string]string{
-			"error":  "invalid login credentials",
-			"status": http.StatusText(http.StatusUnauthorized),
+	lockedUntil, err := h.accountLockedUntil(r.Context(), existingUser.UserID)
+	if err != nil {
+		log.Printf("Lockout check error for user %s: %v", authUser.Email, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if lockedUntil != nil {
+		h.recordAuthEvent(r, authEventLogin, existingUser, authOutcomeFailure, authReasonAccountLocked)
+		writeAccountLocked(w, *lockedUntil)
+		return
+	}
+
+	match, rehash := checkPasswordHash(authUser.Password, existingUser.HashedPassword)
+	if !match {
+		h.recordAuthEvent(r, authEventLogin, existingUser, authOutcomeFailure, authReasonInvalidCredentials)
+		if lockedUntil := h.recordFailedLogin(r.Context(), existingUser); lockedUntil != nil {
+			writeAccountLocked(w, *lockedUntil)
+			return
 		}
-		writeToJson(w, respErr, http.StatusUnauthorized)
+		writeErrorResponse(w, "invalid login credentials", http.StatusUnauthorized)
 		return
 	}
 
-	sessionToken, err := generateJWToken(existingUser.UserID)
+	if rehash {
+		h.rehashPassword(r.Context(), existingUser, authUser.Password)
+	}
+	h.checkBreachedPassword(r.Context(), existingUser, authUser.Password)
+
+	if !existingUser.EmailVerified && emailVerificationPolicy() == VerificationPolicyBlock {
+		h.recordAuthEvent(r, authEventLogin, existingUser, authOutcomeFailure, authReasonEmailUnverified)
+		writeErrorResponse(w, "email address has not been verified", http.StatusForbidden)
+		return
+	}
 
+	mfaRequired, err := h.startMFAChallenge(w, r, existingUser, authUser.Nonce)
 	if err != nil {
-		log.Printf("Token generation error for user %s: %v", authUser.Email, err)
-		respErr := map[string]string{
-			"error":  "internal server error",
-			"status": http.StatusText(http.StatusInternalServerError),
-		}
-		writeToJson(w, respErr, http.StatusInternalServerError)
+		log.Printf("MFA challenge error for user %s: %v", authUser.Email, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
-
-	response := struct {
-		ID         string `json:"id"`
-		Email      string `json:"email"`
-		Token      string `json:"session_token"`
-		StatusCode int    `json:"status_code"`
-		Message    string `json:"message"`
-	}{
-		ID:         existingUser.UserID,
-		Email:      existingUser.Email,
-		Token:      sessionToken,
-		StatusCode: http.StatusOK,
-		Message:    "Login successful! Welcome to AIMAS",
+	if mfaRequired {
+		h.recordAuthEvent(r, authEventLogin, existingUser, authOutcomeChallenge, authReasonMFARequired)
+		return
 	}
 
-	writeToJson(w, response, http.StatusOK)
+	h.writeLoginResponse(w, r, existingUser, authEventLogin, authUser.Nonce)
 }
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/Developer-s-Foundry/df-2.0-aima-auth-service/database/postgres"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/julienschmidt/httprouter"
+)
+
+// introspectionResponse follows RFC 7662 section 2.2. Revoked is an extension
+// that tells the gateway why an otherwise well-formed token is inactive.
+type introspectionResponse struct {
+	Active    bool             `json:"active"`
+	Scope     string           `json:"scope,omitempty"`
+	TokenType string           `json:"token_type,omitempty"`
+	Exp       int64            `json:"exp,omitempty"`
+	Iat       int64            `json:"iat,omitempty"`
+	Sub       string           `json:"sub,omitempty"`
+	Aud       jwt.ClaimStrings `json:"aud,omitempty"`
+	Iss       string           `json:"iss,omitempty"`
+	Jti       string           `json:"jti,omitempty"`
+	Revoked   *bool            `json:"revoked,omitempty"`
+}
+
+// Introspect tells the gateway whether a session or refresh token is
+// currently active. The token is read from the form encoded body as mandated
+// by RFC 7662; JSON bodies are accepted as well.
+func (h *AuthHandler) Introspect(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req struct {
+		Token         string `json:"token"`
+		TokenTypeHint string `json:"token_type_hint"`
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		if err := readFromJson(r, &req); err != nil {
+			writeIntrospectionError(w)
+			return
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			writeIntrospectionError(w)
+			return
+		}
+		req.Token = r.PostForm.Get("token")
+		req.TokenTypeHint = r.PostForm.Get("token_type_hint")
+	}
+
+	if req.Token == "" {
+		writeIntrospectionError(w)
+		return
+	}
+
+	var resp introspectionResponse
+	if req.TokenTypeHint == "refresh_token" {
+		resp = h.introspectRefreshToken(r, req.Token)
+		if !resp.Active && resp.Revoked == nil {
+			resp = h.introspectAccessToken(r, req.Token)
+		}
+	} else {
+		resp = h.introspectAccessToken(r, req.Token)
+		if !resp.Active && resp.Revoked == nil {
+			resp = h.introspectRefreshToken(r, req.Token)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (h *AuthHandler) introspectAccessToken(r *http.Request, token string) introspectionResponse {
+	claims, err := h.verifyAccessToken(r.Context(), token)
+	if err != nil {
+		if errors.Is(err, errRevocationCheck) {
+			log.Printf("unable to introspect access token: %v", err)
+		}
+		if errors.Is(err, ErrTokenRevoked) {
+			revoked := true
+			return introspectionResponse{Active: false, Revoked: &revoked}
+		}
+		return introspectionResponse{Active: false}
+	}
+
+	subject := claims.Subject
+	if subject == "" {
+		subject = claims.UserID
+	}
+
+	revoked := false
+	resp := introspectionResponse{
+		Active:    true,
+		Scope:     claims.Scope,
+		TokenType: "Bearer",
+		Sub:       subject,
+		Aud:       claims.Audience,
+		Iss:       claims.Issuer,
+		Jti:       claims.ID,
+		Revoked:   &revoked,
+	}
+	if claims.ExpiresAt != nil {
+		resp.Exp = claims.ExpiresAt.Unix()
+	}
+	if claims.IssuedAt != nil {
+		resp.Iat = claims.IssuedAt.Unix()
+	}
+	return resp
+}
+
+func (h *AuthHandler) introspectRefreshToken(r *http.Request, token string) introspectionResponse {
+	t, err := h.DB.GetRefreshToken(r.Context(), hashToken(token))
+	if err != nil {
+		if !errors.Is(err, postgres.ErrInvalidRefreshToken) {
+			log.Printf("unable to get refresh token from db: %v", err)
+		}
+		return introspectionResponse{Active: false}
+	}
+
+	revoked := t.RevokedAt != nil || t.RotatedAt != nil
+	if revoked || time.Now().After(t.ExpiresAt) {
+		return introspectionResponse{Active: false, Revoked: &revoked}
+	}
+
+	return introspectionResponse{
+		Active:    true,
+		TokenType: "refresh_token",
+		Sub:       t.UserID,
+		Exp:       t.ExpiresAt.Unix(),
+		Iat:       t.CreatedAt.Unix(),
+		Revoked:   &revoked,
+	}
+}
+
+func writeIntrospectionError(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"error":             "invalid_request",
+		"error_description": "the token parameter is required",
+	})
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Developer-s-Foundry/df-2.0-aima-auth-service/database/postgres"
+)
+
+const (
+	keyringCheckInterval       = 5 * time.Minute
+	keyReloadMinInterval       = 10 * time.Second
+	defaultKeyRotationInterval = 30 * 24 * time.Hour
+	// the default grace period outlives every access token signed just
+	// before a rotation.
+	defaultKeyGracePeriod = accessTokenTTL + time.Hour
+	// minKeyGracePeriod also covers replicas that keep signing with the
+	// retiring key until their next check picks up the rotation.
+	minKeyGracePeriod = accessTokenTTL + keyringCheckInterval
+	// keyPublishLead is how long a new key is in the JWKS before it signs:
+	// every replica loads it within keyringCheckInterval, and verifiers may
+	// hold on to the JWKS they fetched just before for jwksCacheMaxAge.
+	keyPublishLead = keyringCheckInterval + jwksCacheMaxAge
+)
+
+// Keyring persists signing keys in Postgres, encrypted with the master key.
+// The active key signs new tokens. A rotation first adds the next key as
+// pending, which is published in the JWKS for keyPublishLead before it takes
+// over. The previous key is then retiring and still verifies tokens until its
+// grace period is over, at which point it is retired and dropped from the
+// JWKS.
+type Keyring struct {
+	db               *postgres.PostgresConn
+	keys             *KeySet
+	algorithm        string
+	rotationInterval time.Duration
+	gracePeriod      time.Duration
+
+	mu      sync.Mutex
+	pending *postgres.SigningKey
+}
+
+func NewKeyringFromEnv(db *postgres.PostgresConn) (*Keyring, error) {
+	k := &Keyring{
+		db:               db,
+		keys:             NewKeySet(),
+		algorithm:        os.Getenv("JWT_SIGNING_ALG"),
+		rotationInterval: defaultKeyRotationInterval,
+		gracePeriod:      defaultKeyGracePeriod,
+	}
+
+	switch k.algorithm {
+	case "":
+		k.algorithm = AlgES256
+	case AlgRS256, AlgES256, AlgEdDSA:
+	default:
+		return nil, fmt.Errorf("unsupported JWT_SIGNING_ALG %q", k.algorithm)
+	}
+
+	if v := os.Getenv("JWT_KEY_ROTATION_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid JWT_KEY_ROTATION_INTERVAL %q", v)
+		}
+		k.rotationInterval = d
+	}
+
+	if v := os.Getenv("JWT_KEY_GRACE_PERIOD"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWT_KEY_GRACE_PERIOD %q", v)
+		}
+		if d < minKeyGracePeriod {
+			return nil, fmt.Errorf("JWT_KEY_GRACE_PERIOD must be at least %s", minKeyGracePeriod)
+		}
+		k.gracePeriod = d
+	}
+
+	k.keys.reload = func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return k.Load(ctx)
+	}
+	return k, nil
+}
+
+func (k *Keyring) Keys() *KeySet {
+	return k.keys
+}
+
+// Bootstrap loads the keyring and creates its first active key if there is
+// none. A key configured through JWT_PRIVATE_KEY is imported so that tokens
+// signed before the keyring existed keep validating; otherwise a new key is
+// generated.
+func (k *Keyring) Bootstrap(ctx context.Context) error {
+	if err := k.Load(ctx); err != nil {
+		return err
+	}
+	if _, err := k.keys.Active(); err == nil {
+		return nil
+	}
+
+	key, err := loadPrivateKeyFromEnv()
+	if err != nil {
+		return err
+	}
+	if key != nil {
+		log.Printf("[Keyring] Importing configured %s key %s", key.Algorithm, key.ID)
+	} else {
+		key, err = generateSigningKey(k.algorithm)
+		if err != nil {
+			return err
+		}
+		log.Printf("[Keyring] Generated initial %s key %s", key.Algorithm, key.ID)
+	}
+
+	record, err := encryptSigningKey(key)
+	if err != nil {
+		return err
+	}
+	// a concurrent replica may win the race; either way Load picks up
+	// whichever key ended up active.
+	if _, err := k.db.InsertActiveSigningKey(ctx, record); err != nil {
+		return err
+	}
+	return k.Load(ctx)
+}
+
+// Load replaces the in-memory key set with the pending, active and retiring
+// keys stored in Postgres.
+func (k *Keyring) Load(ctx context.Context) error {
+	records, err := k.db.GetSigningKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]*signingKey, 0, len(records))
+	var activeID string
+	var pending *postgres.SigningKey
+	for _, record := range records {
+		key, err := decryptSigningKey(record)
+		if err != nil {
+			return fmt.Errorf("signing key %s: %w", record.KID, err)
+		}
+		keys = append(keys, key)
+		switch record.State {
+		case postgres.SigningKeyActive:
+			activeID = key.ID
+		case postgres.SigningKeyPending:
+			pending = &record
+		}
+	}
+
+	k.keys.Replace(keys, activeID)
+	k.mu.Lock()
+	k.pending = pending
+	k.mu.Unlock()
+	return nil
+}
+
+func (k *Keyring) pendingKey() *postgres.SigningKey {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.pending
+}
+
+// Rotate moves to a new signing key in two steps. Without a pending key it
+// publishes a new one; once the pending key has been published for
+// keyPublishLead it becomes the active key and the current one moves into its
+// grace period.
+func (k *Keyring) Rotate(ctx context.Context) error {
+	current, err := k.keys.Active()
+	if err != nil {
+		return err
+	}
+
+	pending := k.pendingKey()
+	if pending == nil {
+		next, err := generateSigningKey(k.algorithm)
+		if err != nil {
+			return err
+		}
+		record, err := encryptSigningKey(next)
+		if err != nil {
+			return err
+		}
+
+		activateAfter := time.Now().Add(keyPublishLead)
+		created, err := k.db.InsertPendingSigningKey(ctx, record, activateAfter)
+		if err != nil {
+			return err
+		}
+		if created {
+			log.Printf("[Keyring] Published signing key %s, active from %s", next.ID, activateAfter.Format(time.RFC3339))
+		} else {
+			log.Printf("[Keyring] Another replica already published the next signing key")
+		}
+		return k.Load(ctx)
+	}
+
+	if pending.ActivateAfter != nil && time.Now().Before(*pending.ActivateAfter) {
+		return nil
+	}
+
+	err = k.db.RotateSigningKey(ctx, current.ID, pending.KID, time.Now().Add(k.gracePeriod))
+	switch {
+	case errors.Is(err, postgres.ErrSigningKeyRotated):
+		log.Printf("[Keyring] Key %s was already rotated by another replica", current.ID)
+	case err != nil:
+		return err
+	default:
+		log.Printf("[Keyring] Rotated signing key %s -> %s", current.ID, pending.KID)
+	}
+	return k.Load(ctx)
+}
+
+func (k *Keyring) rotateIfDue(ctx context.Context) error {
+	current, err := k.keys.Active()
+	if err != nil {
+		return err
+	}
+	if time.Since(current.CreatedAt) < k.rotationInterval {
+		return nil
+	}
+	return k.Rotate(ctx)
+}
+
+// Run retires keys past their grace period, rotates the active key when it
+// is due and reloads keys rotated by other replicas until ctx is cancelled.
+func (k *Keyring) Run(ctx context.Context) {
+	ticker := time.NewTicker(keyringCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			retired, err := k.db.RetireSigningKeys(ctx)
+			if err != nil {
+				log.Printf("[Keyring] Retire error: %v", err)
+			} else if retired > 0 {
+				log.Printf("[Keyring] Retired %d signing keys", retired)
+			}
+
+			if err := k.rotateIfDue(ctx); err != nil {
+				log.Printf("[Keyring] Rotation error: %v", err)
+			}
+
+			if err := k.Load(ctx); err != nil {
+				log.Printf("[Keyring] Reload error: %v", err)
+			}
+		case <-ctx.Done():
+			log.Println("[Keyring] Context cancelled, stopping key rotation")
+			return
+		}
+	}
+}
+
+func generateSigningKey(algorithm string) (*signingKey, error) {
+	var privateKey crypto.PrivateKey
+	var err error
+
+	switch algorithm {
+	case AlgRS256:
+		privateKey, err = rsa.GenerateKey(rand.Reader, 3072)
+	case AlgES256:
+		privateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgEdDSA:
+		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", algorithm)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate signing key: %w", err)
+	}
+
+	key, err := newSigningKey(privateKey, algorithm)
+	if err != nil {
+		return nil, err
+	}
+	key.CreatedAt = time.Now()
+	return key, nil
+}
+
+func encryptSigningKey(key *signingKey) (postgres.SigningKey, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key.PrivateKey)
+	if err != nil {
+		return postgres.SigningKey{}, fmt.Errorf("failed to encode signing key: %w", err)
+	}
+
+	sealed, err := sealSecret(der, []byte(key.ID))
+	if err != nil {
+		return postgres.SigningKey{}, err
+	}
+
+	return postgres.SigningKey{
+		KID:        key.ID,
+		Algorithm:  key.Algorithm,
+		PrivateKey: sealed,
+	}, nil
+}
+
+func decryptSigningKey(record postgres.SigningKey) (*signingKey, error) {
+	der, err := openSecret(record.PrivateKey, []byte(record.KID))
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key: %w", err)
+	}
+
+	key, err := newSigningKey(privateKey, record.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if key.ID != record.KID {
+		return nil, errors.New("key ID does not match key material")
+	}
+	key.CreatedAt = record.CreatedAt
+	return key, nil
+}
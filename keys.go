@@ -0,0 +1,333 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+	AlgEdDSA = "EdDSA"
+)
+
+// jwtKeys holds the asymmetric keys used by generateJWToken and
+// VerifyJWToken. It is populated from the Postgres keyring at startup.
+var jwtKeys *KeySet
+
+type signingKey struct {
+	ID         string
+	Algorithm  string
+	PrivateKey crypto.PrivateKey
+	PublicKey  crypto.PublicKey
+	CreatedAt  time.Time
+}
+
+func newSigningKey(privateKey crypto.PrivateKey, algorithm string) (*signingKey, error) {
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported private key type")
+	}
+
+	inferred, err := algorithmFor(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	if algorithm == "" {
+		algorithm = inferred
+	}
+	if algorithm != inferred {
+		return nil, fmt.Errorf("private key cannot be used with %s", algorithm)
+	}
+
+	k := &signingKey{
+		Algorithm:  algorithm,
+		PrivateKey: privateKey,
+		PublicKey:  signer.Public(),
+	}
+	k.ID, err = jwkThumbprint(k.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func algorithmFor(publicKey crypto.PublicKey) (string, error) {
+	switch pub := publicKey.(type) {
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < 2048 {
+			return "", errors.New("RSA keys must be at least 2048 bits")
+		}
+		return AlgRS256, nil
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return "", errors.New("only P-256 ECDSA keys are supported")
+		}
+		return AlgES256, nil
+	case ed25519.PublicKey:
+		return AlgEdDSA, nil
+	default:
+		return "", fmt.Errorf("unsupported public key type %T", publicKey)
+	}
+}
+
+func (k *signingKey) method() jwt.SigningMethod {
+	switch k.Algorithm {
+	case AlgRS256:
+		return jwt.SigningMethodRS256
+	case AlgES256:
+		return jwt.SigningMethodES256
+	default:
+		return jwt.SigningMethodEdDSA
+	}
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+func publicJWK(publicKey crypto.PublicKey) (jsonWebKey, error) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch pub := publicKey.(type) {
+	case *rsa.PublicKey:
+		return jsonWebKey{
+			Kty: "RSA",
+			N:   b64(pub.N.Bytes()),
+			E:   b64(big.NewInt(int64(pub.E)).Bytes()),
+		}, nil
+	case *ecdsa.PublicKey:
+		ecdhKey, err := pub.ECDH()
+		if err != nil {
+			return jsonWebKey{}, err
+		}
+		// uncompressed point: 0x04 || X || Y
+		point := ecdhKey.Bytes()[1:]
+		size := len(point) / 2
+		return jsonWebKey{
+			Kty: "EC",
+			Crv: "P-256",
+			X:   b64(point[:size]),
+			Y:   b64(point[size:]),
+		}, nil
+	case ed25519.PublicKey:
+		return jsonWebKey{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			X:   b64(pub),
+		}, nil
+	default:
+		return jsonWebKey{}, fmt.Errorf("unsupported public key type %T", publicKey)
+	}
+}
+
+// jwkThumbprint computes the RFC 7638 thumbprint that is used as the key ID.
+func jwkThumbprint(publicKey crypto.PublicKey) (string, error) {
+	jwk, err := publicJWK(publicKey)
+	if err != nil {
+		return "", err
+	}
+
+	// members in lexicographic order, as required by RFC 7638
+	var canonical string
+	switch jwk.Kty {
+	case "RSA":
+		canonical = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, jwk.E, jwk.N)
+	case "EC":
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, jwk.Crv, jwk.X, jwk.Y)
+	default:
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":"OKP","x":%q}`, jwk.Crv, jwk.X)
+	}
+
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// KeySet is the set of keys tokens may be signed or verified with.
+type KeySet struct {
+	mu       sync.RWMutex
+	keys     map[string]*signingKey
+	activeID string
+
+	// reload is called when a token names an unknown kid, because another
+	// replica may have rotated in a key this one has not loaded yet.
+	reload     func() error
+	reloadMu   sync.Mutex
+	lastReload time.Time
+}
+
+func NewKeySet() *KeySet {
+	return &KeySet{keys: make(map[string]*signingKey)}
+}
+
+// Active returns the key new tokens are signed with.
+func (s *KeySet) Active() (*signingKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	k, ok := s.keys[s.activeID]
+	if !ok {
+		return nil, errors.New("no active signing key")
+	}
+	return k, nil
+}
+
+// Replace swaps the whole set for keys, making activeID the signing key.
+func (s *KeySet) Replace(keys []*signingKey, activeID string) {
+	set := make(map[string]*signingKey, len(keys))
+	for _, k := range keys {
+		set[k.ID] = k
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = set
+	s.activeID = activeID
+}
+
+func (s *KeySet) Lookup(kid string) (*signingKey, bool) {
+	if k, ok := s.lookup(kid); ok || s.reload == nil {
+		return k, ok
+	}
+
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	// reloads are rate limited so that tokens with made up key IDs cannot
+	// be used to hammer the database.
+	if time.Since(s.lastReload) < keyReloadMinInterval {
+		return s.lookup(kid)
+	}
+	s.lastReload = time.Now()
+	if err := s.reload(); err != nil {
+		log.Printf("[Keys] Reload error: %v", err)
+	}
+	return s.lookup(kid)
+}
+
+func (s *KeySet) lookup(kid string) (*signingKey, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	k, ok := s.keys[kid]
+	return k, ok
+}
+
+func (s *KeySet) JWKS() ([]jsonWebKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]jsonWebKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		jwk, err := publicJWK(k.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		jwk.Kid = k.ID
+		jwk.Use = "sig"
+		jwk.Alg = k.Algorithm
+		keys = append(keys, jwk)
+	}
+	return keys, nil
+}
+
+// Algorithms lists the distinct algorithms of the keys in the set.
+func (s *KeySet) Algorithms() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var algorithms []string
+	seen := make(map[string]bool)
+	for _, k := range s.keys {
+		if !seen[k.Algorithm] {
+			seen[k.Algorithm] = true
+			algorithms = append(algorithms, k.Algorithm)
+		}
+	}
+	return algorithms
+}
+
+// loadPrivateKeyFromEnv reads the PEM encoded private key from JWT_PRIVATE_KEY
+// or JWT_PRIVATE_KEY_FILE. It returns nil when neither is set.
+func loadPrivateKeyFromEnv() (*signingKey, error) {
+	pemData := os.Getenv("JWT_PRIVATE_KEY")
+	if path := os.Getenv("JWT_PRIVATE_KEY_FILE"); pemData == "" && path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read JWT_PRIVATE_KEY_FILE: %w", err)
+		}
+		pemData = string(data)
+	}
+
+	if pemData == "" {
+		return nil, nil
+	}
+
+	privateKey, err := parsePrivateKeyPEM([]byte(strings.ReplaceAll(pemData, `\n`, "\n")))
+	if err != nil {
+		return nil, err
+	}
+
+	return newSigningKey(privateKey, os.Getenv("JWT_SIGNING_ALG"))
+}
+
+func parsePrivateKeyPEM(data []byte) (crypto.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found in JWT private key")
+	}
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+}
+
+// jwksCacheMaxAge is how long verifiers may cache the JWKS. New keys are
+// published at least this long before they sign, see keyPublishLead.
+const jwksCacheMaxAge = 5 * time.Minute
+
+// JWKS publishes the public half of every signing key so that other services
+// can verify tokens without being able to mint them.
+func JWKS(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	keys, err := jwtKeys.JWKS()
+	if err != nil {
+		log.Printf("unable to encode JWKS: %v", err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(jwksCacheMaxAge.Seconds())))
+	_ = json.NewEncoder(w).Encode(map[string][]jsonWebKey{"keys": keys})
+}
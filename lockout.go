@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Developer-s-Foundry/df-2.0-aima-auth-service/database/postgres"
+	"github.com/Developer-s-Foundry/df-2.0-aima-auth-service/database/rabbitmq"
+	"github.com/julienschmidt/httprouter"
+)
+
+// LockoutPolicy locks an account after Threshold failed logins within
+// Window. The first lock lasts BaseDuration and each consecutive one twice as
+// long as the previous, up to MaxDuration. Once the account has been quiet for
+// MaxDuration, neither locked nor failing logins, the escalation starts over.
+type LockoutPolicy struct {
+	Threshold    int
+	Window       time.Duration
+	BaseDuration time.Duration
+	MaxDuration  time.Duration
+}
+
+// LockDuration is how long the lockouts-th consecutive lock lasts.
+func (p LockoutPolicy) LockDuration(lockouts int) time.Duration {
+	d := p.BaseDuration
+	for i := 1; i < lockouts && d < p.MaxDuration; i++ {
+		d *= 2
+	}
+	return min(d, p.MaxDuration)
+}
+
+// RecordFailure counts a failed login at now against l and returns the end of
+// the lock it causes, or nil when it causes none. An earlier lock is left in
+// l.LockedUntil.
+func (p LockoutPolicy) RecordFailure(l *postgres.AccountLockout, now time.Time) *time.Time {
+	if l.LastFailedAt == nil || now.Sub(*l.LastFailedAt) > p.Window {
+		l.FailedAttempts = 0
+	}
+	quietSince := time.Time{}
+	if l.LastFailedAt != nil {
+		quietSince = *l.LastFailedAt
+	}
+	if l.LockedUntil != nil && l.LockedUntil.After(quietSince) {
+		quietSince = *l.LockedUntil
+	}
+	if now.Sub(quietSince) > p.MaxDuration {
+		l.Lockouts = 0
+	}
+	l.FailedAttempts++
+	l.LastFailedAt = &now
+
+	if l.FailedAttempts < p.Threshold {
+		return nil
+	}
+	l.Lockouts++
+	l.FailedAttempts = 0
+	lockedUntil := now.Add(p.LockDuration(l.Lockouts))
+	l.LockedUntil = &lockedUntil
+	return &lockedUntil
+}
+
+// lockoutPolicy decides when failed logins lock an account. It is loaded from
+// the LOCKOUT_* variables at startup.
+var lockoutPolicy = LockoutPolicy{
+	Threshold:    5,
+	Window:       15 * time.Minute,
+	BaseDuration: 5 * time.Minute,
+	MaxDuration:  24 * time.Hour,
+}
+
+func loadLockoutPolicy() (LockoutPolicy, error) {
+	policy := lockoutPolicy
+
+	if v := os.Getenv("LOCKOUT_THRESHOLD"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return policy, fmt.Errorf("invalid LOCKOUT_THRESHOLD %q", v)
+		}
+		policy.Threshold = n
+	}
+
+	durations := []struct {
+		name string
+		dst  *time.Duration
+	}{
+		{"LOCKOUT_WINDOW", &policy.Window},
+		{"LOCKOUT_DURATION", &policy.BaseDuration},
+		{"LOCKOUT_MAX_DURATION", &policy.MaxDuration},
+	}
+	for _, d := range durations {
+		v := os.Getenv(d.name)
+		if v == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(v)
+		if err != nil || parsed <= 0 {
+			return policy, fmt.Errorf("invalid %s %q", d.name, v)
+		}
+		*d.dst = parsed
+	}
+
+	if policy.MaxDuration < policy.BaseDuration {
+		return policy, errors.New("LOCKOUT_MAX_DURATION must not be shorter than LOCKOUT_DURATION")
+	}
+	return policy, nil
+}
+
+// accountLockedUntil returns the end of the user's current lock, or nil when
+// the account is not locked.
+func (h *AuthHandler) accountLockedUntil(ctx context.Context, userID string) (*time.Time, error) {
+	lockedUntil, err := h.DB.GetLockedUntil(ctx, userID)
+	if err != nil || lockedUntil == nil || !time.Now().Before(*lockedUntil) {
+		return nil, err
+	}
+	return lockedUntil, nil
+}
+
+// recordFailedLogin counts a wrong password or second factor against the
+// user and tells the account owner when that locks the account. It returns
+// the end of the new lock, or nil if the account was not locked.
+func (h *AuthHandler) recordFailedLogin(ctx context.Context, user *postgres.User) *time.Time {
+	lockedUntil, err := h.DB.RecordFailedLogin(ctx, user.UserID, lockoutPolicy.RecordFailure)
+	if err != nil {
+		log.Printf("unable to record failed login for user %s: %v", user.UserID, err)
+		return nil
+	}
+	if lockedUntil == nil {
+		return nil
+	}
+
+	userData := map[string]interface{}{
+		"data": map[string]string{
+			"type":         rabbitmq.NotifyAccountLocked,
+			"email":        user.Email,
+			"id":           user.UserID,
+			"locked_until": lockedUntil.String(),
+			"timestamp":    time.Now().String(),
+		},
+		"queue_name":    rabbitmq.NotificationQueue,
+		"exchange_name": rabbitmq.NotificationExchange,
+	}
+
+	go h.RabbMQ.PublishNotification(userData)
+
+	return lockedUntil
+}
+
+// writeAccountLocked answers 423 Locked with the time the lock ends.
+func writeAccountLocked(w http.ResponseWriter, lockedUntil time.Time) {
+	retryAfter := int(math.Ceil(time.Until(lockedUntil).Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+
+	response := struct {
+		Error       string    `json:"error"`
+		Status      string    `json:"status"`
+		Locked      bool      `json:"locked"`
+		LockedUntil time.Time `json:"locked_until"`
+	}{
+		Error:       "account is temporarily locked after too many failed login attempts",
+		Status:      http.StatusText(http.StatusLocked),
+		Locked:      true,
+		LockedUntil: lockedUntil.UTC(),
+	}
+	writeToJson(w, response, http.StatusLocked)
+}
+
+// UnlockAccount lifts the lock of a user and clears the failed login history
+// that would otherwise escalate the next lock.
+func (h *AuthHandler) UnlockAccount(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userID := ps.ByName("id")
+
+	if _, err := h.DB.GetUserByID(r.Context(), userID); err != nil {
+		if errors.Is(err, postgres.ErrInvalidUser) {
+			writeErrorResponse(w, "user not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("unable to get user %s from db: %v", userID, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.DB.ResetFailedLogins(r.Context(), userID); err != nil {
+		log.Printf("unable to unlock user %s: %v", userID, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		Message    string `json:"message"`
+		StatusCode int    `json:"status_code"`
+	}{
+		Message:    "Account unlocked",
+		StatusCode: http.StatusOK,
+	}
+	writeToJson(w, response, http.StatusOK)
+}
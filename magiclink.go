@@ -0,0 +1,252 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Developer-s-Foundry/df-2.0-aima-auth-service/database/postgres"
+	"github.com/Developer-s-Foundry/df-2.0-aima-auth-service/database/rabbitmq"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	magicLinkTTL = 15 * time.Minute
+	// magicLinkAudience keeps magic link tokens from being accepted anywhere
+	// else a token signed with the same keys is.
+	magicLinkAudience = "aimas-magic-link"
+	magicLinkCookie   = "aimas_magic_link"
+)
+
+// MagicLinkClaims are carried by the token in a magic link. BrowserHash is the
+// hashToken digest of the browser nonce handed to whoever requested the link,
+// so the link only works in that browser.
+type MagicLinkClaims struct {
+	Nonce       string `json:"nonce,omitempty"`
+	BrowserHash string `json:"bnd"`
+	jwt.RegisteredClaims
+}
+
+func generateMagicLinkToken(user *postgres.User, browserNonce, nonce string) (string, error) {
+	now := time.Now()
+	claims := MagicLinkClaims{
+		Nonce:       nonce,
+		BrowserHash: hashToken(browserNonce),
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        generateUuid(),
+			Issuer:    publicBaseURL(),
+			Subject:   user.UserID,
+			Audience:  jwt.ClaimStrings{magicLinkAudience},
+			ExpiresAt: jwt.NewNumericDate(now.Add(magicLinkTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+	return signJWToken(claims)
+}
+
+func verifyMagicLinkToken(tokenString string) (*MagicLinkClaims, error) {
+	token, err := jwt.ParseWithClaims(
+		tokenString,
+		&MagicLinkClaims{},
+		verificationKey,
+		jwt.WithValidMethods([]string{AlgRS256, AlgES256, AlgEdDSA}),
+		jwt.WithAudience(magicLinkAudience),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(*MagicLinkClaims)
+	if !ok || !token.Valid || claims.ID == "" || claims.Subject == "" || claims.BrowserHash == "" {
+		return nil, errors.New("invalid token")
+	}
+	return claims, nil
+}
+
+func setMagicLinkCookie(w http.ResponseWriter, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     magicLinkCookie,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(publicBaseURL(), "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// RequestMagicLink mails a single-use login link to the account owner and
+// binds it to the requesting browser with a nonce, set as a cookie and
+// returned in the body for clients that cannot rely on cookies. Like
+// ForgotPassword it answers 202 whether or not the account exists.
+func (h *AuthHandler) RequestMagicLink(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var body struct {
+		Email string `json:"email"`
+		Nonce string `json:"nonce"`
+	}
+
+	if err := readFromJson(r, &body); err != nil || body.Email == "" {
+		writeErrorResponse(w, "email is required", http.StatusBadRequest)
+		return
+	}
+
+	browserNonce, err := generateOpaqueToken()
+	if err != nil {
+		log.Printf("error generating magic link nonce %v", err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	setMagicLinkCookie(w, browserNonce, int(magicLinkTTL.Seconds()))
+
+	response := struct {
+		BrowserNonce string `json:"browser_nonce"`
+		ExpiresIn    int    `json:"expires_in"`
+		Message      string `json:"message"`
+		StatusCode   int    `json:"status_code"`
+	}{
+		BrowserNonce: browserNonce,
+		ExpiresIn:    int(magicLinkTTL.Seconds()),
+		Message:      "If an account exists for this email, a login link has been sent",
+		StatusCode:   http.StatusAccepted,
+	}
+
+	user, err := h.DB.GetUser(r.Context(), lookupEmail(body.Email))
+	if err != nil {
+		if !errors.Is(err, postgres.ErrInvalidUser) {
+			log.Printf("unable to get user from db: %v", err)
+		}
+		writeToJson(w, response, http.StatusAccepted)
+		return
+	}
+
+	token, err := generateMagicLinkToken(user, browserNonce, body.Nonce)
+	if err != nil {
+		log.Printf("error generating magic link for user %s: %v", user.UserID, err)
+		writeToJson(w, response, http.StatusAccepted)
+		return
+	}
+
+	userData := map[string]interface{}{
+		"data": map[string]string{
+			"type":           rabbitmq.NotifyMagicLink,
+			"email":          user.Email,
+			"id":             user.UserID,
+			"magic_link_url": linkWithToken(os.Getenv("MAGIC_LINK_URL"), token),
+			"expires_at":     time.Now().Add(magicLinkTTL).String(),
+			"timestamp":      time.Now().String(),
+		},
+		"queue_name":    rabbitmq.NotificationQueue,
+		"exchange_name": rabbitmq.NotificationExchange,
+	}
+
+	notification, err := newOutboxEvent(rabbitmq.NotificationExchange, rabbitmq.NotificationQueue, userData)
+	if err != nil {
+		log.Printf("error encoding magic link notification %v", err)
+		writeToJson(w, response, http.StatusAccepted)
+		return
+	}
+
+	// the link logs in whoever holds it, so it only leaves sealed through
+	// the outbox relay
+	if err := h.DB.InsertOutboxEvents(r.Context(), notification); err != nil {
+		log.Printf("unable to queue magic link for user %s: %v", user.UserID, err)
+	}
+
+	writeToJson(w, response, http.StatusAccepted)
+}
+
+// ConsumeMagicLink exchanges a magic link token for the same response Login
+// gives after a correct password, including an MFA challenge when the user
+// has a second factor enabled.
+func (h *AuthHandler) ConsumeMagicLink(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var body struct {
+		Token        string `json:"token"`
+		BrowserNonce string `json:"browser_nonce"`
+	}
+
+	if err := readFromJson(r, &body); err != nil || body.Token == "" {
+		writeErrorResponse(w, "token is required", http.StatusBadRequest)
+		return
+	}
+	if body.BrowserNonce == "" {
+		if cookie, err := r.Cookie(magicLinkCookie); err == nil {
+			body.BrowserNonce = cookie.Value
+		}
+	}
+
+	claims, err := verifyMagicLinkToken(body.Token)
+	if err != nil {
+		h.recordAuthEvent(r, authEventLoginMagicLink, &postgres.User{}, authOutcomeFailure, authReasonInvalidToken)
+		writeErrorResponse(w, "magic link is invalid or has expired", http.StatusUnauthorized)
+		return
+	}
+
+	// checked before the link is burned, so a forwarded link cannot be used
+	// to lock its owner out
+	if subtle.ConstantTimeCompare([]byte(hashToken(body.BrowserNonce)), []byte(claims.BrowserHash)) != 1 {
+		h.recordAuthEvent(r, authEventLoginMagicLink, &postgres.User{UserID: claims.Subject}, authOutcomeFailure, authReasonInvalidToken)
+		writeErrorResponse(w, "magic link must be opened in the browser that requested it", http.StatusUnauthorized)
+		return
+	}
+
+	// a locked account keeps its link, it may still be used once the lock ends
+	lockedUntil, err := h.accountLockedUntil(r.Context(), claims.Subject)
+	if err != nil {
+		log.Printf("unable to check lockout of user %s: %v", claims.Subject, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if lockedUntil != nil {
+		h.recordAuthEvent(r, authEventLoginMagicLink, &postgres.User{UserID: claims.Subject}, authOutcomeFailure, authReasonAccountLocked)
+		writeAccountLocked(w, *lockedUntil)
+		return
+	}
+
+	if err := h.DB.RedeemMagicLink(r.Context(), claims.ID, claims.Subject, claims.ExpiresAt.Time); err != nil {
+		if errors.Is(err, postgres.ErrMagicLinkUsed) {
+			h.recordAuthEvent(r, authEventLoginMagicLink, &postgres.User{UserID: claims.Subject}, authOutcomeFailure, authReasonInvalidToken)
+			writeErrorResponse(w, "magic link is invalid or has expired", http.StatusUnauthorized)
+			return
+		}
+		log.Printf("unable to redeem magic link for user %s: %v", claims.Subject, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	setMagicLinkCookie(w, "", -1)
+
+	user, err := h.DB.GetUserByID(r.Context(), claims.Subject)
+	if err != nil {
+		if errors.Is(err, postgres.ErrInvalidUser) {
+			writeErrorResponse(w, "magic link is invalid or has expired", http.StatusUnauthorized)
+			return
+		}
+		log.Printf("unable to get user %s from db: %v", claims.Subject, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if !user.EmailVerified && emailVerificationPolicy() == VerificationPolicyBlock {
+		h.recordAuthEvent(r, authEventLoginMagicLink, user, authOutcomeFailure, authReasonEmailUnverified)
+		writeErrorResponse(w, "email address has not been verified", http.StatusForbidden)
+		return
+	}
+
+	mfaRequired, err := h.startMFAChallenge(w, r, user, claims.Nonce)
+	if err != nil {
+		log.Printf("MFA challenge error for user %s: %v", user.UserID, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if mfaRequired {
+		h.recordAuthEvent(r, authEventLoginMagicLink, user, authOutcomeChallenge, authReasonMFARequired)
+		return
+	}
+
+	h.writeLoginResponse(w, r, user, authEventLoginMagicLink, claims.Nonce)
+}
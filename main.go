@@ -19,13 +19,23 @@ import (
 )
 
 type AuthHandler struct {
-	DB     *postgres.PostgresConn
+	DB     Store
 	RabbMQ *rabbitmq.RabbitMQ
+	// Revocations serves revocation checks in front of DB. DB answers them
+	// itself when it is nil.
+	Revocations RevocationStore
 }
 
 func main() {
 	_ = godotenv.Load()
 
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	portString := os.Getenv("PORT")
 	rConnStr := os.Getenv("RABBITMQ_URL")
 	if portString == "" {
@@ -37,20 +47,89 @@ func main() {
 		log.Fatal("Invalid PORT parameter")
 	}
 
-	url, user := os.Getenv("DB_URL"), os.Getenv("DB_USER")
-	host := os.Getenv("DB_HOST")
-	password, port := os.Getenv("DB_PASSWORD"), os.Getenv("DB_PORT")
-	dbName, dbSSL := os.Getenv("DB_NAME"), os.Getenv("DB_SSL")
-
-	post, err := postgres.ConnectPostgres(url, password, port, host, dbName, user, dbSSL)
+	post, err := connectPostgresFromEnv()
 	if err != nil {
 		panic(err)
 	}
 
+	if err := migrateOnStartup(post); err != nil {
+		log.Fatal(err)
+	}
+
+	masterKey, err = loadMasterKey()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := checkPublicBaseURL(); err != nil {
+		log.Fatal(err)
+	}
+
+	lockoutPolicy, err = loadLockoutPolicy()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	authEventRetention, err = loadAuthEventRetention()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	passwordHasher, err = loadPasswordHasher()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	passwordPolicy, err = loadPasswordPolicy()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if passwordPolicy.Breached != nil {
+		log.Printf("Loaded %d breached password hashes", passwordPolicy.Breached.Len())
+	}
+
 	rabbit := rabbitmq.NewRabbitMQ(rConnStr)
 
 	var wg sync.WaitGroup
-	// ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
+
+	keyring, err := NewKeyringFromEnv(post)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := keyring.Bootstrap(ctx); err != nil {
+		log.Fatalf("unable to load signing keys: %v", err)
+	}
+	jwtKeys = keyring.Keys()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		keyring.Run(ctx)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		runCleanup(ctx, post)
+	}()
+
+	revocations := NewRevocationCache(post)
+	if err := revocations.Sync(ctx); err != nil {
+		log.Fatalf("unable to load revoked tokens: %v", err)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		revocations.Run(ctx)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		revocations.Listen(ctx)
+	}()
 
 	wg.Add(1)
 	go func() {
@@ -65,6 +144,17 @@ func main() {
 		log.Fatal(err)
 	}
 
+	outboxRelay, err := NewOutboxRelayFromEnv(post, rabbit)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		outboxRelay.Run(ctx)
+	}()
+
 	// consumeEmail := rabbitmq.NewConsumer(rabbit, "notification_email_queue", "email-worker", handleEmailDeliveryAck)
 
 	// wg.Add(1)
@@ -73,10 +163,45 @@ func main() {
 	// 	consumeEmail.Start(ctx)
 	// }()
 
-	auth := &AuthHandler{DB: post, RabbMQ: rabbit}
+	rateLimiter, err := NewRateLimiterFromEnv(post)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	auth := &AuthHandler{DB: post, RabbMQ: rabbit, Revocations: revocations}
 	router := httprouter.New()
-	router.POST("/register", VerifyGatewayRequest(auth.Register))
-	router.POST("/login", VerifyGatewayRequest(auth.Login))
+	router.POST("/register", VerifyGatewayRequest(rateLimiter.Limit("register", auth.Register)))
+	router.POST("/login", VerifyGatewayRequest(rateLimiter.Limit("login", auth.Login)))
+	router.POST("/token/refresh", VerifyGatewayRequest(auth.RefreshToken))
+	router.POST("/logout", VerifyGatewayRequest(auth.RequireAuth(auth.Logout)))
+	router.GET("/.well-known/jwks.json", JWKS)
+	router.POST("/introspect", VerifyGatewayRequest(auth.Introspect))
+	router.GET("/.well-known/openid-configuration", OpenIDConfiguration)
+	router.GET("/userinfo", VerifyGatewayRequest(auth.RequireAuth(auth.UserInfo)))
+	router.POST("/userinfo", VerifyGatewayRequest(auth.RequireAuth(auth.UserInfo)))
+	router.POST("/verify-email", VerifyGatewayRequest(auth.VerifyEmail))
+	router.POST("/verify-email/resend", VerifyGatewayRequest(auth.ResendVerificationEmail))
+	router.POST("/password/forgot", VerifyGatewayRequest(auth.ForgotPassword))
+	router.POST("/password/reset", VerifyGatewayRequest(auth.ResetPassword))
+	router.POST("/password/change", VerifyGatewayRequest(auth.RequireAuth(auth.ChangePassword)))
+	router.PATCH("/me/username", VerifyGatewayRequest(auth.RequireAuth(auth.UpdateUsername)))
+	router.POST("/login/mfa", VerifyGatewayRequest(rateLimiter.Limit("login", auth.CompleteMFALogin)))
+	router.POST("/login/magic-link", VerifyGatewayRequest(auth.RequestMagicLink))
+	router.POST("/login/magic-link/consume", VerifyGatewayRequest(auth.ConsumeMagicLink))
+	router.POST("/login/otp", VerifyGatewayRequest(auth.RequestEmailOTP))
+	router.POST("/login/otp/verify", VerifyGatewayRequest(rateLimiter.Limit("login", auth.VerifyEmailOTP)))
+	router.POST("/admin/users/:id/unlock", VerifyGatewayRequest(RequireAdmin(auth.UnlockAccount)))
+	router.GET("/admin/auth-events", VerifyGatewayRequest(RequireAdmin(auth.ListAuthEvents)))
+	router.POST("/mfa/totp/enroll", VerifyGatewayRequest(auth.RequireAuth(auth.EnrollTOTP)))
+	router.POST("/mfa/totp/confirm", VerifyGatewayRequest(auth.RequireAuth(auth.ConfirmTOTP)))
+	router.POST("/mfa/totp/disable", VerifyGatewayRequest(auth.RequireAuth(auth.DisableTOTP)))
+	router.POST("/mfa/recovery-codes", VerifyGatewayRequest(auth.RequireAuth(auth.RegenerateRecoveryCodes)))
+	router.POST("/webauthn/register/begin", VerifyGatewayRequest(auth.RequireAuth(auth.BeginPasskeyRegistration)))
+	router.POST("/webauthn/register/finish", VerifyGatewayRequest(auth.RequireAuth(auth.FinishPasskeyRegistration)))
+	router.GET("/webauthn/credentials", VerifyGatewayRequest(auth.RequireAuth(auth.ListPasskeys)))
+	router.DELETE("/webauthn/credentials/:id", VerifyGatewayRequest(auth.RequireAuth(auth.DeletePasskey)))
+	router.POST("/webauthn/login/begin", VerifyGatewayRequest(auth.BeginPasskeyLogin))
+	router.POST("/webauthn/login/finish", VerifyGatewayRequest(auth.FinishPasskeyLogin))
 
 	server := &http.Server{
 		Addr:         fmt.Sprintf(":%d", portInt),
@@ -100,7 +225,7 @@ func main() {
 	<-stop
 	log.Println("[Main] Shutdown signal received")
 
-	// cancel()
+	cancel()
 
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer shutdownCancel()
@@ -115,3 +240,12 @@ func main() {
 	wg.Wait()
 	log.Println("[Main] All goroutines exited cleanly")
 }
+
+func connectPostgresFromEnv() (*postgres.PostgresConn, error) {
+	url, user := os.Getenv("DB_URL"), os.Getenv("DB_USER")
+	host := os.Getenv("DB_HOST")
+	password, port := os.Getenv("DB_PASSWORD"), os.Getenv("DB_PORT")
+	dbName, dbSSL := os.Getenv("DB_NAME"), os.Getenv("DB_SSL")
+
+	return postgres.ConnectPostgres(url, password, port, host, dbName, user, dbSSL)
+}
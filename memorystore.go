@@ -0,0 +1,940 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Developer-s-Foundry/df-2.0-aima-auth-service/database/postgres"
+)
+
+// errDuplicateKey stands in for the primary key violations Postgres reports
+// when a token or challenge is stored twice.
+var errDuplicateKey = errors.New("duplicate key")
+
+// MemoryStore is a Store that keeps everything in process memory, for tests
+// and single instance development setups. It enforces the same uniqueness
+// rules and returns the same errors as the Postgres store, but does not check
+// that referenced users exist. Nothing survives a restart.
+type MemoryStore struct {
+	mu sync.Mutex
+
+	users             map[string]*postgres.User
+	userIDsByEmail    map[string]string
+	userIDsByUsername map[string]string
+
+	refreshTokens        map[string]*postgres.RefreshToken
+	refreshTokenIDs      map[string]string
+	verificationTokens   map[string]*postgres.EmailVerificationToken
+	passwordResetTokens  map[string]*postgres.PasswordResetToken
+	totps                map[string]*postgres.TOTPCredential
+	mfaChallenges        map[string]*postgres.MFAChallenge
+	recoveryCodes        map[string]map[string]*time.Time
+	webAuthnCredentials  map[string][]*postgres.WebAuthnCredential
+	webAuthnCredentialOf map[string]string
+	webAuthnChallenges   map[string]*postgres.WebAuthnChallenge
+	magicLinks           map[string]time.Time
+	emailOTPs            map[string]*postgres.EmailOTP
+	lockouts             map[string]*postgres.AccountLockout
+	revokedTokens        map[string]time.Time
+	sessionCutoffs       map[string]time.Time
+
+	// outbox holds every event in insertion order; relayMu lets one relay
+	// run at a time without holding mu while publishing.
+	outbox   []*postgres.OutboxEvent
+	outboxID int64
+	relayMu  sync.Mutex
+
+	authEvents []postgres.AuthEvent
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:                make(map[string]*postgres.User),
+		userIDsByEmail:       make(map[string]string),
+		userIDsByUsername:    make(map[string]string),
+		refreshTokens:        make(map[string]*postgres.RefreshToken),
+		refreshTokenIDs:      make(map[string]string),
+		verificationTokens:   make(map[string]*postgres.EmailVerificationToken),
+		passwordResetTokens:  make(map[string]*postgres.PasswordResetToken),
+		totps:                make(map[string]*postgres.TOTPCredential),
+		mfaChallenges:        make(map[string]*postgres.MFAChallenge),
+		recoveryCodes:        make(map[string]map[string]*time.Time),
+		webAuthnCredentials:  make(map[string][]*postgres.WebAuthnCredential),
+		webAuthnCredentialOf: make(map[string]string),
+		webAuthnChallenges:   make(map[string]*postgres.WebAuthnChallenge),
+		magicLinks:           make(map[string]time.Time),
+		emailOTPs:            make(map[string]*postgres.EmailOTP),
+		lockouts:             make(map[string]*postgres.AccountLockout),
+		revokedTokens:        make(map[string]time.Time),
+		sessionCutoffs:       make(map[string]time.Time),
+	}
+}
+
+func (s *MemoryStore) InsertUser(u postgres.User, verification *postgres.EmailVerificationToken, events ...postgres.OutboxEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	email := strings.ToLower(u.Email)
+	if _, ok := s.users[u.UserID]; ok {
+		return postgres.ErrUserExists
+	}
+	if _, ok := s.userIDsByEmail[email]; ok {
+		return postgres.ErrUserExists
+	}
+	if verification != nil {
+		if _, ok := s.verificationTokens[verification.TokenHash]; ok {
+			return fmt.Errorf("failed to insert email verification token: %w", errDuplicateKey)
+		}
+	}
+
+	now := time.Now()
+	s.users[u.UserID] = &postgres.User{
+		UserID:         u.UserID,
+		Email:          u.Email,
+		HashedPassword: u.HashedPassword,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+	s.userIDsByEmail[email] = u.UserID
+
+	if verification != nil {
+		s.verificationTokens[verification.TokenHash] = &postgres.EmailVerificationToken{
+			TokenHash: verification.TokenHash,
+			UserID:    verification.UserID,
+			ExpiresAt: verification.ExpiresAt,
+			CreatedAt: now,
+		}
+	}
+	s.appendOutboxEvents(events, now)
+	return nil
+}
+
+// appendOutboxEvents queues copies of events for the relay. s.mu must be
+// held.
+func (s *MemoryStore) appendOutboxEvents(events []postgres.OutboxEvent, now time.Time) {
+	for _, e := range events {
+		s.outboxID++
+		s.outbox = append(s.outbox, &postgres.OutboxEvent{
+			ID:         s.outboxID,
+			Exchange:   e.Exchange,
+			RoutingKey: e.RoutingKey,
+			Payload:    slices.Clone(e.Payload),
+			CreatedAt:  now,
+		})
+	}
+}
+
+// user returns a copy of the user with the given ID, so that callers cannot
+// change the stored one. s.mu must be held.
+func (s *MemoryStore) user(userID string) (*postgres.User, error) {
+	u, ok := s.users[userID]
+	if !ok {
+		return nil, postgres.ErrInvalidUser
+	}
+	c := *u
+	return &c, nil
+}
+
+func (s *MemoryStore) GetUser(_ context.Context, email string) (*postgres.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.user(s.userIDsByEmail[strings.ToLower(email)])
+}
+
+func (s *MemoryStore) GetUserByID(_ context.Context, userID string) (*postgres.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.user(userID)
+}
+
+func (s *MemoryStore) GetUserByUsername(_ context.Context, username string) (*postgres.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.user(s.userIDsByUsername[strings.ToLower(username)])
+}
+
+func (s *MemoryStore) UpdateUsername(_ context.Context, userID, newUsername string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userID]
+	if !ok {
+		return "", postgres.ErrInvalidUser
+	}
+	key := strings.ToLower(newUsername)
+	if owner, taken := s.userIDsByUsername[key]; newUsername != "" && taken && owner != userID {
+		return "", postgres.ErrUsernameTaken
+	}
+
+	previous := ""
+	if u.Username != nil {
+		previous = *u.Username
+		delete(s.userIDsByUsername, strings.ToLower(previous))
+	}
+	u.Username = nil
+	if newUsername != "" {
+		u.Username = &newUsername
+		s.userIDsByUsername[key] = userID
+	}
+	u.UpdatedAt = time.Now()
+	return previous, nil
+}
+
+func (s *MemoryStore) UpdatePassword(_ context.Context, userID, hashedPassword string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userID]
+	if !ok {
+		return postgres.ErrInvalidUser
+	}
+	u.HashedPassword = hashedPassword
+	u.PasswordBreachedAt = nil
+	u.UpdatedAt = time.Now()
+	return nil
+}
+
+func (s *MemoryStore) UpdatePasswordAndRevokeSessions(_ context.Context, userID, hashedPassword string, revokedBefore time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userID]
+	if !ok {
+		return postgres.ErrInvalidUser
+	}
+	now := time.Now()
+	u.HashedPassword = hashedPassword
+	u.PasswordBreachedAt = nil
+	u.UpdatedAt = now
+	s.revokeUserRefreshTokens(userID, now)
+	s.revokeSessions(userID, revokedBefore)
+	return nil
+}
+
+func (s *MemoryStore) UpgradePasswordHash(_ context.Context, userID, oldHash, newHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u, ok := s.users[userID]; ok && u.HashedPassword == oldHash {
+		u.HashedPassword = newHash
+	}
+	return nil
+}
+
+func (s *MemoryStore) FlagBreachedPassword(_ context.Context, userID string) (*time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userID]
+	if !ok || u.PasswordBreachedAt != nil {
+		return nil, nil
+	}
+	flaggedAt := time.Now()
+	u.PasswordBreachedAt = &flaggedAt
+	return &flaggedAt, nil
+}
+
+func (s *MemoryStore) InsertRefreshToken(_ context.Context, t postgres.RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.insertRefreshToken(t); err != nil {
+		return fmt.Errorf("failed to insert refresh token: %w", err)
+	}
+	return nil
+}
+
+// insertRefreshToken stores t as a fresh token. s.mu must be held.
+func (s *MemoryStore) insertRefreshToken(t postgres.RefreshToken) error {
+	if _, ok := s.refreshTokens[t.ID]; ok {
+		return errDuplicateKey
+	}
+	if _, ok := s.refreshTokenIDs[t.TokenHash]; ok {
+		return errDuplicateKey
+	}
+
+	s.refreshTokens[t.ID] = &postgres.RefreshToken{
+		ID:        t.ID,
+		UserID:    t.UserID,
+		FamilyID:  t.FamilyID,
+		TokenHash: t.TokenHash,
+		ExpiresAt: t.ExpiresAt,
+		CreatedAt: time.Now(),
+	}
+	s.refreshTokenIDs[t.TokenHash] = t.ID
+	return nil
+}
+
+func (s *MemoryStore) GetRefreshToken(_ context.Context, tokenHash string) (*postgres.RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.refreshTokens[s.refreshTokenIDs[tokenHash]]
+	if !ok {
+		return nil, postgres.ErrInvalidRefreshToken
+	}
+	c := *t
+	return &c, nil
+}
+
+func (s *MemoryStore) RotateRefreshToken(_ context.Context, oldID string, next postgres.RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.refreshTokens[oldID]
+	if !ok || old.RotatedAt != nil || old.RevokedAt != nil {
+		return postgres.ErrRefreshTokenReused
+	}
+	if err := s.insertRefreshToken(next); err != nil {
+		return fmt.Errorf("failed to insert rotated refresh token: %w", err)
+	}
+	now := time.Now()
+	old.RotatedAt = &now
+	return nil
+}
+
+func (s *MemoryStore) RevokeRefreshTokenFamily(_ context.Context, familyID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, t := range s.refreshTokens {
+		if t.FamilyID == familyID && t.RevokedAt == nil {
+			t.RevokedAt = &now
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) RevokeUserRefreshTokens(_ context.Context, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.revokeUserRefreshTokens(userID, time.Now())
+	return nil
+}
+
+// revokeUserRefreshTokens revokes every live refresh token of the user. s.mu
+// must be held.
+func (s *MemoryStore) revokeUserRefreshTokens(userID string, now time.Time) {
+	for _, t := range s.refreshTokens {
+		if t.UserID == userID && t.RevokedAt == nil {
+			t.RevokedAt = &now
+		}
+	}
+}
+
+func (s *MemoryStore) Revoke(_ context.Context, jti, userID string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.revokedTokens[jti]; !ok {
+		s.revokedTokens[jti] = expiresAt
+	}
+	return nil
+}
+
+func (s *MemoryStore) RevokeSessions(_ context.Context, userID string, revokedBefore time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.revokeSessions(userID, revokedBefore)
+	return nil
+}
+
+// revokeSessions moves the session cutoff of the user forward to
+// revokedBefore. s.mu must be held.
+func (s *MemoryStore) revokeSessions(userID string, revokedBefore time.Time) {
+	if revokedBefore.After(s.sessionCutoffs[userID]) {
+		s.sessionCutoffs[userID] = revokedBefore
+	}
+}
+
+func (s *MemoryStore) IsRevoked(_ context.Context, jti, userID string, issuedAt time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if expiresAt, ok := s.revokedTokens[jti]; ok && time.Now().Before(expiresAt) {
+		return true, nil
+	}
+	cutoff, ok := s.sessionCutoffs[userID]
+	return ok && issuedAt.Before(cutoff), nil
+}
+
+func (s *MemoryStore) InsertEmailVerificationToken(_ context.Context, t postgres.EmailVerificationToken, events ...postgres.OutboxEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.verificationTokens[t.TokenHash]; ok {
+		return fmt.Errorf("failed to insert email verification token: %w", errDuplicateKey)
+	}
+	now := time.Now()
+	s.verificationTokens[t.TokenHash] = &postgres.EmailVerificationToken{
+		TokenHash: t.TokenHash,
+		UserID:    t.UserID,
+		ExpiresAt: t.ExpiresAt,
+		CreatedAt: now,
+	}
+	s.appendOutboxEvents(events, now)
+	return nil
+}
+
+func (s *MemoryStore) GetLastEmailVerificationSentAt(_ context.Context, userID string) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var sentAt time.Time
+	for _, t := range s.verificationTokens {
+		if t.UserID == userID && t.CreatedAt.After(sentAt) {
+			sentAt = t.CreatedAt
+		}
+	}
+	return sentAt, nil
+}
+
+func (s *MemoryStore) VerifyEmail(_ context.Context, tokenHash string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	t, ok := s.verificationTokens[tokenHash]
+	if !ok || t.UsedAt != nil || !t.ExpiresAt.After(now) {
+		return "", postgres.ErrInvalidVerificationToken
+	}
+
+	for _, other := range s.verificationTokens {
+		if other.UserID == t.UserID && other.UsedAt == nil {
+			other.UsedAt = &now
+		}
+	}
+	if u, ok := s.users[t.UserID]; ok {
+		u.EmailVerified = true
+		u.EmailVerifiedAt = &now
+		u.UpdatedAt = now
+	}
+	return t.UserID, nil
+}
+
+func (s *MemoryStore) InsertPasswordResetToken(_ context.Context, t postgres.PasswordResetToken, events ...postgres.OutboxEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.passwordResetTokens[t.TokenHash]; ok {
+		return fmt.Errorf("failed to insert password reset token: %w", errDuplicateKey)
+	}
+	now := time.Now()
+	s.passwordResetTokens[t.TokenHash] = &postgres.PasswordResetToken{
+		TokenHash: t.TokenHash,
+		UserID:    t.UserID,
+		ExpiresAt: t.ExpiresAt,
+		CreatedAt: now,
+	}
+	s.appendOutboxEvents(events, now)
+	return nil
+}
+
+func (s *MemoryStore) GetPasswordResetToken(_ context.Context, tokenHash string) (*postgres.PasswordResetToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.passwordResetTokens[tokenHash]
+	if !ok {
+		return nil, postgres.ErrInvalidResetToken
+	}
+	c := *t
+	return &c, nil
+}
+
+func (s *MemoryStore) ResetPassword(_ context.Context, tokenHash, hashedPassword string, revokedBefore time.Time) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	t, ok := s.passwordResetTokens[tokenHash]
+	if !ok || t.UsedAt != nil || !t.ExpiresAt.After(now) {
+		return "", postgres.ErrInvalidResetToken
+	}
+
+	for _, other := range s.passwordResetTokens {
+		if other.UserID == t.UserID && other.UsedAt == nil {
+			other.UsedAt = &now
+		}
+	}
+	if u, ok := s.users[t.UserID]; ok {
+		u.HashedPassword = hashedPassword
+		u.PasswordBreachedAt = nil
+		u.UpdatedAt = now
+	}
+	s.revokeUserRefreshTokens(t.UserID, now)
+	s.revokeSessions(t.UserID, revokedBefore)
+	return t.UserID, nil
+}
+
+func (s *MemoryStore) UpsertPendingTOTP(_ context.Context, userID string, secret []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if c, ok := s.totps[userID]; ok && c.ConfirmedAt != nil {
+		return postgres.ErrTOTPAlreadyEnabled
+	}
+	s.totps[userID] = &postgres.TOTPCredential{
+		UserID:    userID,
+		Secret:    slices.Clone(secret),
+		CreatedAt: time.Now(),
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetTOTP(_ context.Context, userID string) (*postgres.TOTPCredential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.totps[userID]
+	if !ok {
+		return nil, postgres.ErrTOTPNotFound
+	}
+	cp := *c
+	cp.Secret = slices.Clone(c.Secret)
+	return &cp, nil
+}
+
+func (s *MemoryStore) ConfirmTOTP(_ context.Context, userID string, step int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.totps[userID]
+	if !ok || c.ConfirmedAt != nil {
+		return postgres.ErrTOTPNotFound
+	}
+	now := time.Now()
+	c.ConfirmedAt = &now
+	c.LastUsedStep = step
+	return nil
+}
+
+func (s *MemoryStore) UseTOTPStep(_ context.Context, userID string, step int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.totps[userID]
+	if !ok || c.ConfirmedAt == nil || c.LastUsedStep >= step {
+		return postgres.ErrTOTPCodeReused
+	}
+	c.LastUsedStep = step
+	return nil
+}
+
+func (s *MemoryStore) DeleteTOTP(_ context.Context, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.totps, userID)
+	return nil
+}
+
+func (s *MemoryStore) InsertMFAChallenge(_ context.Context, c postgres.MFAChallenge) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.mfaChallenges[c.TokenHash]; ok {
+		return fmt.Errorf("failed to insert mfa challenge: %w", errDuplicateKey)
+	}
+	s.mfaChallenges[c.TokenHash] = &postgres.MFAChallenge{
+		TokenHash: c.TokenHash,
+		UserID:    c.UserID,
+		Nonce:     c.Nonce,
+		ExpiresAt: c.ExpiresAt,
+		CreatedAt: time.Now(),
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetMFAChallenge(_ context.Context, tokenHash string) (*postgres.MFAChallenge, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.mfaChallenges[tokenHash]
+	if !ok {
+		return nil, postgres.ErrInvalidMFAChallenge
+	}
+	cp := *c
+	return &cp, nil
+}
+
+func (s *MemoryStore) ClaimMFAChallengeAttempt(_ context.Context, tokenHash string, maxAttempts int) (*postgres.MFAChallenge, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.mfaChallenges[tokenHash]
+	if !ok || c.ConsumedAt != nil || !c.ExpiresAt.After(time.Now()) || c.Attempts >= maxAttempts {
+		return nil, postgres.ErrInvalidMFAChallenge
+	}
+	c.Attempts++
+	cp := *c
+	return &cp, nil
+}
+
+func (s *MemoryStore) ConsumeMFAChallenge(_ context.Context, tokenHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	c, ok := s.mfaChallenges[tokenHash]
+	if !ok || c.ConsumedAt != nil || !c.ExpiresAt.After(now) {
+		return postgres.ErrInvalidMFAChallenge
+	}
+	c.ConsumedAt = &now
+	return nil
+}
+
+func (s *MemoryStore) ReplaceRecoveryCodes(_ context.Context, userID string, codeHashes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	codes := make(map[string]*time.Time, len(codeHashes))
+	for _, codeHash := range codeHashes {
+		if _, ok := codes[codeHash]; ok {
+			return fmt.Errorf("failed to insert recovery code: %w", errDuplicateKey)
+		}
+		codes[codeHash] = nil
+	}
+	s.recoveryCodes[userID] = codes
+	return nil
+}
+
+func (s *MemoryStore) CountUnusedRecoveryCodes(_ context.Context, userID string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+	for _, usedAt := range s.recoveryCodes[userID] {
+		if usedAt == nil {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *MemoryStore) UseRecoveryCode(_ context.Context, userID, codeHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	codes := s.recoveryCodes[userID]
+	usedAt, ok := codes[codeHash]
+	if !ok || usedAt != nil {
+		return postgres.ErrInvalidRecoveryCode
+	}
+	now := time.Now()
+	codes[codeHash] = &now
+	return nil
+}
+
+func (s *MemoryStore) DeleteRecoveryCodes(_ context.Context, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.recoveryCodes, userID)
+	return nil
+}
+
+func (s *MemoryStore) InsertWebAuthnCredential(_ context.Context, c postgres.WebAuthnCredential) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.webAuthnCredentialOf[c.ID]; ok {
+		return postgres.ErrWebAuthnCredentialExists
+	}
+	s.webAuthnCredentials[c.UserID] = append(s.webAuthnCredentials[c.UserID], &postgres.WebAuthnCredential{
+		ID:        c.ID,
+		UserID:    c.UserID,
+		Name:      c.Name,
+		PublicKey: slices.Clone(c.PublicKey),
+		SignCount: c.SignCount,
+		CreatedAt: time.Now(),
+	})
+	s.webAuthnCredentialOf[c.ID] = c.UserID
+	return nil
+}
+
+// webAuthnCredential returns the stored credential with the given ID, or nil.
+// s.mu must be held.
+func (s *MemoryStore) webAuthnCredential(id string) *postgres.WebAuthnCredential {
+	for _, c := range s.webAuthnCredentials[s.webAuthnCredentialOf[id]] {
+		if c.ID == id {
+			return c
+		}
+	}
+	return nil
+}
+
+func copyWebAuthnCredential(c *postgres.WebAuthnCredential) postgres.WebAuthnCredential {
+	cp := *c
+	cp.PublicKey = slices.Clone(c.PublicKey)
+	return cp
+}
+
+func (s *MemoryStore) GetWebAuthnCredential(_ context.Context, id string) (*postgres.WebAuthnCredential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.webAuthnCredential(id)
+	if c == nil {
+		return nil, postgres.ErrWebAuthnCredentialNotFound
+	}
+	cp := copyWebAuthnCredential(c)
+	return &cp, nil
+}
+
+func (s *MemoryStore) GetWebAuthnCredentials(_ context.Context, userID string) ([]postgres.WebAuthnCredential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var credentials []postgres.WebAuthnCredential
+	for _, c := range s.webAuthnCredentials[userID] {
+		credentials = append(credentials, copyWebAuthnCredential(c))
+	}
+	return credentials, nil
+}
+
+func (s *MemoryStore) UpdateWebAuthnSignCount(_ context.Context, id string, signCount int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.webAuthnCredential(id)
+	if c == nil || !(c.SignCount < signCount || c.SignCount == 0 && signCount == 0) {
+		return postgres.ErrWebAuthnSignCount
+	}
+	now := time.Now()
+	c.SignCount = signCount
+	c.LastUsedAt = &now
+	return nil
+}
+
+func (s *MemoryStore) DeleteWebAuthnCredential(_ context.Context, userID, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	credentials := s.webAuthnCredentials[userID]
+	i := slices.IndexFunc(credentials, func(c *postgres.WebAuthnCredential) bool { return c.ID == id })
+	if i < 0 {
+		return postgres.ErrWebAuthnCredentialNotFound
+	}
+	s.webAuthnCredentials[userID] = slices.Delete(credentials, i, i+1)
+	delete(s.webAuthnCredentialOf, id)
+	return nil
+}
+
+func (s *MemoryStore) InsertWebAuthnChallenge(_ context.Context, c postgres.WebAuthnChallenge) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.webAuthnChallenges[c.ChallengeHash]; ok {
+		return fmt.Errorf("failed to insert webauthn challenge: %w", errDuplicateKey)
+	}
+	s.webAuthnChallenges[c.ChallengeHash] = &postgres.WebAuthnChallenge{
+		ChallengeHash: c.ChallengeHash,
+		UserID:        c.UserID,
+		Ceremony:      c.Ceremony,
+		Nonce:         c.Nonce,
+		ExpiresAt:     c.ExpiresAt,
+		CreatedAt:     time.Now(),
+	}
+	return nil
+}
+
+func (s *MemoryStore) ConsumeWebAuthnChallenge(_ context.Context, challengeHash, ceremony string) (*postgres.WebAuthnChallenge, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.webAuthnChallenges[challengeHash]
+	if !ok || c.Ceremony != ceremony || !c.ExpiresAt.After(time.Now()) {
+		return nil, postgres.ErrInvalidWebAuthnChallenge
+	}
+	delete(s.webAuthnChallenges, challengeHash)
+	return c, nil
+}
+
+func (s *MemoryStore) RedeemMagicLink(_ context.Context, jti, userID string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.magicLinks[jti]; ok {
+		return postgres.ErrMagicLinkUsed
+	}
+	s.magicLinks[jti] = expiresAt
+	return nil
+}
+
+func (s *MemoryStore) UpsertEmailOTP(_ context.Context, c postgres.EmailOTP, cooldown time.Duration, events ...postgres.OutboxEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if current, ok := s.emailOTPs[c.UserID]; ok && current.CreatedAt.After(now.Add(-cooldown)) {
+		return postgres.ErrEmailOTPCooldown
+	}
+	s.emailOTPs[c.UserID] = &postgres.EmailOTP{
+		UserID:    c.UserID,
+		CodeHash:  c.CodeHash,
+		ExpiresAt: c.ExpiresAt,
+		CreatedAt: now,
+	}
+	s.appendOutboxEvents(events, now)
+	return nil
+}
+
+func (s *MemoryStore) ClaimEmailOTPAttempt(_ context.Context, userID string, maxAttempts int) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.emailOTPs[userID]
+	if !ok || !c.ExpiresAt.After(time.Now()) || c.Attempts >= maxAttempts {
+		return "", postgres.ErrInvalidEmailOTP
+	}
+	c.Attempts++
+	return c.CodeHash, nil
+}
+
+func (s *MemoryStore) ConsumeEmailOTP(_ context.Context, userID, codeHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.emailOTPs[userID]
+	if !ok || c.CodeHash != codeHash {
+		return postgres.ErrInvalidEmailOTP
+	}
+	delete(s.emailOTPs, userID)
+	return nil
+}
+
+func (s *MemoryStore) RecordFailedLogin(_ context.Context, userID string, record func(l *postgres.AccountLockout, now time.Time) *time.Time) (*time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l, ok := s.lockouts[userID]
+	if !ok {
+		l = &postgres.AccountLockout{UserID: userID}
+		s.lockouts[userID] = l
+	}
+	now := time.Now()
+	lockedUntil := record(l, now)
+	l.UpdatedAt = now
+	return lockedUntil, nil
+}
+
+func (s *MemoryStore) ResetFailedLogins(_ context.Context, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.lockouts, userID)
+	return nil
+}
+
+func (s *MemoryStore) InsertOutboxEvents(_ context.Context, events ...postgres.OutboxEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.appendOutboxEvents(events, time.Now())
+	return nil
+}
+
+func (s *MemoryStore) RelayOutboxEvents(_ context.Context, limit, maxAttempts int, publish func(postgres.OutboxEvent) error) (int, error) {
+	s.relayMu.Lock()
+	defer s.relayMu.Unlock()
+
+	s.mu.Lock()
+	// sent events are only kept until the next relay, there is nothing to
+	// inspect them with
+	s.outbox = slices.DeleteFunc(s.outbox, func(e *postgres.OutboxEvent) bool { return e.SentAt != nil })
+	var events []postgres.OutboxEvent
+	for _, e := range s.outbox {
+		if len(events) == limit {
+			break
+		}
+		if e.SentAt == nil && e.DeadAt == nil {
+			cp := *e
+			cp.Payload = slices.Clone(e.Payload)
+			events = append(events, cp)
+		}
+	}
+	s.mu.Unlock()
+
+	sent := 0
+	for _, e := range events {
+		err := publish(e)
+
+		s.mu.Lock()
+		stored := s.outbox[slices.IndexFunc(s.outbox, func(o *postgres.OutboxEvent) bool { return o.ID == e.ID })]
+		stored.Attempts++
+		now := time.Now()
+		if err != nil {
+			stored.LastError = err.Error()
+			if stored.Attempts >= maxAttempts {
+				stored.DeadAt = &now
+			}
+		} else {
+			stored.SentAt = &now
+			stored.Payload = nil
+			stored.LastError = ""
+		}
+		dead := stored.DeadAt != nil
+		s.mu.Unlock()
+
+		if err != nil {
+			if dead {
+				continue
+			}
+			return sent, fmt.Errorf("failed to publish outbox event %d: %w", e.ID, err)
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+func (s *MemoryStore) GetLockedUntil(_ context.Context, userID string) (*time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if l, ok := s.lockouts[userID]; ok {
+		return l.LockedUntil, nil
+	}
+	return nil, nil
+}
+
+func (s *MemoryStore) InsertAuthEvent(_ context.Context, e postgres.AuthEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e.ID = int64(len(s.authEvents)) + 1
+	e.CreatedAt = time.Now()
+	s.authEvents = append(s.authEvents, e)
+	return nil
+}
+
+func (s *MemoryStore) GetAuthEvents(_ context.Context, f postgres.AuthEventFilter) ([]postgres.AuthEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var events []postgres.AuthEvent
+	for i := len(s.authEvents) - 1; i >= 0 && len(events) < f.Limit; i-- {
+		e := s.authEvents[i]
+		switch {
+		case f.Type != "" && e.Type != f.Type,
+			f.UserID != "" && e.UserID != f.UserID,
+			f.Email != "" && e.Email != f.Email,
+			f.Outcome != "" && e.Outcome != f.Outcome,
+			f.ClientIP != "" && e.ClientIP != f.ClientIP,
+			!f.Since.IsZero() && e.CreatedAt.Before(f.Since),
+			!f.Until.IsZero() && !e.CreatedAt.Before(f.Until),
+			f.Before > 0 && e.ID >= f.Before:
+			continue
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
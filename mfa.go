@@ -0,0 +1,450 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/Developer-s-Foundry/df-2.0-aima-auth-service/database/postgres"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	mfaChallengeTTL = 5 * time.Minute
+	maxMFAAttempts  = 5
+)
+
+const MFAMethodTOTP = "totp"
+
+// mfaMethods lists the second factors the user has enabled. An empty list
+// means login completes after the password check.
+func (h *AuthHandler) mfaMethods(ctx context.Context, userID string) ([]string, error) {
+	var methods []string
+
+	totp, err := h.DB.GetTOTP(ctx, userID)
+	if err != nil && !errors.Is(err, postgres.ErrTOTPNotFound) {
+		return nil, err
+	}
+	if totp != nil && totp.ConfirmedAt != nil {
+		methods = append(methods, MFAMethodTOTP)
+	}
+
+	passkeys, err := h.DB.GetWebAuthnCredentials(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(passkeys) > 0 {
+		methods = append(methods, MFAMethodWebAuthn)
+	}
+
+	// recovery codes only stand in for another factor, never on their own
+	if len(methods) > 0 {
+		remaining, err := h.DB.CountUnusedRecoveryCodes(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+		if remaining > 0 {
+			methods = append(methods, MFAMethodRecoveryCode)
+		}
+	}
+
+	return methods, nil
+}
+
+// startMFAChallenge answers the login with an MFA challenge instead of a
+// session when user has a second factor enabled. It reports whether it did
+// so; nothing is written to w when it returns false or an error.
+func (h *AuthHandler) startMFAChallenge(w http.ResponseWriter, r *http.Request, user *postgres.User, nonce string) (bool, error) {
+	methods, err := h.mfaMethods(r.Context(), user.UserID)
+	if err != nil || len(methods) == 0 {
+		return false, err
+	}
+
+	token, err := generateOpaqueToken()
+	if err != nil {
+		return false, err
+	}
+
+	err = h.DB.InsertMFAChallenge(r.Context(), postgres.MFAChallenge{
+		TokenHash: hashToken(token),
+		UserID:    user.UserID,
+		Nonce:     nonce,
+		ExpiresAt: time.Now().Add(mfaChallengeTTL),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	var webAuthn *webAuthnRequestOptions
+	if slices.Contains(methods, MFAMethodWebAuthn) {
+		webAuthn, err = h.webAuthnRequestOptions(r.Context(), user.UserID, postgres.WebAuthnCeremonyMFA, "", "discouraged")
+		if err != nil {
+			return false, err
+		}
+	}
+
+	response := struct {
+		MFARequired bool                    `json:"mfa_required"`
+		MFAToken    string                  `json:"mfa_token"`
+		Methods     []string                `json:"methods"`
+		WebAuthn    *webAuthnRequestOptions `json:"webauthn,omitempty"`
+		ExpiresIn   int                     `json:"expires_in"`
+		StatusCode  int                     `json:"status_code"`
+		Message     string                  `json:"message"`
+	}{
+		MFARequired: true,
+		MFAToken:    token,
+		Methods:     methods,
+		WebAuthn:    webAuthn,
+		ExpiresIn:   int(mfaChallengeTTL.Seconds()),
+		StatusCode:  http.StatusOK,
+		Message:     "Second factor required to complete login",
+	}
+	writeToJson(w, response, http.StatusOK)
+	return true, nil
+}
+
+// CompleteMFALogin exchanges the challenge handed out by Login and a second
+// factor (a TOTP code, a passkey assertion or a recovery code) for the same
+// session Login returns. A challenge is single-use and is burned after
+// maxMFAAttempts wrong codes.
+func (h *AuthHandler) CompleteMFALogin(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var body struct {
+		MFAToken     string                  `json:"mfa_token"`
+		Code         string                  `json:"code"`
+		WebAuthn     *webAuthnCredentialJSON `json:"webauthn"`
+		RecoveryCode string                  `json:"recovery_code"`
+	}
+
+	if err := readFromJson(r, &body); err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body.MFAToken == "" || (body.Code == "" && body.WebAuthn == nil && body.RecoveryCode == "") {
+		writeErrorResponse(w, "mfa_token and one of code, webauthn or recovery_code are required", http.StatusBadRequest)
+		return
+	}
+
+	challengeHash := hashToken(body.MFAToken)
+	challenge, err := h.DB.ClaimMFAChallengeAttempt(r.Context(), challengeHash, maxMFAAttempts)
+	if err != nil {
+		if errors.Is(err, postgres.ErrInvalidMFAChallenge) {
+			h.recordAuthEvent(r, authEventLoginMFA, &postgres.User{}, authOutcomeFailure, authReasonInvalidToken)
+			writeErrorResponse(w, "mfa challenge is invalid or has expired", http.StatusUnauthorized)
+			return
+		}
+		log.Printf("unable to claim mfa attempt: %v", err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	user, err := h.DB.GetUserByID(r.Context(), challenge.UserID)
+	if err != nil {
+		log.Printf("unable to get user %s from db: %v", challenge.UserID, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	lockedUntil, err := h.accountLockedUntil(r.Context(), user.UserID)
+	if err != nil {
+		log.Printf("unable to check lockout of user %s: %v", user.UserID, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if lockedUntil != nil {
+		h.recordAuthEvent(r, authEventLoginMFA, user, authOutcomeFailure, authReasonAccountLocked)
+		writeAccountLocked(w, *lockedUntil)
+		return
+	}
+
+	var ok bool
+	switch {
+	case body.WebAuthn != nil:
+		ok, err = h.verifyWebAuthnLogin(r.Context(), user.UserID, body.WebAuthn)
+	case body.RecoveryCode != "":
+		ok, err = h.useRecoveryCode(r.Context(), user, body.RecoveryCode)
+	default:
+		ok, err = h.verifyTOTPLogin(r.Context(), user.UserID, body.Code)
+	}
+	if err != nil {
+		log.Printf("unable to verify second factor for user %s: %v", user.UserID, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		h.recordAuthEvent(r, authEventLoginMFA, user, authOutcomeFailure, authReasonInvalidCredentials)
+		if lockedUntil := h.recordFailedLogin(r.Context(), user); lockedUntil != nil {
+			writeAccountLocked(w, *lockedUntil)
+			return
+		}
+		writeErrorResponse(w, "invalid verification code", http.StatusUnauthorized)
+		return
+	}
+
+	if err := h.DB.ConsumeMFAChallenge(r.Context(), challengeHash); err != nil {
+		if errors.Is(err, postgres.ErrInvalidMFAChallenge) {
+			h.recordAuthEvent(r, authEventLoginMFA, user, authOutcomeFailure, authReasonInvalidToken)
+			writeErrorResponse(w, "mfa challenge is invalid or has expired", http.StatusUnauthorized)
+			return
+		}
+		log.Printf("unable to consume mfa challenge: %v", err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	h.writeLoginResponse(w, r, user, authEventLoginMFA, challenge.Nonce)
+}
+
+// verifyTOTPLogin checks code against the user's confirmed authenticator and
+// burns its time step so the same code cannot be replayed.
+func (h *AuthHandler) verifyTOTPLogin(ctx context.Context, userID, code string) (bool, error) {
+	credential, err := h.DB.GetTOTP(ctx, userID)
+	if err != nil {
+		if errors.Is(err, postgres.ErrTOTPNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	if credential.ConfirmedAt == nil {
+		return false, nil
+	}
+
+	secret, err := openSecret(credential.Secret, totpAssociatedData(userID))
+	if err != nil {
+		return false, err
+	}
+
+	step, ok := verifyTOTP(secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+
+	if err := h.DB.UseTOTPStep(ctx, userID, step); err != nil {
+		if errors.Is(err, postgres.ErrTOTPCodeReused) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// verifyWebAuthnLogin checks a passkey assertion made for the challenge that
+// startMFAChallenge handed out to userID.
+func (h *AuthHandler) verifyWebAuthnLogin(ctx context.Context, userID string, c *webAuthnCredentialJSON) (bool, error) {
+	credential, _, err := h.verifyWebAuthnAssertion(ctx, c, postgres.WebAuthnCeremonyMFA, false)
+	if err != nil {
+		if errors.Is(err, errInvalidWebAuthnResponse) {
+			log.Printf("rejected passkey for user %s: %v", userID, err)
+			return false, nil
+		}
+		return false, err
+	}
+	return credential.UserID == userID, nil
+}
+
+func totpAssociatedData(userID string) []byte {
+	return []byte("totp:" + userID)
+}
+
+// EnrollTOTP generates a new authenticator secret for the logged in user. It
+// stays inactive until ConfirmTOTP receives a valid code from it.
+func (h *AuthHandler) EnrollTOTP(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	claims := claimsFromContext(r.Context())
+
+	user, err := h.DB.GetUserByID(r.Context(), claims.UserID)
+	if err != nil {
+		log.Printf("unable to get user %s from db: %v", claims.UserID, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		log.Printf("error generating totp secret %v", err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	sealed, err := sealSecret(secret, totpAssociatedData(user.UserID))
+	if err != nil {
+		log.Printf("error encrypting totp secret %v", err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.DB.UpsertPendingTOTP(r.Context(), user.UserID, sealed); err != nil {
+		if errors.Is(err, postgres.ErrTOTPAlreadyEnabled) {
+			writeErrorResponse(w, "two-factor authentication is already enabled", http.StatusConflict)
+			return
+		}
+		log.Printf("unable to store totp secret for user %s: %v", user.UserID, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	uri := totpURI(secret, user.Email)
+	response := struct {
+		Secret     string `json:"secret"`
+		OTPAuthURI string `json:"otpauth_uri"`
+		QRPayload  string `json:"qr_payload"`
+		StatusCode int    `json:"status_code"`
+		Message    string `json:"message"`
+	}{
+		Secret:     totpEncoding.EncodeToString(secret),
+		OTPAuthURI: uri,
+		QRPayload:  uri,
+		StatusCode: http.StatusOK,
+		Message:    "Scan the QR code and confirm with a code from your authenticator app",
+	}
+	writeToJson(w, response, http.StatusOK)
+}
+
+func (h *AuthHandler) ConfirmTOTP(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	claims := claimsFromContext(r.Context())
+
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := readFromJson(r, &body); err != nil || body.Code == "" {
+		writeErrorResponse(w, "code is required", http.StatusBadRequest)
+		return
+	}
+
+	credential, err := h.DB.GetTOTP(r.Context(), claims.UserID)
+	if err != nil {
+		if errors.Is(err, postgres.ErrTOTPNotFound) {
+			writeErrorResponse(w, "two-factor authentication enrollment has not been started", http.StatusBadRequest)
+			return
+		}
+		log.Printf("unable to get totp for user %s: %v", claims.UserID, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if credential.ConfirmedAt != nil {
+		writeErrorResponse(w, "two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	secret, err := openSecret(credential.Secret, totpAssociatedData(claims.UserID))
+	if err != nil {
+		log.Printf("unable to decrypt totp secret for user %s: %v", claims.UserID, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	step, ok := verifyTOTP(secret, body.Code, time.Now())
+	if !ok {
+		writeErrorResponse(w, "invalid verification code", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.DB.ConfirmTOTP(r.Context(), claims.UserID, step); err != nil {
+		if errors.Is(err, postgres.ErrTOTPNotFound) {
+			writeErrorResponse(w, "two-factor authentication is already enabled", http.StatusConflict)
+			return
+		}
+		log.Printf("unable to confirm totp for user %s: %v", claims.UserID, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	codes, err := h.issueRecoveryCodes(r.Context(), claims.UserID)
+	if err != nil {
+		log.Printf("unable to issue recovery codes for user %s: %v", claims.UserID, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+		Message       string   `json:"message"`
+		StatusCode    int      `json:"status_code"`
+	}{
+		RecoveryCodes: codes,
+		Message:       "Two-factor authentication enabled, store the recovery codes somewhere safe",
+		StatusCode:    http.StatusOK,
+	}
+	writeToJson(w, response, http.StatusOK)
+}
+
+// DisableTOTP removes the authenticator after checking both the password and
+// a current code.
+func (h *AuthHandler) DisableTOTP(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	claims := claimsFromContext(r.Context())
+
+	var body struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	if err := readFromJson(r, &body); err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body.Password == "" || body.Code == "" {
+		writeErrorResponse(w, "password and code are required", http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.DB.GetUserByID(r.Context(), claims.UserID)
+	if err != nil {
+		log.Printf("unable to get user %s from db: %v", claims.UserID, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// wrong passwords and codes count towards the same lockout as the login
+	lockedUntil, err := h.accountLockedUntil(r.Context(), user.UserID)
+	if err != nil {
+		log.Printf("unable to check lockout of user %s: %v", user.UserID, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if lockedUntil != nil {
+		writeAccountLocked(w, *lockedUntil)
+		return
+	}
+
+	if match, _ := checkPasswordHash(body.Password, user.HashedPassword); !match {
+		if lockedUntil := h.recordFailedLogin(r.Context(), user); lockedUntil != nil {
+			writeAccountLocked(w, *lockedUntil)
+			return
+		}
+		writeErrorResponse(w, "invalid login credentials", http.StatusUnauthorized)
+		return
+	}
+
+	ok, err := h.verifyTOTPLogin(r.Context(), user.UserID, body.Code)
+	if err != nil {
+		log.Printf("unable to verify totp for user %s: %v", user.UserID, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		if lockedUntil := h.recordFailedLogin(r.Context(), user); lockedUntil != nil {
+			writeAccountLocked(w, *lockedUntil)
+			return
+		}
+		writeErrorResponse(w, "invalid verification code", http.StatusUnauthorized)
+		return
+	}
+
+	if err := h.DB.DeleteTOTP(r.Context(), user.UserID); err != nil {
+		log.Printf("unable to delete totp for user %s: %v", user.UserID, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	h.deleteOrphanedRecoveryCodes(r.Context(), user.UserID)
+
+	response := struct {
+		Message    string `json:"message"`
+		StatusCode int    `json:"status_code"`
+	}{
+		Message:    "Two-factor authentication disabled",
+		StatusCode: http.StatusOK,
+	}
+	writeToJson(w, response, http.StatusOK)
+}
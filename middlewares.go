@@ -1,13 +1,17 @@
 package main
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
@@ -54,3 +58,68 @@ func VerifyGatewayRequest(next httprouter.Handle) httprouter.Handle {
 		next(w, r, ps)
 	}
 }
+
+// RequireAdmin only lets requests through that carry ADMIN_API_KEY in the
+// X-Admin-Key header. The admin API is disabled while the key is not set.
+func RequireAdmin(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		adminKey := os.Getenv("ADMIN_API_KEY")
+		if adminKey == "" {
+			writeJSONError(w, http.StatusForbidden, "admin api is disabled")
+			return
+		}
+
+		if !hmac.Equal([]byte(r.Header.Get("X-Admin-Key")), []byte(adminKey)) {
+			writeJSONError(w, http.StatusUnauthorized, "invalid admin key")
+			return
+		}
+
+		next(w, r, ps)
+	}
+}
+
+type contextKey string
+
+const claimsContextKey contextKey = "claims"
+
+// RequireAuth only lets requests through that carry a valid, unrevoked bearer
+// token. The verified claims are available to next via claimsFromContext.
+func (h *AuthHandler) RequireAuth(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		tokenString, ok := bearerToken(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer`)
+			writeJSONError(w, http.StatusUnauthorized, "missing bearer token")
+			return
+		}
+
+		claims, err := h.verifyAccessToken(r.Context(), tokenString)
+		if errors.Is(err, errRevocationCheck) {
+			log.Printf("unable to verify bearer token: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "internal server error")
+			return
+		}
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeJSONError(w, http.StatusUnauthorized, "invalid or expired token")
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), claimsContextKey, claims)
+		next(w, r.WithContext(ctx), ps)
+	}
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	scheme, token, found := strings.Cut(header, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+func claimsFromContext(ctx context.Context) *CustomClaims {
+	claims, _ := ctx.Value(claimsContextKey).(*CustomClaims)
+	return claims
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Developer-s-Foundry/df-2.0-aima-auth-service/database/postgres"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/julienschmidt/httprouter"
+)
+
+const idTokenTTL = time.Hour
+
+// IDTokenClaims are the OpenID Connect ID token claims. ID tokens describe the
+// authenticated user to the client and are never accepted as session tokens.
+type IDTokenClaims struct {
+	Email         string           `json:"email"`
+	EmailVerified bool             `json:"email_verified"`
+	Nonce         string           `json:"nonce,omitempty"`
+	AuthTime      *jwt.NumericDate `json:"auth_time,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// generateIDToken issues an ID token for user. nonce is echoed back from the
+// client's request and authTime is left out when the token is minted without
+// a fresh authentication, e.g. on refresh.
+func generateIDToken(user *postgres.User, nonce string, authTime time.Time) (string, error) {
+	now := time.Now()
+	claims := IDTokenClaims{
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		Nonce:         nonce,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    publicBaseURL(),
+			Subject:   user.UserID,
+			Audience:  oidcClientAudience(),
+			ExpiresAt: jwt.NewNumericDate(now.Add(idTokenTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+	if !authTime.IsZero() {
+		claims.AuthTime = jwt.NewNumericDate(authTime)
+	}
+
+	tokenString, err := signJWToken(claims)
+	if err != nil {
+		log.Printf("Error signing ID token: %v", err)
+		return "", errors.New("error generating ID token")
+	}
+	return tokenString, nil
+}
+
+// oidcClientAudience is the audience of ID tokens: the OIDC_CLIENT_ID list,
+// falling back to JWT_AUDIENCE.
+func oidcClientAudience() jwt.ClaimStrings {
+	var audience jwt.ClaimStrings
+	for _, aud := range strings.Split(os.Getenv("OIDC_CLIENT_ID"), ",") {
+		if aud = strings.TrimSpace(aud); aud != "" {
+			audience = append(audience, aud)
+		}
+	}
+	if len(audience) == 0 {
+		return tokenAudience()
+	}
+	return audience
+}
+
+// publicBaseURL is the URL clients reach this service on. It is the iss of
+// every token and the base of the endpoint URLs advertised in the discovery
+// document, which OIDC clients fetch from the issuer and match against it.
+func publicBaseURL() string {
+	return strings.TrimSuffix(os.Getenv("AUTH_PUBLIC_URL"), "/")
+}
+
+// checkPublicBaseURL makes sure AUTH_PUBLIC_URL can serve as an OIDC issuer:
+// an https URL without query or fragment. Plain http is only allowed for
+// local development.
+func checkPublicBaseURL() error {
+	base := publicBaseURL()
+	if base == "" {
+		return errors.New("AUTH_PUBLIC_URL is required")
+	}
+	u, err := url.Parse(base)
+	if err != nil || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("invalid AUTH_PUBLIC_URL %q", base)
+	}
+	local := u.Hostname() == "localhost" || net.ParseIP(u.Hostname()).IsLoopback()
+	if u.Scheme != "https" && !(u.Scheme == "http" && local) {
+		return fmt.Errorf("AUTH_PUBLIC_URL must be an https URL, got %q", base)
+	}
+	return nil
+}
+
+func OpenIDConfiguration(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	base := publicBaseURL()
+
+	config := map[string]interface{}{
+		"issuer":                                base,
+		"jwks_uri":                              base + "/.well-known/jwks.json",
+		"userinfo_endpoint":                     base + "/userinfo",
+		"introspection_endpoint":                base + "/introspect",
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": jwtKeys.Algorithms(),
+		"scopes_supported":                      strings.Fields(defaultTokenScope),
+		"claims_supported": []string{
+			"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "email", "email_verified",
+			"preferred_username",
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	_ = json.NewEncoder(w).Encode(config)
+}
+
+// UserInfo is the OIDC userinfo endpoint. It returns the claims about the
+// user the bearer token was issued to.
+func (h *AuthHandler) UserInfo(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	claims := claimsFromContext(r.Context())
+
+	user, err := h.DB.GetUserByID(r.Context(), claims.UserID)
+	if err != nil {
+		if errors.Is(err, postgres.ErrInvalidUser) {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeErrorResponse(w, "user no longer exists", http.StatusUnauthorized)
+			return
+		}
+		log.Printf("unable to get user %s from db: %v", claims.UserID, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		Sub               string `json:"sub"`
+		Email             string `json:"email"`
+		EmailVerified     bool   `json:"email_verified"`
+		PreferredUsername string `json:"preferred_username,omitempty"`
+	}{
+		Sub:           user.UserID,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+	}
+	if user.Username != nil {
+		response.PreferredUsername = *user.Username
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(response)
+}
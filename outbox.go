@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Developer-s-Foundry/df-2.0-aima-auth-service/database/postgres"
+)
+
+const (
+	defaultOutboxPollInterval = time.Second
+	defaultOutboxBatchSize    = 100
+	defaultOutboxMaxAttempts  = 20
+	// outboxMaxBackoff caps the wait between attempts while publishing fails.
+	outboxMaxBackoff = time.Minute
+	// outboxRetention is how long sent events are kept before cleanup drops
+	// them.
+	outboxRetention = 7 * 24 * time.Hour
+)
+
+// OutboxPublisher sends one encoded message. *rabbitmq.RabbitMQ implements
+// it; retries are left to the relay.
+type OutboxPublisher interface {
+	PublishOnce(exchange, routingKey string, body []byte) error
+}
+
+// OutboxRelay publishes the events stored in the outbox, in the order of
+// their ids. Events that fail are retried with a growing delay, and as they
+// are only marked sent once published, a restart picks up where the last run
+// stopped. An event that fails maxAttempts times is marked dead and skipped.
+// An event may go out twice if the process dies between publishing it and
+// marking it sent, so consumers must tolerate duplicates.
+type OutboxRelay struct {
+	store       OutboxStore
+	publisher   OutboxPublisher
+	interval    time.Duration
+	batchSize   int
+	maxAttempts int
+}
+
+// NewOutboxRelayFromEnv builds the relay. OUTBOX_POLL_INTERVAL sets how often
+// the outbox is checked, OUTBOX_BATCH_SIZE how many events are read at a time
+// and OUTBOX_MAX_ATTEMPTS how often an event is tried before it is marked
+// dead.
+func NewOutboxRelayFromEnv(store OutboxStore, publisher OutboxPublisher) (*OutboxRelay, error) {
+	r := &OutboxRelay{
+		store:       store,
+		publisher:   publisher,
+		interval:    defaultOutboxPollInterval,
+		batchSize:   defaultOutboxBatchSize,
+		maxAttempts: defaultOutboxMaxAttempts,
+	}
+
+	if v := os.Getenv("OUTBOX_POLL_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid OUTBOX_POLL_INTERVAL %q", v)
+		}
+		r.interval = d
+	}
+	if v := os.Getenv("OUTBOX_BATCH_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid OUTBOX_BATCH_SIZE %q", v)
+		}
+		r.batchSize = n
+	}
+	if v := os.Getenv("OUTBOX_MAX_ATTEMPTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid OUTBOX_MAX_ATTEMPTS %q", v)
+		}
+		r.maxAttempts = n
+	}
+	return r, nil
+}
+
+// newOutboxEvent encodes data as an event for the given exchange and routing
+// key, to be stored along with the change it announces. The payload is sealed
+// with the master key, as events such as the welcome mail carry tokens.
+func newOutboxEvent(exchange, routingKey string, data interface{}) (postgres.OutboxEvent, error) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return postgres.OutboxEvent{}, fmt.Errorf("failed to encode outbox event: %w", err)
+	}
+	sealed, err := sealSecret(payload, outboxAssociatedData(exchange, routingKey))
+	if err != nil {
+		return postgres.OutboxEvent{}, fmt.Errorf("failed to seal outbox event: %w", err)
+	}
+	return postgres.OutboxEvent{Exchange: exchange, RoutingKey: routingKey, Payload: sealed}, nil
+}
+
+func outboxAssociatedData(exchange, routingKey string) []byte {
+	return []byte("outbox:" + exchange + ":" + routingKey)
+}
+
+// openOutboxPayload returns the JSON body of e. Events written before
+// payloads were sealed hold plain JSON and are published as they are.
+func openOutboxPayload(e postgres.OutboxEvent) ([]byte, error) {
+	payload, err := openSecret(e.Payload, outboxAssociatedData(e.Exchange, e.RoutingKey))
+	if err != nil {
+		if json.Valid(e.Payload) {
+			return e.Payload, nil
+		}
+		return nil, err
+	}
+	return payload, nil
+}
+
+// Run relays the outbox every interval until ctx is cancelled. After a failed
+// publish it waits twice as long each time, up to outboxMaxBackoff.
+func (r *OutboxRelay) Run(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			log.Println("[Outbox] Context cancelled, stopping relay")
+			return
+		}
+
+		sent, err := r.relayPending(ctx)
+		if sent > 0 {
+			log.Printf("[Outbox] Published %d events", sent)
+		}
+
+		wait := r.interval
+		if err != nil {
+			failures++
+			for i := 1; i < failures && wait < outboxMaxBackoff; i++ {
+				wait *= 2
+			}
+			wait = min(wait, outboxMaxBackoff)
+			log.Printf("[Outbox] %v — retrying in %.1fs", err, wait.Seconds())
+		} else {
+			failures = 0
+		}
+		timer.Reset(wait)
+	}
+}
+
+// relayPending publishes batches until the outbox is drained or publishing
+// fails, and returns how many events were sent.
+func (r *OutboxRelay) relayPending(ctx context.Context) (int, error) {
+	publish := func(e postgres.OutboxEvent) error {
+		payload, err := openOutboxPayload(e)
+		if err == nil {
+			err = r.publisher.PublishOnce(e.Exchange, e.RoutingKey, payload)
+		}
+		if err != nil && e.Attempts+1 >= r.maxAttempts {
+			log.Printf("[Outbox] Giving up on event %d after %d attempts: %v", e.ID, e.Attempts+1, err)
+		}
+		return err
+	}
+
+	total := 0
+	for {
+		sent, err := r.store.RelayOutboxEvents(ctx, r.batchSize, r.maxAttempts, publish)
+		total += sent
+		if err != nil || sent < r.batchSize {
+			return total, err
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/Developer-s-Foundry/df-2.0-aima-auth-service/database/postgres"
+	"github.com/julienschmidt/httprouter"
+)
+
+const MFAMethodWebAuthn = "webauthn"
+
+// BeginPasskeyRegistration returns the options for navigator.credentials.create
+// to register a passkey for the logged in user.
+func (h *AuthHandler) BeginPasskeyRegistration(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	claims := claimsFromContext(r.Context())
+
+	user, err := h.DB.GetUserByID(r.Context(), claims.UserID)
+	if err != nil {
+		log.Printf("unable to get user %s from db: %v", claims.UserID, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	options, err := h.webAuthnCreationOptions(r.Context(), user)
+	if err != nil {
+		log.Printf("unable to start passkey registration for user %s: %v", user.UserID, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		Options    *webAuthnCreationOptions `json:"options"`
+		StatusCode int                      `json:"status_code"`
+		Message    string                   `json:"message"`
+	}{
+		Options:    options,
+		StatusCode: http.StatusOK,
+		Message:    "Create a passkey with these options",
+	}
+	writeToJson(w, response, http.StatusOK)
+}
+
+// FinishPasskeyRegistration stores the credential created from the options of
+// BeginPasskeyRegistration. Recovery codes are handed out along with the
+// user's first second factor.
+func (h *AuthHandler) FinishPasskeyRegistration(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	claims := claimsFromContext(r.Context())
+
+	var body struct {
+		Name       string                 `json:"name"`
+		Credential webAuthnCredentialJSON `json:"credential"`
+	}
+	if err := readFromJson(r, &body); err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	credential, err := h.verifyWebAuthnRegistration(r.Context(), claims.UserID, &body.Credential)
+	if err != nil {
+		if errors.Is(err, errInvalidWebAuthnResponse) {
+			writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("unable to verify passkey registration for user %s: %v", claims.UserID, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	credential.Name = body.Name
+
+	methods, err := h.mfaMethods(r.Context(), claims.UserID)
+	if err != nil {
+		log.Printf("unable to get mfa methods of user %s: %v", claims.UserID, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.DB.InsertWebAuthnCredential(r.Context(), *credential); err != nil {
+		if errors.Is(err, postgres.ErrWebAuthnCredentialExists) {
+			writeErrorResponse(w, "passkey is already registered", http.StatusConflict)
+			return
+		}
+		log.Printf("unable to store passkey for user %s: %v", claims.UserID, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	var codes []string
+	if len(methods) == 0 {
+		codes, err = h.issueRecoveryCodes(r.Context(), claims.UserID)
+		if err != nil {
+			log.Printf("unable to issue recovery codes for user %s: %v", claims.UserID, err)
+		}
+	}
+
+	response := struct {
+		ID            string   `json:"id"`
+		Name          string   `json:"name"`
+		RecoveryCodes []string `json:"recovery_codes,omitempty"`
+		StatusCode    int      `json:"status_code"`
+		Message       string   `json:"message"`
+	}{
+		ID:            credential.ID,
+		Name:          credential.Name,
+		RecoveryCodes: codes,
+		StatusCode:    http.StatusCreated,
+		Message:       "Passkey registered",
+	}
+	writeToJson(w, response, http.StatusCreated)
+}
+
+func (h *AuthHandler) ListPasskeys(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	claims := claimsFromContext(r.Context())
+
+	credentials, err := h.DB.GetWebAuthnCredentials(r.Context(), claims.UserID)
+	if err != nil {
+		log.Printf("unable to get passkeys of user %s: %v", claims.UserID, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if credentials == nil {
+		credentials = []postgres.WebAuthnCredential{}
+	}
+
+	response := struct {
+		Credentials []postgres.WebAuthnCredential `json:"credentials"`
+		StatusCode  int                           `json:"status_code"`
+	}{
+		Credentials: credentials,
+		StatusCode:  http.StatusOK,
+	}
+	writeToJson(w, response, http.StatusOK)
+}
+
+func (h *AuthHandler) DeletePasskey(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	claims := claimsFromContext(r.Context())
+
+	if err := h.DB.DeleteWebAuthnCredential(r.Context(), claims.UserID, ps.ByName("id")); err != nil {
+		if errors.Is(err, postgres.ErrWebAuthnCredentialNotFound) {
+			writeErrorResponse(w, "passkey not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("unable to delete passkey of user %s: %v", claims.UserID, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	h.deleteOrphanedRecoveryCodes(r.Context(), claims.UserID)
+
+	response := struct {
+		Message    string `json:"message"`
+		StatusCode int    `json:"status_code"`
+	}{
+		Message:    "Passkey deleted",
+		StatusCode: http.StatusOK,
+	}
+	writeToJson(w, response, http.StatusOK)
+}
+
+// BeginPasskeyLogin starts a passwordless login. The options leave
+// allowCredentials empty, so the authenticator offers the passkeys it holds
+// for this site and no account is revealed before the user picks one.
+func (h *AuthHandler) BeginPasskeyLogin(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var body struct {
+		Nonce string `json:"nonce"`
+	}
+	if err := readFromJson(r, &body); err != nil && !errors.Is(err, io.EOF) {
+		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	options, err := h.webAuthnRequestOptions(r.Context(), "", postgres.WebAuthnCeremonyLogin, body.Nonce, "required")
+	if err != nil {
+		log.Printf("unable to start passkey login: %v", err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		Options    *webAuthnRequestOptions `json:"options"`
+		StatusCode int                     `json:"status_code"`
+		Message    string                  `json:"message"`
+	}{
+		Options:    options,
+		StatusCode: http.StatusOK,
+		Message:    "Sign in with a passkey using these options",
+	}
+	writeToJson(w, response, http.StatusOK)
+}
+
+// FinishPasskeyLogin logs the user in with a passkey assertion. A passkey
+// needs user verification here, which makes it multi-factor on its own, so no
+// further MFA challenge follows.
+func (h *AuthHandler) FinishPasskeyLogin(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var body webAuthnCredentialJSON
+	if err := readFromJson(r, &body); err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	credential, challenge, err := h.verifyWebAuthnAssertion(r.Context(), &body, postgres.WebAuthnCeremonyLogin, true)
+	if err != nil {
+		if errors.Is(err, errInvalidWebAuthnResponse) {
+			log.Printf("rejected passkey login: %v", err)
+			h.recordAuthEvent(r, authEventLoginPasskey, &postgres.User{}, authOutcomeFailure, authReasonInvalidCredentials)
+			writeErrorResponse(w, "invalid login credentials", http.StatusUnauthorized)
+			return
+		}
+		log.Printf("unable to verify passkey login: %v", err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	user, err := h.DB.GetUserByID(r.Context(), credential.UserID)
+	if err != nil {
+		log.Printf("unable to get user %s from db: %v", credential.UserID, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	lockedUntil, err := h.accountLockedUntil(r.Context(), user.UserID)
+	if err != nil {
+		log.Printf("unable to check lockout of user %s: %v", user.UserID, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if lockedUntil != nil {
+		h.recordAuthEvent(r, authEventLoginPasskey, user, authOutcomeFailure, authReasonAccountLocked)
+		writeAccountLocked(w, *lockedUntil)
+		return
+	}
+
+	if !user.EmailVerified && emailVerificationPolicy() == VerificationPolicyBlock {
+		h.recordAuthEvent(r, authEventLoginPasskey, user, authOutcomeFailure, authReasonEmailUnverified)
+		writeErrorResponse(w, "email address has not been verified", http.StatusForbidden)
+		return
+	}
+
+	h.writeLoginResponse(w, r, user, authEventLoginPasskey, challenge.Nonce)
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Developer-s-Foundry/df-2.0-aima-auth-service/database/postgres"
+	"github.com/Developer-s-Foundry/df-2.0-aima-auth-service/database/rabbitmq"
+	"github.com/julienschmidt/httprouter"
+)
+
+const passwordResetTTL = time.Hour
+
+// ForgotPassword mails a single-use reset token to the account owner. It
+// answers 202 whether or not the account exists so that it cannot be used to
+// enumerate registered addresses.
+func (h *AuthHandler) ForgotPassword(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var body struct {
+		Email string `json:"email"`
+	}
+
+	if err := readFromJson(r, &body); err != nil || body.Email == "" {
+		writeErrorResponse(w, "email is required", http.StatusBadRequest)
+		return
+	}
+
+	response := struct {
+		Message    string `json:"message"`
+		StatusCode int    `json:"status_code"`
+	}{
+		Message:    "If an account exists for this email, a password reset link has been sent",
+		StatusCode: http.StatusAccepted,
+	}
+
+	user, err := h.DB.GetUser(r.Context(), lookupEmail(body.Email))
+	if err != nil {
+		if errors.Is(err, postgres.ErrInvalidUser) {
+			h.recordAuthEvent(r, authEventPasswordForgot, &postgres.User{Email: lookupEmail(body.Email)}, authOutcomeFailure, authReasonUnknownUser)
+		} else {
+			log.Printf("unable to get user from db: %v", err)
+		}
+		writeToJson(w, response, http.StatusAccepted)
+		return
+	}
+
+	token, err := generateOpaqueToken()
+	if err != nil {
+		log.Printf("error generating password reset token %v", err)
+		writeToJson(w, response, http.StatusAccepted)
+		return
+	}
+
+	userData := map[string]interface{}{
+		"data": map[string]string{
+			"type":        rabbitmq.NotifyPasswordReset,
+			"email":       user.Email,
+			"id":          user.UserID,
+			"reset_token": token,
+			"reset_url":   linkWithToken(os.Getenv("PASSWORD_RESET_URL"), token),
+			"expires_at":  time.Now().Add(passwordResetTTL).String(),
+			"timestamp":   time.Now().String(),
+		},
+		"queue_name":    rabbitmq.NotificationQueue,
+		"exchange_name": rabbitmq.NotificationExchange,
+	}
+
+	notification, err := newOutboxEvent(rabbitmq.NotificationExchange, rabbitmq.NotificationQueue, userData)
+	if err != nil {
+		log.Printf("error encoding password reset notification %v", err)
+		writeToJson(w, response, http.StatusAccepted)
+		return
+	}
+
+	// the mail is committed with the token and sent by the outbox relay, so
+	// the token never reaches the broker or the logs in the clear
+	err = h.DB.InsertPasswordResetToken(r.Context(), postgres.PasswordResetToken{
+		TokenHash: hashToken(token),
+		UserID:    user.UserID,
+		ExpiresAt: time.Now().Add(passwordResetTTL),
+	}, notification)
+	if err != nil {
+		log.Printf("unable to store password reset token for user %s: %v", user.UserID, err)
+		writeToJson(w, response, http.StatusAccepted)
+		return
+	}
+
+	h.recordAuthEvent(r, authEventPasswordForgot, user, authOutcomeSuccess, "")
+	writeToJson(w, response, http.StatusAccepted)
+}
+
+// ResetPassword sets a new password using a token from ForgotPassword. The
+// token is burned and every session of the user is invalidated: refresh
+// tokens are revoked and access tokens issued before now are rejected.
+func (h *AuthHandler) ResetPassword(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var body struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	if err := readFromJson(r, &body); err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body.Token == "" || body.Password == "" {
+		writeErrorResponse(w, "token and password are required", http.StatusBadRequest)
+		return
+	}
+
+	// the token is looked up first so the password can be checked against
+	// the account it is for; ResetPassword checks it again when burning it
+	resetToken, err := h.DB.GetPasswordResetToken(r.Context(), hashToken(body.Token))
+	if err != nil {
+		if errors.Is(err, postgres.ErrInvalidResetToken) {
+			h.recordAuthEvent(r, authEventPasswordReset, &postgres.User{}, authOutcomeFailure, authReasonInvalidToken)
+			writeErrorResponse(w, "reset token is invalid or has expired", http.StatusBadRequest)
+			return
+		}
+		log.Printf("unable to get password reset token: %v", err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if resetToken.UsedAt != nil || time.Now().After(resetToken.ExpiresAt) {
+		h.recordAuthEvent(r, authEventPasswordReset, &postgres.User{UserID: resetToken.UserID}, authOutcomeFailure, authReasonInvalidToken)
+		writeErrorResponse(w, "reset token is invalid or has expired", http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.DB.GetUserByID(r.Context(), resetToken.UserID)
+	if err != nil {
+		log.Printf("unable to get user %s from db: %v", resetToken.UserID, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if !acceptPassword(w, body.Password, user.Email) {
+		h.recordAuthEvent(r, authEventPasswordReset, user, authOutcomeFailure, authReasonPasswordRejected)
+		return
+	}
+
+	hashedPassword, err := hashPassword(body.Password)
+	if err != nil {
+		log.Printf("error hashing password %v", err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// the cutoff is stored with the new password, so a reset cannot succeed
+	// while sessions from before it stay valid
+	cutoff := sessionCutoff()
+	userID, err := h.DB.ResetPassword(r.Context(), hashToken(body.Token), hashedPassword, cutoff)
+	if err != nil {
+		if errors.Is(err, postgres.ErrInvalidResetToken) {
+			h.recordAuthEvent(r, authEventPasswordReset, user, authOutcomeFailure, authReasonInvalidToken)
+			writeErrorResponse(w, "reset token is invalid or has expired", http.StatusBadRequest)
+			return
+		}
+		log.Printf("unable to reset password: %v", err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	h.sessionsRevoked(r.Context(), userID, cutoff)
+	h.recordAuthEvent(r, authEventPasswordReset, user, authOutcomeSuccess, "")
+
+	response := struct {
+		Message    string `json:"message"`
+		StatusCode int    `json:"status_code"`
+	}{
+		Message:    "Password reset successfully, please log in again",
+		StatusCode: http.StatusOK,
+	}
+	writeToJson(w, response, http.StatusOK)
+}
+
+// ChangePassword lets a logged in user replace their password after proving
+// they know the current one. With revoke_other_sessions set, every other
+// session is signed out and the caller receives a fresh set of tokens.
+func (h *AuthHandler) ChangePassword(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	claims := claimsFromContext(r.Context())
+
+	var body struct {
+		CurrentPassword     string `json:"current_password"`
+		NewPassword         string `json:"new_password"`
+		RevokeOtherSessions bool   `json:"revoke_other_sessions"`
+	}
+
+	if err := readFromJson(r, &body); err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body.CurrentPassword == "" || body.NewPassword == "" {
+		writeErrorResponse(w, "current_password and new_password are required", http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.DB.GetUserByID(r.Context(), claims.UserID)
+	if err != nil {
+		if errors.Is(err, postgres.ErrInvalidUser) {
+			writeErrorResponse(w, "user no longer exists", http.StatusUnauthorized)
+			return
+		}
+		log.Printf("unable to get user %s from db: %v", claims.UserID, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// a stolen session must not be a way around the login lockout
+	lockedUntil, err := h.accountLockedUntil(r.Context(), user.UserID)
+	if err != nil {
+		log.Printf("unable to check lockout of user %s: %v", user.UserID, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if lockedUntil != nil {
+		h.recordAuthEvent(r, authEventPasswordChange, user, authOutcomeFailure, authReasonAccountLocked)
+		writeAccountLocked(w, *lockedUntil)
+		return
+	}
+
+	if match, _ := checkPasswordHash(body.CurrentPassword, user.HashedPassword); !match {
+		h.recordAuthEvent(r, authEventPasswordChange, user, authOutcomeFailure, authReasonInvalidCredentials)
+		if lockedUntil := h.recordFailedLogin(r.Context(), user); lockedUntil != nil {
+			writeAccountLocked(w, *lockedUntil)
+			return
+		}
+		writeErrorResponse(w, "current password is incorrect", http.StatusUnauthorized)
+		return
+	}
+
+	if !acceptPassword(w, body.NewPassword, user.Email) {
+		h.recordAuthEvent(r, authEventPasswordChange, user, authOutcomeFailure, authReasonPasswordRejected)
+		return
+	}
+
+	hashedPassword, err := hashPassword(body.NewPassword)
+	if err != nil {
+		log.Printf("error hashing password %v", err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// other sessions are revoked along with the password change, so that it
+	// cannot succeed while they stay valid
+	cutoff := sessionCutoff()
+	if body.RevokeOtherSessions {
+		err = h.DB.UpdatePasswordAndRevokeSessions(r.Context(), user.UserID, hashedPassword, cutoff)
+	} else {
+		err = h.DB.UpdatePassword(r.Context(), user.UserID, hashedPassword)
+	}
+	if err != nil {
+		log.Printf("unable to update password for user %s: %v", user.UserID, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		Message      string `json:"message"`
+		Token        string `json:"session_token,omitempty"`
+		RefreshToken string `json:"refresh_token,omitempty"`
+		IDToken      string `json:"id_token,omitempty"`
+		StatusCode   int    `json:"status_code"`
+	}{
+		Message:    "Password changed successfully",
+		StatusCode: http.StatusOK,
+	}
+
+	if body.RevokeOtherSessions {
+		h.sessionsRevoked(r.Context(), user.UserID, cutoff)
+
+		// the caller's own token was revoked with the others, so it is
+		// replaced to keep the current session signed in.
+		response.Token, err = generateJWToken(user)
+		if err == nil {
+			response.RefreshToken, err = h.issueRefreshToken(r.Context(), user.UserID, "")
+		}
+		if err == nil {
+			response.IDToken, err = generateIDToken(user, "", time.Time{})
+		}
+		if err != nil {
+			log.Printf("unable to issue new session for user %s: %v", user.UserID, err)
+			writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		response.Message = "Password changed successfully, all other sessions have been signed out"
+	}
+
+	userData := map[string]interface{}{
+		"data": map[string]string{
+			"type":             rabbitmq.NotifyPasswordChanged,
+			"email":            user.Email,
+			"id":               user.UserID,
+			"sessions_revoked": strconv.FormatBool(body.RevokeOtherSessions),
+			"timestamp":        time.Now().String(),
+		},
+		"queue_name":    rabbitmq.NotificationQueue,
+		"exchange_name": rabbitmq.NotificationExchange,
+	}
+
+	// security notification so the owner notices changes they did not make
+	go h.RabbMQ.PublishNotification(userData)
+
+	h.recordAuthEvent(r, authEventPasswordChange, user, authOutcomeSuccess, "")
+	writeToJson(w, response, http.StatusOK)
+}
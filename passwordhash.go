@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Developer-s-Foundry/df-2.0-aima-auth-service/database/postgres"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// bcryptMaxPasswordBytes is the longest password bcrypt can hash; longer ones
+// make GenerateFromPassword fail.
+const bcryptMaxPasswordBytes = 72
+
+// maxArgon2Memory bounds the memory, in KiB, a stored hash may ask for.
+const maxArgon2Memory = 4 * 1024 * 1024
+
+var errMalformedPasswordHash = errors.New("malformed password hash")
+
+// PasswordHasher hashes passwords into PHC strings
+// ($id$param=value,...$salt$hash), or the modular crypt format for bcrypt.
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	// Verify checks password against a hash of this algorithm, using the
+	// parameters stored in the hash.
+	Verify(password, encoded string) (bool, error)
+	// Recognizes reports whether encoded was made with this algorithm.
+	Recognizes(encoded string) bool
+	// Outdated reports whether encoded was made with other parameters than
+	// the hasher would use now.
+	Outdated(encoded string) bool
+	// MaxPasswordBytes is the longest password the algorithm takes, or 0
+	// when there is no limit.
+	MaxPasswordBytes() int
+}
+
+// Argon2idHasher hashes with Argon2id. Memory is in KiB.
+type Argon2idHasher struct {
+	Memory      uint32
+	Time        uint32
+	Parallelism uint8
+	SaltLength  int
+	KeyLength   uint32
+}
+
+type argon2idHash struct {
+	memory      uint32
+	time        uint32
+	parallelism uint8
+	salt        []byte
+	key         []byte
+}
+
+func (a Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, a.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	key := argon2.IDKey([]byte(password), salt, a.Time, a.Memory, a.Parallelism, a.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, a.Memory, a.Time, a.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (a Argon2idHasher) Verify(password, encoded string) (bool, error) {
+	h, err := parseArgon2idHash(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	key := argon2.IDKey([]byte(password), h.salt, h.time, h.memory, h.parallelism, uint32(len(h.key)))
+	return subtle.ConstantTimeCompare(key, h.key) == 1, nil
+}
+
+func (a Argon2idHasher) Recognizes(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+func (a Argon2idHasher) Outdated(encoded string) bool {
+	h, err := parseArgon2idHash(encoded)
+	if err != nil {
+		return true
+	}
+	return h.memory != a.Memory || h.time != a.Time || h.parallelism != a.Parallelism ||
+		len(h.salt) != a.SaltLength || uint32(len(h.key)) != a.KeyLength
+}
+
+func (a Argon2idHasher) MaxPasswordBytes() int {
+	return 0
+}
+
+func parseArgon2idHash(encoded string) (*argon2idHash, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "argon2id" {
+		return nil, errMalformedPasswordHash
+	}
+	if parts[2] != "v="+strconv.Itoa(argon2.Version) {
+		return nil, fmt.Errorf("unsupported argon2 version %q", parts[2])
+	}
+
+	h := &argon2idHash{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.parallelism); err != nil {
+		return nil, errMalformedPasswordHash
+	}
+	if h.time == 0 || h.parallelism == 0 || h.memory > maxArgon2Memory {
+		return nil, errMalformedPasswordHash
+	}
+
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, errMalformedPasswordHash
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.key) == 0 {
+		return nil, errMalformedPasswordHash
+	}
+	return h, nil
+}
+
+// BcryptHasher hashes with bcrypt, which was the only algorithm before
+// Argon2id was added.
+type BcryptHasher struct {
+	Cost int
+}
+
+func (b BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), b.Cost)
+	return string(hash), err
+}
+
+func (b BcryptHasher) Verify(password, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b BcryptHasher) Recognizes(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+func (b BcryptHasher) Outdated(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != b.Cost
+}
+
+func (b BcryptHasher) MaxPasswordBytes() int {
+	return bcryptMaxPasswordBytes
+}
+
+var (
+	defaultArgon2idHasher = Argon2idHasher{
+		Memory:      19 * 1024,
+		Time:        2,
+		Parallelism: 1,
+		SaltLength:  16,
+		KeyLength:   32,
+	}
+	defaultBcryptHasher = BcryptHasher{Cost: 10}
+)
+
+// passwordHasher hashes every new password. It is loaded from
+// PASSWORD_HASH_ALGORITHM and the ARGON2_* or BCRYPT_COST variables at
+// startup.
+var passwordHasher PasswordHasher = defaultArgon2idHasher
+
+func loadPasswordHasher() (PasswordHasher, error) {
+	switch algorithm := os.Getenv("PASSWORD_HASH_ALGORITHM"); algorithm {
+	case "", "argon2id":
+		hasher := defaultArgon2idHasher
+		settings := []struct {
+			name     string
+			dst      func(uint64)
+			min, max uint64
+		}{
+			{"ARGON2_MEMORY", func(n uint64) { hasher.Memory = uint32(n) }, 8 * 1024, maxArgon2Memory},
+			{"ARGON2_TIME", func(n uint64) { hasher.Time = uint32(n) }, 1, 100},
+			{"ARGON2_PARALLELISM", func(n uint64) { hasher.Parallelism = uint8(n) }, 1, 255},
+		}
+		for _, s := range settings {
+			v := os.Getenv(s.name)
+			if v == "" {
+				continue
+			}
+			n, err := strconv.ParseUint(v, 10, 64)
+			if err != nil || n < s.min || n > s.max {
+				return nil, fmt.Errorf("invalid %s %q, must be between %d and %d", s.name, v, s.min, s.max)
+			}
+			s.dst(n)
+		}
+		return hasher, nil
+
+	case "bcrypt":
+		hasher := defaultBcryptHasher
+		if v := os.Getenv("BCRYPT_COST"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < bcrypt.MinCost || n > bcrypt.MaxCost {
+				return nil, fmt.Errorf("invalid BCRYPT_COST %q, must be between %d and %d", v, bcrypt.MinCost, bcrypt.MaxCost)
+			}
+			hasher.Cost = n
+		}
+		return hasher, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported PASSWORD_HASH_ALGORITHM %q", algorithm)
+	}
+}
+
+func hashPassword(password string) (string, error) {
+	return passwordHasher.Hash(password)
+}
+
+// checkPasswordHash reports whether password matches hash and, if it does,
+// whether hash was made with another algorithm or other parameters than
+// passwordHasher uses now and should be replaced.
+func checkPasswordHash(password, hash string) (match, rehash bool) {
+	hasher, current := PasswordHasher(nil), true
+	if passwordHasher.Recognizes(hash) {
+		hasher = passwordHasher
+	} else {
+		for _, h := range []PasswordHasher{defaultArgon2idHasher, defaultBcryptHasher} {
+			if h.Recognizes(hash) {
+				hasher, current = h, false
+				break
+			}
+		}
+	}
+	if hasher == nil {
+		return false, false
+	}
+
+	match, err := hasher.Verify(password, hash)
+	if err != nil {
+		log.Printf("unable to verify password hash: %v", err)
+		return false, false
+	}
+	if !match {
+		return false, false
+	}
+	return true, !current || passwordHasher.Outdated(hash)
+}
+
+// rehashPassword replaces the stored hash of a password that was just
+// verified. Failures are only logged, the old hash keeps working.
+func (h *AuthHandler) rehashPassword(ctx context.Context, user *postgres.User, password string) {
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		log.Printf("unable to rehash password of user %s: %v", user.UserID, err)
+		return
+	}
+	if err := h.DB.UpgradePasswordHash(ctx, user.UserID, user.HashedPassword, hashedPassword); err != nil {
+		log.Printf("unable to store rehashed password of user %s: %v", user.UserID, err)
+		return
+	}
+	user.HashedPassword = hashedPassword
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxPasswordLength bounds PASSWORD_MAX_LENGTH. The hasher may allow less,
+// see PasswordHasher.MaxPasswordBytes.
+const maxPasswordLength = 1024
+
+// Password strength scores, from the estimated entropy of a password.
+const (
+	PasswordVeryWeak = iota
+	PasswordWeak
+	PasswordFair
+	PasswordStrong
+	PasswordVeryStrong
+)
+
+// Violation codes reported by PasswordPolicy.Validate.
+const (
+	PasswordTooShort        = "too_short"
+	PasswordTooLong         = "too_long"
+	PasswordTooFewClasses   = "too_few_character_classes"
+	PasswordTooWeak         = "too_weak"
+	PasswordContainsContext = "contains_personal_information"
+	PasswordBreached        = "breached"
+)
+
+// PasswordPolicy is applied to every password a user sets. Lengths count
+// characters, not bytes. Passwords in Breached are rejected, and when
+// CheckBreachedAtLogin is set, accounts whose password turns up in it are
+// flagged at login.
+type PasswordPolicy struct {
+	MinLength            int
+	MaxLength            int
+	MinCharClasses       int
+	MinStrength          int
+	Breached             *BreachedPasswords
+	CheckBreachedAtLogin bool
+}
+
+// passwordPolicy is loaded from the PASSWORD_* variables at startup.
+var passwordPolicy = PasswordPolicy{
+	MinLength:      8,
+	MaxLength:      64,
+	MinCharClasses: 1,
+	MinStrength:    PasswordFair,
+}
+
+func loadPasswordPolicy() (PasswordPolicy, error) {
+	policy := passwordPolicy
+
+	settings := []struct {
+		name     string
+		dst      *int
+		min, max int
+	}{
+		{"PASSWORD_MIN_LENGTH", &policy.MinLength, 1, maxPasswordLength},
+		{"PASSWORD_MAX_LENGTH", &policy.MaxLength, 1, maxPasswordLength},
+		{"PASSWORD_MIN_CHAR_CLASSES", &policy.MinCharClasses, 0, 4},
+		{"PASSWORD_MIN_STRENGTH", &policy.MinStrength, PasswordVeryWeak, PasswordVeryStrong},
+	}
+	for _, s := range settings {
+		v := os.Getenv(s.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < s.min || n > s.max {
+			return policy, fmt.Errorf("invalid %s %q, must be between %d and %d", s.name, v, s.min, s.max)
+		}
+		*s.dst = n
+	}
+
+	if policy.MaxLength < policy.MinLength {
+		return policy, fmt.Errorf("PASSWORD_MAX_LENGTH must not be lower than PASSWORD_MIN_LENGTH")
+	}
+
+	if v := os.Getenv("BREACHED_PASSWORDS_CHECK_LOGIN"); v != "" {
+		check, err := strconv.ParseBool(v)
+		if err != nil {
+			return policy, fmt.Errorf("invalid BREACHED_PASSWORDS_CHECK_LOGIN %q", v)
+		}
+		policy.CheckBreachedAtLogin = check
+	}
+
+	breached, err := loadBreachedPasswords()
+	if err != nil {
+		return policy, err
+	}
+	policy.Breached = breached
+	return policy, nil
+}
+
+type PasswordViolation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// PasswordPolicyError lists every rule a password breaks, so that clients can
+// show them all at once.
+type PasswordPolicyError struct {
+	Violations []PasswordViolation
+	Strength   int
+}
+
+func (e *PasswordPolicyError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		messages[i] = v.Message
+	}
+	return "password does not meet the password policy: " + strings.Join(messages, "; ")
+}
+
+// Validate checks password against the policy. personal holds values, such
+// as the user's email address, that the password must not contain. It returns
+// a *PasswordPolicyError when the password is rejected.
+func (p PasswordPolicy) Validate(password string, personal ...string) error {
+	var violations []PasswordViolation
+	violate := func(code, format string, args ...interface{}) {
+		violations = append(violations, PasswordViolation{Code: code, Message: fmt.Sprintf(format, args...)})
+	}
+
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		violate(PasswordTooShort, "password must be at least %d characters long", p.MinLength)
+	}
+	if length > p.MaxLength {
+		violate(PasswordTooLong, "password must be at most %d characters long", p.MaxLength)
+	} else if limit := passwordHasher.MaxPasswordBytes(); limit > 0 && len(password) > limit {
+		violate(PasswordTooLong, "password must be at most %d bytes long", limit)
+	}
+
+	if classes := passwordCharClasses(password); classes < p.MinCharClasses {
+		violate(PasswordTooFewClasses, "password must mix at least %d of lowercase letters, uppercase letters, digits and symbols", p.MinCharClasses)
+	}
+
+	lower := strings.ToLower(password)
+	for _, value := range personalTerms(personal) {
+		if strings.Contains(lower, value) {
+			violate(PasswordContainsContext, "password must not contain your email address or name")
+			break
+		}
+	}
+
+	strength := passwordStrength(password)
+	if strength < p.MinStrength {
+		violate(PasswordTooWeak, "password is too easy to guess, use a longer password or a passphrase")
+	}
+
+	if p.Breached.Contains(password) {
+		violate(PasswordBreached, "password has appeared in a data breach, choose a different one")
+	}
+
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations, Strength: strength}
+	}
+	return nil
+}
+
+// personalTerms breaks values such as email addresses into the lowercase
+// parts a password might reuse, skipping parts too short to matter.
+func personalTerms(values []string) []string {
+	var terms []string
+	for _, value := range values {
+		value = strings.ToLower(strings.TrimSpace(value))
+		local, domain, _ := strings.Cut(value, "@")
+		parts := append([]string{value, local}, strings.FieldsFunc(local, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})...)
+		if name, _, ok := strings.Cut(domain, "."); ok {
+			parts = append(parts, name)
+		}
+		for _, part := range parts {
+			if utf8.RuneCountInString(part) >= 4 {
+				terms = append(terms, part)
+			}
+		}
+	}
+	return terms
+}
+
+func passwordCharClasses(password string) int {
+	var lower, upper, digit, other bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+
+	classes := 0
+	for _, present := range []bool{lower, upper, digit, other} {
+		if present {
+			classes++
+		}
+	}
+	return classes
+}
+
+// passwordEntropy estimates the entropy of password in bits from the size of
+// the alphabet it draws from. Characters that repeat the previous one or
+// continue a sequence such as "abc" or "321" add almost nothing.
+func passwordEntropy(password string) float64 {
+	var lower, upper, digit, symbol, other bool
+	effective := 0.0
+	var prev, step rune
+	for i, r := range password {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < utf8.RuneSelf:
+			symbol = true
+		default:
+			other = true
+		}
+
+		delta := r - prev
+		switch {
+		case i == 0:
+			effective++
+		case delta == 0 || (delta == 1 || delta == -1) && delta == step:
+			effective += 0.1
+		default:
+			effective++
+		}
+		if i > 0 {
+			step = delta
+		}
+		prev = r
+	}
+
+	pool := 0
+	for _, class := range []struct {
+		present bool
+		size    int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.present {
+			pool += class.size
+		}
+	}
+	if pool == 0 {
+		return 0
+	}
+	return effective * math.Log2(float64(pool))
+}
+
+// passwordStrength buckets the estimated entropy into a score from
+// PasswordVeryWeak to PasswordVeryStrong.
+func passwordStrength(password string) int {
+	bits := passwordEntropy(password)
+	switch {
+	case bits < 28:
+		return PasswordVeryWeak
+	case bits < 36:
+		return PasswordWeak
+	case bits < 60:
+		return PasswordFair
+	case bits < 128:
+		return PasswordStrong
+	default:
+		return PasswordVeryStrong
+	}
+}
+
+// writePasswordPolicyError answers 400 with every violation of the policy.
+func writePasswordPolicyError(w http.ResponseWriter, err *PasswordPolicyError) {
+	response := struct {
+		Error      string              `json:"error"`
+		Status     string              `json:"status"`
+		Violations []PasswordViolation `json:"violations"`
+		Strength   int                 `json:"strength"`
+	}{
+		Error:      "password does not meet the password policy",
+		Status:     http.StatusText(http.StatusBadRequest),
+		Violations: err.Violations,
+		Strength:   err.Strength,
+	}
+	writeToJson(w, response, http.StatusBadRequest)
+}
+
+// acceptPassword checks password against the policy and, when it is
+// rejected, answers with the violations. It reports whether the caller may go
+// on to store the password.
+func acceptPassword(w http.ResponseWriter, password string, personal ...string) bool {
+	var policyErr *PasswordPolicyError
+	if err := passwordPolicy.Validate(password, personal...); errors.As(err, &policyErr) {
+		writePasswordPolicyError(w, policyErr)
+		return false
+	}
+	return true
+}
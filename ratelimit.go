@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Developer-s-Foundry/df-2.0-aima-auth-service/database/postgres"
+	"github.com/julienschmidt/httprouter"
+)
+
+// RateLimitStore keeps the fixed-window counters the sliding window limiter
+// is built on. *postgres.PostgresConn implements it, so that limits hold
+// across replicas; MemoryRateLimitStore is for single instances.
+type RateLimitStore interface {
+	// HitRateLimit counts a request for key in the window starting at
+	// windowStart and returns the counts of that window and the one before.
+	HitRateLimit(ctx context.Context, key string, windowStart time.Time, window time.Duration) (current, previous int64, err error)
+}
+
+// RateLimitRule allows Limit requests per Window for every key Key derives
+// from a request. Key returns false when the rule does not apply, such as a
+// per-email rule on a request without an email.
+type RateLimitRule struct {
+	Name   string
+	Limit  int
+	Window time.Duration
+	Key    func(r *http.Request) (string, bool)
+}
+
+// RateLimiter applies named sets of rules with a sliding window counter: the
+// count of the previous window is weighted by how much of it still overlaps
+// the sliding window and added to the count of the current one.
+type RateLimiter struct {
+	store RateLimitStore
+	rules map[string][]RateLimitRule
+}
+
+type rateLimitResult struct {
+	rule       RateLimitRule
+	remaining  int
+	reset      time.Duration
+	retryAfter time.Duration
+	limited    bool
+}
+
+// NewRateLimiterFromEnv builds the limiter for the login and register
+// endpoints. RATE_LIMIT_BACKEND picks the store, memory (default) or
+// postgres, and the RATE_LIMIT_* variables override the default limits.
+func NewRateLimiterFromEnv(db *postgres.PostgresConn) (*RateLimiter, error) {
+	l := &RateLimiter{rules: map[string][]RateLimitRule{}}
+
+	switch backend := os.Getenv("RATE_LIMIT_BACKEND"); backend {
+	case "", "memory":
+		l.store = NewMemoryRateLimitStore()
+	case "postgres":
+		l.store = db
+	default:
+		return nil, fmt.Errorf("unsupported RATE_LIMIT_BACKEND %q", backend)
+	}
+
+	rules := []struct {
+		set, name, env, fallback string
+		key                      func(r *http.Request) (string, bool)
+	}{
+		{"login", "ip", "RATE_LIMIT_LOGIN_IP", "20/1m", clientIPKey},
+		{"login", "email", "RATE_LIMIT_LOGIN_EMAIL", "10/15m", emailKey},
+		{"login", "global", "RATE_LIMIT_LOGIN_GLOBAL", "1000/1m", globalKey},
+		{"register", "ip", "RATE_LIMIT_REGISTER_IP", "10/1h", clientIPKey},
+		{"register", "global", "RATE_LIMIT_REGISTER_GLOBAL", "200/1m", globalKey},
+	}
+	for _, r := range rules {
+		spec := os.Getenv(r.env)
+		if spec == "" {
+			spec = r.fallback
+		}
+		if spec == "off" {
+			continue
+		}
+
+		limit, window, err := parseRateLimit(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %w", r.env, spec, err)
+		}
+		l.rules[r.set] = append(l.rules[r.set], RateLimitRule{
+			Name:   r.set + ":" + r.name,
+			Limit:  limit,
+			Window: window,
+			Key:    r.key,
+		})
+	}
+	return l, nil
+}
+
+// parseRateLimit parses limits written as requests/window, e.g. 20/1m.
+func parseRateLimit(spec string) (int, time.Duration, error) {
+	count, period, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("expected requests/window")
+	}
+	limit, err := strconv.Atoi(count)
+	if err != nil || limit <= 0 {
+		return 0, 0, fmt.Errorf("invalid request count")
+	}
+	window, err := time.ParseDuration(period)
+	if err != nil || window < time.Second {
+		return 0, 0, fmt.Errorf("invalid window")
+	}
+	return limit, window, nil
+}
+
+// Limit applies the rule set to next. It is meant to sit inside
+// VerifyGatewayRequest, which makes the forwarded client address trustworthy.
+func (l *RateLimiter) Limit(set string, next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		var tightest *rateLimitResult
+		for _, rule := range l.rules[set] {
+			key, ok := rule.Key(r)
+			if !ok {
+				continue
+			}
+
+			result, err := l.hit(r.Context(), rule, key, time.Now())
+			if err != nil {
+				// an unavailable store must not take logins down with it
+				log.Printf("[RateLimit] Unable to apply %s: %v", rule.Name, err)
+				continue
+			}
+			if tightest == nil || result.tighterThan(tightest) {
+				tightest = result
+			}
+		}
+
+		if tightest != nil {
+			writeRateLimitHeaders(w, tightest)
+			if tightest.limited {
+				w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(tightest.retryAfter)))
+				writeErrorResponse(w, "too many requests, please try again later", http.StatusTooManyRequests)
+				return
+			}
+		}
+
+		next(w, r, ps)
+	}
+}
+
+func (l *RateLimiter) hit(ctx context.Context, rule RateLimitRule, key string, now time.Time) (*rateLimitResult, error) {
+	windowStart := now.Truncate(rule.Window)
+	current, previous, err := l.store.HitRateLimit(ctx, rule.Name+":"+key, windowStart, rule.Window)
+	if err != nil {
+		return nil, err
+	}
+
+	elapsed := now.Sub(windowStart)
+	weight := 1 - float64(elapsed)/float64(rule.Window)
+	estimate := float64(previous)*weight + float64(current)
+	limit := float64(rule.Limit)
+
+	result := &rateLimitResult{
+		rule:      rule,
+		remaining: max(0, rule.Limit-int(math.Ceil(estimate))),
+		reset:     rule.Window - elapsed,
+		limited:   estimate > limit,
+	}
+	if !result.limited {
+		return result, nil
+	}
+
+	// time until one more request fits, assuming no further hits
+	if float64(current)+1 <= limit && previous > 0 {
+		fits := time.Duration(float64(rule.Window) * (1 - (limit-float64(current)-1)/float64(previous)))
+		result.retryAfter = fits - elapsed
+	} else {
+		fits := time.Duration(float64(rule.Window) * (1 - (limit-1)/float64(current)))
+		result.retryAfter = rule.Window - elapsed + max(fits, 0)
+	}
+	result.reset = result.retryAfter
+	return result, nil
+}
+
+func (r *rateLimitResult) tighterThan(other *rateLimitResult) bool {
+	if r.limited != other.limited {
+		return r.limited
+	}
+	if r.limited {
+		return r.retryAfter > other.retryAfter
+	}
+	return r.remaining < other.remaining
+}
+
+// writeRateLimitHeaders reports the rule closest to its limit in the
+// RateLimit-* fields of the IETF httpapi rate limit draft.
+func writeRateLimitHeaders(w http.ResponseWriter, result *rateLimitResult) {
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(result.rule.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.reset)))
+	w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", result.rule.Limit, int(result.rule.Window.Seconds())))
+}
+
+func ceilSeconds(d time.Duration) int {
+	return max(1, int(math.Ceil(d.Seconds())))
+}
+
+// clientIPKey keys requests by the client address the gateway forwards in
+// TRUSTED_CLIENT_IP_HEADER (X-Forwarded-For by default). The last entry is
+// used, as that is the one the gateway appended itself.
+func clientIPKey(r *http.Request) (string, bool) {
+	header := os.Getenv("TRUSTED_CLIENT_IP_HEADER")
+	if header == "" {
+		header = "X-Forwarded-For"
+	}
+
+	if forwarded := r.Header.Values(header); len(forwarded) > 0 {
+		entries := strings.Split(forwarded[len(forwarded)-1], ",")
+		if ip := net.ParseIP(strings.TrimSpace(entries[len(entries)-1])); ip != nil {
+			return ip.String(), true
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return host, host != ""
+}
+
+// emailKey keys requests by the email or, failing that, username field of
+// their JSON body, which is left in place for the handler.
+func emailKey(r *http.Request) (string, bool) {
+	if r.Body == nil {
+		return "", false
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return "", false
+	}
+
+	var payload struct {
+		Email    string `json:"email"`
+		Username string `json:"username"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return "", false
+	}
+	if payload.Email == "" {
+		payload.Email = payload.Username
+	}
+	email := lookupEmail(payload.Email)
+	return email, email != ""
+}
+
+func globalKey(*http.Request) (string, bool) {
+	return "all", true
+}
+
+// MemoryRateLimitStore keeps rate limit counters in process memory.
+type MemoryRateLimitStore struct {
+	mu       sync.Mutex
+	counters map[string]*memoryRateLimitCounter
+	hits     int
+}
+
+type memoryRateLimitCounter struct {
+	windowStart time.Time
+	window      time.Duration
+	current     int64
+	previous    int64
+}
+
+// memoryRateLimitSweepEvery is how many hits pass between sweeps of counters
+// that have gone quiet.
+const memoryRateLimitSweepEvery = 1024
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{counters: make(map[string]*memoryRateLimitCounter)}
+}
+
+func (s *MemoryRateLimitStore) HitRateLimit(_ context.Context, key string, windowStart time.Time, window time.Duration) (int64, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.hits++
+	if s.hits%memoryRateLimitSweepEvery == 0 {
+		for k, c := range s.counters {
+			if windowStart.Sub(c.windowStart) > 2*c.window {
+				delete(s.counters, k)
+			}
+		}
+	}
+
+	c, ok := s.counters[key]
+	switch {
+	case !ok:
+		c = &memoryRateLimitCounter{windowStart: windowStart, window: window}
+		s.counters[key] = c
+	case c.windowStart.Equal(windowStart):
+	case c.windowStart.Add(window).Equal(windowStart):
+		c.windowStart, c.previous, c.current = windowStart, c.current, 0
+	default:
+		c.windowStart, c.previous, c.current = windowStart, 0, 0
+	}
+
+	c.current++
+	return c.current, c.previous, nil
+}
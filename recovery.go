@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Developer-s-Foundry/df-2.0-aima-auth-service/database/postgres"
+	"github.com/Developer-s-Foundry/df-2.0-aima-auth-service/database/rabbitmq"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	recoveryCodeCount  = 10
+	recoveryCodeLength = 10
+	// Crockford's base32 alphabet leaves out characters that are easy to
+	// misread when a code is typed in from paper.
+	recoveryCodeAlphabet = "0123456789abcdefghjkmnpqrstvwxyz"
+)
+
+const MFAMethodRecoveryCode = "recovery_code"
+
+// generateRecoveryCodes returns recoveryCodeCount codes of 50 random bits
+// each, formatted as xxxxx-xxxxx.
+func generateRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	buf := make([]byte, recoveryCodeLength)
+	for i := range codes {
+		if _, err := rand.Read(buf); err != nil {
+			return nil, fmt.Errorf("failed to generate recovery code: %w", err)
+		}
+		for j, b := range buf {
+			buf[j] = recoveryCodeAlphabet[b&31]
+		}
+		half := recoveryCodeLength / 2
+		codes[i] = string(buf[:half]) + "-" + string(buf[half:])
+	}
+	return codes, nil
+}
+
+// hashRecoveryCode hashes code for storage. Case, dashes and spaces are
+// ignored so users can type codes the way they wrote them down.
+func hashRecoveryCode(userID, code string) string {
+	normalized := strings.ToLower(code)
+	normalized = strings.NewReplacer("-", "", " ", "").Replace(normalized)
+	return hashToken(userID + ":" + normalized)
+}
+
+// issueRecoveryCodes replaces the user's recovery codes with a fresh set and
+// returns the plaintext codes, which are never retrievable again.
+func (h *AuthHandler) issueRecoveryCodes(ctx context.Context, userID string) ([]string, error) {
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = hashRecoveryCode(userID, code)
+	}
+
+	if err := h.DB.ReplaceRecoveryCodes(ctx, userID, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// deleteOrphanedRecoveryCodes drops the user's recovery codes once no second
+// factor is left for them to stand in for.
+func (h *AuthHandler) deleteOrphanedRecoveryCodes(ctx context.Context, userID string) {
+	methods, err := h.mfaMethods(ctx, userID)
+	if err != nil {
+		log.Printf("unable to get mfa methods of user %s: %v", userID, err)
+		return
+	}
+	if len(methods) > 0 {
+		return
+	}
+	if err := h.DB.DeleteRecoveryCodes(ctx, userID); err != nil {
+		log.Printf("unable to delete recovery codes for user %s: %v", userID, err)
+	}
+}
+
+// useRecoveryCode burns code in place of a second factor and notifies the
+// account owner, who may not have been the one using it.
+func (h *AuthHandler) useRecoveryCode(ctx context.Context, user *postgres.User, code string) (bool, error) {
+	err := h.DB.UseRecoveryCode(ctx, user.UserID, hashRecoveryCode(user.UserID, code))
+	if err != nil {
+		if errors.Is(err, postgres.ErrInvalidRecoveryCode) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	remaining, err := h.DB.CountUnusedRecoveryCodes(ctx, user.UserID)
+	if err != nil {
+		log.Printf("unable to count recovery codes of user %s: %v", user.UserID, err)
+	}
+
+	userData := map[string]interface{}{
+		"data": map[string]string{
+			"type":            rabbitmq.NotifyRecoveryCodeUsed,
+			"email":           user.Email,
+			"id":              user.UserID,
+			"codes_remaining": strconv.Itoa(remaining),
+			"timestamp":       time.Now().String(),
+		},
+		"queue_name":    rabbitmq.NotificationQueue,
+		"exchange_name": rabbitmq.NotificationExchange,
+	}
+
+	go h.RabbMQ.PublishNotification(userData)
+
+	return true, nil
+}
+
+// RegenerateRecoveryCodes invalidates every existing recovery code of the
+// logged in user and returns a new set.
+func (h *AuthHandler) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	claims := claimsFromContext(r.Context())
+
+	methods, err := h.mfaMethods(r.Context(), claims.UserID)
+	if err != nil {
+		log.Printf("unable to get mfa methods of user %s: %v", claims.UserID, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if len(methods) == 0 {
+		writeErrorResponse(w, "enable a second factor before generating recovery codes", http.StatusBadRequest)
+		return
+	}
+
+	codes, err := h.issueRecoveryCodes(r.Context(), claims.UserID)
+	if err != nil {
+		log.Printf("unable to issue recovery codes for user %s: %v", claims.UserID, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+		StatusCode    int      `json:"status_code"`
+		Message       string   `json:"message"`
+	}{
+		RecoveryCodes: codes,
+		StatusCode:    http.StatusOK,
+		Message:       "Store these recovery codes somewhere safe, previous codes no longer work",
+	}
+	writeToJson(w, response, http.StatusOK)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Developer-s-Foundry/df-2.0-aima-auth-service/database/postgres"
+	"github.com/julienschmidt/httprouter"
+)
+
+const refreshTokenTTL = 30 * 24 * time.Hour
+
+// issueRefreshToken stores a new refresh token for userID and returns its
+// plaintext value. An empty familyID starts a new token family, which happens
+// on every fresh login or registration.
+func (h *AuthHandler) issueRefreshToken(ctx context.Context, userID, familyID string) (string, error) {
+	token, err := generateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	if familyID == "" {
+		familyID = generateUuid()
+	}
+
+	err = h.DB.InsertRefreshToken(ctx, postgres.RefreshToken{
+		ID:        generateUuid(),
+		UserID:    userID,
+		FamilyID:  familyID,
+		TokenHash: hashToken(token),
+		ExpiresAt: time.Now().Add(refreshTokenTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+func (h *AuthHandler) RefreshToken(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	if err := readFromJson(r, &body); err != nil || body.RefreshToken == "" {
+		writeErrorResponse(w, "refresh_token is required", http.StatusBadRequest)
+		return
+	}
+
+	current, err := h.DB.GetRefreshToken(r.Context(), hashToken(body.RefreshToken))
+	if err != nil {
+		if errors.Is(err, postgres.ErrInvalidRefreshToken) {
+			writeErrorResponse(w, "invalid refresh token", http.StatusUnauthorized)
+			return
+		}
+		log.Printf("unable to get refresh token from db: %v", err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if current.RevokedAt != nil {
+		writeErrorResponse(w, "refresh token has been revoked", http.StatusUnauthorized)
+		return
+	}
+
+	if current.RotatedAt != nil {
+		h.revokeReusedRefreshToken(r.Context(), current)
+		writeErrorResponse(w, "refresh token reuse detected", http.StatusUnauthorized)
+		return
+	}
+
+	if time.Now().After(current.ExpiresAt) {
+		writeErrorResponse(w, "refresh token has expired", http.StatusUnauthorized)
+		return
+	}
+
+	nextToken, err := generateOpaqueToken()
+	if err != nil {
+		log.Printf("error generating refresh token %v", err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	err = h.DB.RotateRefreshToken(r.Context(), current.ID, postgres.RefreshToken{
+		ID:        generateUuid(),
+		UserID:    current.UserID,
+		FamilyID:  current.FamilyID,
+		TokenHash: hashToken(nextToken),
+		ExpiresAt: time.Now().Add(refreshTokenTTL),
+	})
+	if err != nil {
+		if errors.Is(err, postgres.ErrRefreshTokenReused) {
+			// another request rotated this token first, so one of the two
+			// callers is replaying it.
+			h.revokeReusedRefreshToken(r.Context(), current)
+			writeErrorResponse(w, "refresh token reuse detected", http.StatusUnauthorized)
+			return
+		}
+		log.Printf("unable to rotate refresh token: %v", err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	user, err := h.DB.GetUserByID(r.Context(), current.UserID)
+	if err != nil {
+		log.Printf("unable to get user %s from db: %v", current.UserID, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	sessionToken, err := generateJWToken(user)
+	if err != nil {
+		log.Printf("Token generation error for user %s: %v", current.UserID, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	idToken, err := generateIDToken(user, "", time.Time{})
+	if err != nil {
+		log.Printf("ID token error for user %s: %v", current.UserID, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		ID           string `json:"id"`
+		Token        string `json:"session_token"`
+		RefreshToken string `json:"refresh_token"`
+		IDToken      string `json:"id_token"`
+		StatusCode   int    `json:"status_code"`
+		Message      string `json:"message"`
+	}{
+		ID:           current.UserID,
+		Token:        sessionToken,
+		RefreshToken: nextToken,
+		IDToken:      idToken,
+		StatusCode:   http.StatusOK,
+		Message:      "Token refreshed successfully",
+	}
+
+	writeToJson(w, response, http.StatusOK)
+}
+
+// revokeReusedRefreshToken revokes every token descended from the same login
+// once a rotated-out token is presented again.
+func (h *AuthHandler) revokeReusedRefreshToken(ctx context.Context, t *postgres.RefreshToken) {
+	log.Printf("refresh token reuse detected for user %s, revoking family %s", t.UserID, t.FamilyID)
+	if err := h.DB.RevokeRefreshTokenFamily(ctx, t.FamilyID); err != nil {
+		log.Printf("unable to revoke refresh token family %s: %v", t.FamilyID, err)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Developer-s-Foundry/df-2.0-aima-auth-service/database/postgres"
+)
+
+const (
+	// revocationSyncInterval bounds how long a revocation can go unnoticed
+	// by a replica whose listener is down; otherwise notifications apply it
+	// right away.
+	revocationSyncInterval = 30 * time.Second
+	// revocationListenRetry is the wait before a failed listener reconnects.
+	revocationListenRetry = 5 * time.Second
+	// revocationSyncOverlap re-reads a short window of already seen rows so
+	// revocations committed slightly out of order are never skipped.
+	revocationSyncOverlap = time.Minute
+)
+
+// RevocationCache is a RevocationStore that keeps the jti of every revoked,
+// not yet expired access token, and per user cutoffs that revoke all of a
+// user's tokens issued before a point in time. Postgres is the source of truth
+// shared by all replicas; lookups are served from memory, which Listen updates
+// as other replicas commit revocations and Run re-synchronises in case a
+// notification was missed.
+type RevocationCache struct {
+	db             *postgres.PostgresConn
+	mu             sync.RWMutex
+	revoked        map[string]time.Time
+	cutoffs        map[string]time.Time
+	lastSeen       time.Time
+	lastCutoffSeen time.Time
+}
+
+var _ RevocationStore = (*RevocationCache)(nil)
+
+func NewRevocationCache(db *postgres.PostgresConn) *RevocationCache {
+	return &RevocationCache{
+		db:      db,
+		revoked: make(map[string]time.Time),
+		cutoffs: make(map[string]time.Time),
+	}
+}
+
+// Revoke blocks the token identified by jti until expiresAt, after which it
+// would be rejected anyway.
+func (s *RevocationCache) Revoke(ctx context.Context, jti, userID string, expiresAt time.Time) error {
+	if err := s.db.Revoke(ctx, jti, userID, expiresAt); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.revoked[jti] = expiresAt
+	s.mu.Unlock()
+	return nil
+}
+
+// sessionCutoff is the cutoff that revokes every access token issued before
+// now. It is truncated to whole seconds, the resolution of the iat claim, so
+// that tokens handed out right after it stay valid.
+func sessionCutoff() time.Time {
+	return time.Now().Truncate(time.Second)
+}
+
+// RevokeSessions revokes every token of the user issued before cutoff, and
+// applies it here without waiting for its notification. Repeating a cutoff
+// that was already stored along with other changes, such as by a password
+// reset, is harmless.
+func (s *RevocationCache) RevokeSessions(ctx context.Context, userID string, cutoff time.Time) error {
+	if err := s.db.RevokeSessions(ctx, userID, cutoff); err != nil {
+		return err
+	}
+
+	s.apply(postgres.RevocationNotice{UserID: userID, RevokedBefore: cutoff})
+	return nil
+}
+
+// IsRevoked reports whether the token with the given jti, issued to userID at
+// issuedAt, has been revoked individually or through a session cutoff. It
+// only reads memory and never fails.
+func (s *RevocationCache) IsRevoked(_ context.Context, jti, userID string, issuedAt time.Time) (bool, error) {
+	s.mu.RLock()
+	expiresAt, revoked := s.revoked[jti]
+	cutoff, hasCutoff := s.cutoffs[userID]
+	s.mu.RUnlock()
+
+	if revoked && time.Now().Before(expiresAt) {
+		return true, nil
+	}
+	return hasCutoff && issuedAt.Before(cutoff), nil
+}
+
+// revocations returns where the handler records and checks revocations: the
+// injected cache, or the store itself when there is none.
+func (h *AuthHandler) revocations() RevocationStore {
+	if h.Revocations != nil {
+		return h.Revocations
+	}
+	return h.DB
+}
+
+// sessionsRevoked makes a cutoff that DB already stored along with other
+// changes, such as by a password reset, take effect in Revocations without
+// waiting for its notification.
+func (h *AuthHandler) sessionsRevoked(ctx context.Context, userID string, cutoff time.Time) {
+	if h.Revocations == nil {
+		return
+	}
+	if err := h.Revocations.RevokeSessions(ctx, userID, cutoff); err != nil {
+		log.Printf("unable to apply session cutoff for user %s: %v", userID, err)
+	}
+}
+
+// verifyAccessToken checks the signature and expiry of a session token like
+// VerifyJWToken, and rejects it with ErrTokenRevoked once it was revoked.
+func (h *AuthHandler) verifyAccessToken(ctx context.Context, tokenString string) (*CustomClaims, error) {
+	claims, err := VerifyJWToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	var issuedAt time.Time
+	if claims.IssuedAt != nil {
+		issuedAt = claims.IssuedAt.Time
+	}
+	revoked, err := h.revocations().IsRevoked(ctx, claims.ID, claims.UserID, issuedAt)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errRevocationCheck, err)
+	}
+	if revoked {
+		return nil, ErrTokenRevoked
+	}
+	return claims, nil
+}
+
+// Sync pulls revocations made by other replicas since the last sync.
+func (s *RevocationCache) Sync(ctx context.Context) error {
+	s.mu.RLock()
+	since, cutoffSince := s.lastSeen, s.lastCutoffSeen
+	s.mu.RUnlock()
+	if !since.IsZero() {
+		since = since.Add(-revocationSyncOverlap)
+	}
+	if !cutoffSince.IsZero() {
+		cutoffSince = cutoffSince.Add(-revocationSyncOverlap)
+	}
+
+	tokens, err := s.db.GetRevokedTokensSince(ctx, since)
+	if err != nil {
+		return err
+	}
+
+	sessions, err := s.db.GetSessionRevocationsSince(ctx, cutoffSince)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range tokens {
+		s.revoked[t.JTI] = t.ExpiresAt
+		if t.RevokedAt.After(s.lastSeen) {
+			s.lastSeen = t.RevokedAt
+		}
+	}
+	for _, session := range sessions {
+		if session.RevokedBefore.After(s.cutoffs[session.UserID]) {
+			s.cutoffs[session.UserID] = session.RevokedBefore
+		}
+		if session.UpdatedAt.After(s.lastCutoffSeen) {
+			s.lastCutoffSeen = session.UpdatedAt
+		}
+	}
+	return nil
+}
+
+// Listen applies revocations committed by any replica as Postgres announces
+// them, until ctx is cancelled. Whenever it (re)connects it syncs, so nothing
+// committed while it was disconnected is left for the next periodic sync.
+func (s *RevocationCache) Listen(ctx context.Context) {
+	for {
+		listening := func() {
+			if err := s.Sync(ctx); err != nil {
+				log.Printf("[Revocation] Sync error: %v", err)
+			}
+		}
+		err := s.db.ListenRevocations(ctx, listening, s.apply)
+		if ctx.Err() != nil {
+			log.Println("[Revocation] Context cancelled, stopping revocation listener")
+			return
+		}
+		log.Printf("[Revocation] Listener error: %v — reconnecting in %.0fs", err, revocationListenRetry.Seconds())
+
+		select {
+		case <-time.After(revocationListenRetry):
+		case <-ctx.Done():
+			log.Println("[Revocation] Context cancelled, stopping revocation listener")
+			return
+		}
+	}
+}
+
+func (s *RevocationCache) apply(n postgres.RevocationNotice) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if n.JTI != "" {
+		s.revoked[n.JTI] = n.ExpiresAt
+		return
+	}
+	if n.RevokedBefore.After(s.cutoffs[n.UserID]) {
+		s.cutoffs[n.UserID] = n.RevokedBefore
+	}
+}
+
+// Prune drops expired entries from memory and from Postgres. A session
+// cutoff expires once every token it could reject has expired.
+func (s *RevocationCache) Prune(ctx context.Context) error {
+	now := time.Now()
+	oldestLiveToken := now.Add(-accessTokenTTL)
+	s.mu.Lock()
+	for jti, expiresAt := range s.revoked {
+		if !now.Before(expiresAt) {
+			delete(s.revoked, jti)
+		}
+	}
+	for userID, cutoff := range s.cutoffs {
+		if cutoff.Before(oldestLiveToken) {
+			delete(s.cutoffs, userID)
+		}
+	}
+	s.mu.Unlock()
+
+	deleted, err := s.db.DeleteExpiredRevokedTokens(ctx)
+	if err != nil {
+		return err
+	}
+	if deleted > 0 {
+		log.Printf("[Revocation] Pruned %d expired revoked tokens", deleted)
+	}
+
+	deleted, err = s.db.DeleteSessionRevocationsBefore(ctx, oldestLiveToken)
+	if err != nil {
+		return err
+	}
+	if deleted > 0 {
+		log.Printf("[Revocation] Pruned %d expired session revocations", deleted)
+	}
+	return nil
+}
+
+// Run keeps the store in sync and pruned until ctx is cancelled.
+func (s *RevocationCache) Run(ctx context.Context) {
+	ticker := time.NewTicker(revocationSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Sync(ctx); err != nil {
+				log.Printf("[Revocation] Sync error: %v", err)
+			}
+			if err := s.Prune(ctx); err != nil {
+				log.Printf("[Revocation] Prune error: %v", err)
+			}
+		case <-ctx.Done():
+			log.Println("[Revocation] Context cancelled, stopping revocation sync")
+			return
+		}
+	}
+}
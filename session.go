@@ -2,6 +2,119 @@ package main
 
 import (
 	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Developer-s-Foundry/df-2.0-aima-auth-service/database/postgres"
+	"github.com/julienschmidt/httprouter"
 )
 
 var ErrAuth = errors.New("Unauthorized")
+
+var ErrTokenRevoked = errors.New("token has been revoked")
+
+// errRevocationCheck wraps failures to look up whether a token was revoked,
+// so callers can tell them apart from invalid tokens.
+var errRevocationCheck = errors.New("unable to check token revocation")
+
+// Logout revokes the caller's access token until it expires. When the body
+// carries the session's refresh token, its whole family is revoked as well.
+func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	claims := claimsFromContext(r.Context())
+
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if r.ContentLength != 0 {
+		if err := readFromJson(r, &body); err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if claims.ID == "" {
+		writeErrorResponse(w, "token has no jti and cannot be revoked", http.StatusBadRequest)
+		return
+	}
+	if err := h.revocations().Revoke(r.Context(), claims.ID, claims.UserID, claims.ExpiresAt.Time); err != nil {
+		log.Printf("unable to revoke token for user %s: %v", claims.UserID, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if body.RefreshToken != "" {
+		t, err := h.DB.GetRefreshToken(r.Context(), hashToken(body.RefreshToken))
+		if err == nil && t.UserID == claims.UserID {
+			if err := h.DB.RevokeRefreshTokenFamily(r.Context(), t.FamilyID); err != nil {
+				log.Printf("unable to revoke refresh token family %s: %v", t.FamilyID, err)
+			}
+		}
+	}
+	h.recordAuthEvent(r, authEventLogout, &postgres.User{UserID: claims.UserID}, authOutcomeSuccess, "")
+
+	response := struct {
+		Message    string `json:"message"`
+		StatusCode int    `json:"status_code"`
+	}{
+		Message:    "Logged out successfully",
+		StatusCode: http.StatusOK,
+	}
+	writeToJson(w, response, http.StatusOK)
+}
+
+// writeLoginResponse completes a successful authentication: it issues a
+// session token, a refresh token starting a new family and an ID token for
+// user, records the login as eventType and writes the login response.
+func (h *AuthHandler) writeLoginResponse(w http.ResponseWriter, r *http.Request, user *postgres.User, eventType, nonce string) {
+	sessionToken, err := generateJWToken(user)
+
+	if err != nil {
+		log.Printf("Token generation error for user %s: %v", user.Email, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	refreshToken, err := h.issueRefreshToken(r.Context(), user.UserID, "")
+	if err != nil {
+		log.Printf("Refresh token error for user %s: %v", user.Email, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	idToken, err := generateIDToken(user, nonce, time.Now())
+	if err != nil {
+		log.Printf("ID token error for user %s: %v", user.Email, err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// only a completed login clears failed attempts, so guessing second
+	// factors still counts after a correct password
+	if err := h.DB.ResetFailedLogins(r.Context(), user.UserID); err != nil {
+		log.Printf("Unable to reset failed logins for user %s: %v", user.Email, err)
+	}
+	h.recordAuthEvent(r, eventType, user, authOutcomeSuccess, "")
+
+	response := struct {
+		ID               string `json:"id"`
+		Email            string `json:"email"`
+		Token            string `json:"session_token"`
+		RefreshToken     string `json:"refresh_token"`
+		IDToken          string `json:"id_token"`
+		PasswordBreached bool   `json:"password_breached,omitempty"`
+		StatusCode       int    `json:"status_code"`
+		Message          string `json:"message"`
+	}{
+		ID:               user.UserID,
+		Email:            user.Email,
+		Token:            sessionToken,
+		RefreshToken:     refreshToken,
+		IDToken:          idToken,
+		PasswordBreached: user.PasswordBreachedAt != nil,
+		StatusCode:       http.StatusOK,
+		Message:          "Login successful! Welcome to AIMAS",
+	}
+
+	writeToJson(w, response, http.StatusOK)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/Developer-s-Foundry/df-2.0-aima-auth-service/database/postgres"
+)
+
+// The stores below cover everything AuthHandler reads and writes.
+// *postgres.PostgresConn implements them for production and MemoryStore for
+// tests and single instance development setups. Both report the sentinel
+// errors of the postgres package, such as postgres.ErrInvalidUser, so that
+// handlers behave the same on either.
+
+type UserStore interface {
+	// InsertUser stores the user, its verification token and its outbox
+	// events all or nothing. It fails with postgres.ErrUserExists when the
+	// email is taken, regardless of case.
+	InsertUser(u postgres.User, verification *postgres.EmailVerificationToken, events ...postgres.OutboxEvent) error
+	GetUser(ctx context.Context, email string) (*postgres.User, error)
+	GetUserByID(ctx context.Context, userID string) (*postgres.User, error)
+	GetUserByUsername(ctx context.Context, username string) (*postgres.User, error)
+	UpdateUsername(ctx context.Context, userID, newUsername string) (string, error)
+	UpdatePassword(ctx context.Context, userID, hashedPassword string) error
+	UpdatePasswordAndRevokeSessions(ctx context.Context, userID, hashedPassword string, revokedBefore time.Time) error
+	UpgradePasswordHash(ctx context.Context, userID, oldHash, newHash string) error
+	FlagBreachedPassword(ctx context.Context, userID string) (*time.Time, error)
+}
+
+type RefreshTokenStore interface {
+	InsertRefreshToken(ctx context.Context, t postgres.RefreshToken) error
+	GetRefreshToken(ctx context.Context, tokenHash string) (*postgres.RefreshToken, error)
+	RotateRefreshToken(ctx context.Context, oldID string, next postgres.RefreshToken) error
+	RevokeRefreshTokenFamily(ctx context.Context, familyID string) error
+	RevokeUserRefreshTokens(ctx context.Context, userID string) error
+}
+
+// VerificationStore holds the single use tokens sent by email to verify an
+// address or reset a password.
+type VerificationStore interface {
+	InsertEmailVerificationToken(ctx context.Context, t postgres.EmailVerificationToken, events ...postgres.OutboxEvent) error
+	GetLastEmailVerificationSentAt(ctx context.Context, userID string) (time.Time, error)
+	VerifyEmail(ctx context.Context, tokenHash string) (string, error)
+	InsertPasswordResetToken(ctx context.Context, t postgres.PasswordResetToken, events ...postgres.OutboxEvent) error
+	GetPasswordResetToken(ctx context.Context, tokenHash string) (*postgres.PasswordResetToken, error)
+	ResetPassword(ctx context.Context, tokenHash, hashedPassword string, revokedBefore time.Time) (string, error)
+}
+
+// MFAStore holds TOTP authenticators, the challenges handed out between the
+// two login steps and recovery codes.
+type MFAStore interface {
+	UpsertPendingTOTP(ctx context.Context, userID string, secret []byte) error
+	GetTOTP(ctx context.Context, userID string) (*postgres.TOTPCredential, error)
+	ConfirmTOTP(ctx context.Context, userID string, step int64) error
+	UseTOTPStep(ctx context.Context, userID string, step int64) error
+	DeleteTOTP(ctx context.Context, userID string) error
+
+	InsertMFAChallenge(ctx context.Context, c postgres.MFAChallenge) error
+	GetMFAChallenge(ctx context.Context, tokenHash string) (*postgres.MFAChallenge, error)
+	ClaimMFAChallengeAttempt(ctx context.Context, tokenHash string, maxAttempts int) (*postgres.MFAChallenge, error)
+	ConsumeMFAChallenge(ctx context.Context, tokenHash string) error
+
+	ReplaceRecoveryCodes(ctx context.Context, userID string, codeHashes []string) error
+	CountUnusedRecoveryCodes(ctx context.Context, userID string) (int, error)
+	UseRecoveryCode(ctx context.Context, userID, codeHash string) error
+	DeleteRecoveryCodes(ctx context.Context, userID string) error
+}
+
+type WebAuthnStore interface {
+	InsertWebAuthnCredential(ctx context.Context, c postgres.WebAuthnCredential) error
+	GetWebAuthnCredential(ctx context.Context, id string) (*postgres.WebAuthnCredential, error)
+	GetWebAuthnCredentials(ctx context.Context, userID string) ([]postgres.WebAuthnCredential, error)
+	UpdateWebAuthnSignCount(ctx context.Context, id string, signCount int64) error
+	DeleteWebAuthnCredential(ctx context.Context, userID, id string) error
+	InsertWebAuthnChallenge(ctx context.Context, c postgres.WebAuthnChallenge) error
+	ConsumeWebAuthnChallenge(ctx context.Context, challengeHash, ceremony string) (*postgres.WebAuthnChallenge, error)
+}
+
+// PasswordlessStore holds magic link redemptions and email login codes.
+type PasswordlessStore interface {
+	RedeemMagicLink(ctx context.Context, jti, userID string, expiresAt time.Time) error
+	UpsertEmailOTP(ctx context.Context, c postgres.EmailOTP, cooldown time.Duration, events ...postgres.OutboxEvent) error
+	ClaimEmailOTPAttempt(ctx context.Context, userID string, maxAttempts int) (string, error)
+	ConsumeEmailOTP(ctx context.Context, userID, codeHash string) error
+}
+
+type LockoutStore interface {
+	RecordFailedLogin(ctx context.Context, userID string, record func(l *postgres.AccountLockout, now time.Time) *time.Time) (*time.Time, error)
+	ResetFailedLogins(ctx context.Context, userID string) error
+	GetLockedUntil(ctx context.Context, userID string) (*time.Time, error)
+}
+
+// OutboxStore is read by the outbox relay. Events are written along with the
+// changes they announce, such as by InsertUser. InsertOutboxEvents queues
+// events that announce no stored change, such as a stateless magic link.
+type OutboxStore interface {
+	InsertOutboxEvents(ctx context.Context, events ...postgres.OutboxEvent) error
+	RelayOutboxEvents(ctx context.Context, limit, maxAttempts int, publish func(postgres.OutboxEvent) error) (int, error)
+}
+
+// RevocationStore rejects access tokens before they expire, either a single
+// token by its jti or every token of a user issued before a cutoff.
+// ResetPassword and UpdatePasswordAndRevokeSessions store such a cutoff as
+// part of their change.
+type RevocationStore interface {
+	Revoke(ctx context.Context, jti, userID string, expiresAt time.Time) error
+	RevokeSessions(ctx context.Context, userID string, revokedBefore time.Time) error
+	IsRevoked(ctx context.Context, jti, userID string, issuedAt time.Time) (bool, error)
+}
+
+// AuditStore holds the audit log of authentication events.
+type AuditStore interface {
+	InsertAuthEvent(ctx context.Context, e postgres.AuthEvent) error
+	GetAuthEvents(ctx context.Context, f postgres.AuthEventFilter) ([]postgres.AuthEvent, error)
+}
+
+// Store is every store AuthHandler uses.
+type Store interface {
+	UserStore
+	RefreshTokenStore
+	VerificationStore
+	MFAStore
+	WebAuthnStore
+	PasswordlessStore
+	LockoutStore
+	RevocationStore
+	AuditStore
+	OutboxStore
+}
+
+var (
+	_ Store = (*postgres.PostgresConn)(nil)
+	_ Store = (*MemoryStore)(nil)
+)
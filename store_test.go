@@ -0,0 +1,904 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Developer-s-Foundry/df-2.0-aima-auth-service/database/postgres"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+// TestPostgresStore runs the suite against the database at
+// TEST_DATABASE_URL, migrating it first. Every test works on users of its
+// own, so the database may be shared and reused.
+func TestPostgresStore(t *testing.T) {
+	uri := os.Getenv("TEST_DATABASE_URL")
+	if uri == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	ctx := context.Background()
+	pool, err := pgxpool.New(ctx, uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+
+	db := postgres.NewPostgresConn(pool)
+	if _, err := db.MigrateUp(ctx); err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, db)
+}
+
+// testStore is the conformance suite every Store has to pass.
+func testStore(t *testing.T, s Store) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s Store)
+	}{
+		{"Users", testStoreUsers},
+		{"Usernames", testStoreUsernames},
+		{"Passwords", testStorePasswords},
+		{"RefreshTokens", testStoreRefreshTokens},
+		{"EmailVerification", testStoreEmailVerification},
+		{"PasswordReset", testStorePasswordReset},
+		{"TOTP", testStoreTOTP},
+		{"MFAChallenges", testStoreMFAChallenges},
+		{"RecoveryCodes", testStoreRecoveryCodes},
+		{"WebAuthn", testStoreWebAuthn},
+		{"Passwordless", testStorePasswordless},
+		{"Lockout", testStoreLockout},
+		{"Revocation", testStoreRevocation},
+		{"Outbox", testStoreOutbox},
+		{"AuthEvents", testStoreAuthEvents},
+		{"ConcurrentWrites", testStoreConcurrentWrites},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) { tt.fn(t, s) })
+	}
+}
+
+func wantErr(t *testing.T, err, want error) {
+	t.Helper()
+	if !errors.Is(err, want) {
+		t.Fatalf("got error %v, want %v", err, want)
+	}
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestUser stores a user with a unique ID and email.
+func newTestUser(t *testing.T, s Store) *postgres.User {
+	t.Helper()
+	id := uuid.NewString()
+	must(t, s.InsertUser(postgres.User{UserID: id, Email: id + "@example.com", HashedPassword: "hash"}, nil))
+
+	u, err := s.GetUserByID(context.Background(), id)
+	must(t, err)
+	return u
+}
+
+func testStoreUsers(t *testing.T, s Store) {
+	ctx := context.Background()
+	u := newTestUser(t, s)
+
+	if u.EmailVerified || u.Username != nil || u.PasswordBreachedAt != nil || u.CreatedAt.IsZero() {
+		t.Fatalf("new user has unexpected state %+v", u)
+	}
+
+	got, err := s.GetUser(ctx, strings.ToUpper(u.Email))
+	must(t, err)
+	if got.UserID != u.UserID {
+		t.Fatalf("GetUser returned %s, want %s", got.UserID, u.UserID)
+	}
+
+	err = s.InsertUser(postgres.User{UserID: uuid.NewString(), Email: strings.ToUpper(u.Email), HashedPassword: "hash"}, nil)
+	wantErr(t, err, postgres.ErrUserExists)
+	err = s.InsertUser(postgres.User{UserID: u.UserID, Email: uuid.NewString() + "@example.com", HashedPassword: "hash"}, nil)
+	wantErr(t, err, postgres.ErrUserExists)
+
+	_, err = s.GetUser(ctx, uuid.NewString()+"@example.com")
+	wantErr(t, err, postgres.ErrInvalidUser)
+	_, err = s.GetUserByID(ctx, uuid.NewString())
+	wantErr(t, err, postgres.ErrInvalidUser)
+	_, err = s.GetUserByUsername(ctx, "nobody"+uuid.NewString()[:8])
+	wantErr(t, err, postgres.ErrInvalidUser)
+
+	// the stored user must not change through a returned copy
+	got.Email = "changed@example.com"
+	again, err := s.GetUserByID(ctx, u.UserID)
+	must(t, err)
+	if again.Email != u.Email {
+		t.Fatal("changing a returned user changed the stored one")
+	}
+}
+
+func testStoreUsernames(t *testing.T, s Store) {
+	ctx := context.Background()
+	a, b := newTestUser(t, s), newTestUser(t, s)
+	name := "User" + uuid.NewString()[:8]
+
+	previous, err := s.UpdateUsername(ctx, a.UserID, name)
+	must(t, err)
+	if previous != "" {
+		t.Fatalf("previous username %q, want none", previous)
+	}
+
+	got, err := s.GetUserByUsername(ctx, strings.ToLower(name))
+	must(t, err)
+	if got.UserID != a.UserID || got.Username == nil || *got.Username != name {
+		t.Fatalf("GetUserByUsername returned %+v", got)
+	}
+
+	_, err = s.UpdateUsername(ctx, b.UserID, strings.ToUpper(name))
+	wantErr(t, err, postgres.ErrUsernameTaken)
+
+	// changing only the case of one's own username is allowed
+	previous, err = s.UpdateUsername(ctx, a.UserID, strings.ToLower(name))
+	must(t, err)
+	if previous != name {
+		t.Fatalf("previous username %q, want %q", previous, name)
+	}
+
+	previous, err = s.UpdateUsername(ctx, a.UserID, "")
+	must(t, err)
+	if previous != strings.ToLower(name) {
+		t.Fatalf("previous username %q, want %q", previous, strings.ToLower(name))
+	}
+	_, err = s.GetUserByUsername(ctx, name)
+	wantErr(t, err, postgres.ErrInvalidUser)
+
+	// a removed username is free again
+	_, err = s.UpdateUsername(ctx, b.UserID, name)
+	must(t, err)
+
+	_, err = s.UpdateUsername(ctx, uuid.NewString(), "")
+	wantErr(t, err, postgres.ErrInvalidUser)
+}
+
+func testStorePasswords(t *testing.T, s Store) {
+	ctx := context.Background()
+	u := newTestUser(t, s)
+
+	flaggedAt, err := s.FlagBreachedPassword(ctx, u.UserID)
+	must(t, err)
+	if flaggedAt == nil {
+		t.Fatal("first FlagBreachedPassword returned nil")
+	}
+	flaggedAt, err = s.FlagBreachedPassword(ctx, u.UserID)
+	must(t, err)
+	if flaggedAt != nil {
+		t.Fatal("second FlagBreachedPassword flagged again")
+	}
+
+	must(t, s.UpgradePasswordHash(ctx, u.UserID, "stale", "upgraded"))
+	got, err := s.GetUserByID(ctx, u.UserID)
+	must(t, err)
+	if got.HashedPassword != "hash" {
+		t.Fatal("UpgradePasswordHash replaced a hash that changed meanwhile")
+	}
+	must(t, s.UpgradePasswordHash(ctx, u.UserID, "hash", "upgraded"))
+	got, err = s.GetUserByID(ctx, u.UserID)
+	must(t, err)
+	if got.HashedPassword != "upgraded" || got.PasswordBreachedAt == nil {
+		t.Fatalf("after UpgradePasswordHash got %+v", got)
+	}
+
+	must(t, s.UpdatePassword(ctx, u.UserID, "new"))
+	got, err = s.GetUserByID(ctx, u.UserID)
+	must(t, err)
+	if got.HashedPassword != "new" || got.PasswordBreachedAt != nil {
+		t.Fatalf("after UpdatePassword got %+v", got)
+	}
+
+	wantErr(t, s.UpdatePassword(ctx, uuid.NewString(), "new"), postgres.ErrInvalidUser)
+
+	refresh := newTestRefreshToken(u.UserID, uuid.NewString())
+	must(t, s.InsertRefreshToken(ctx, refresh))
+	must(t, s.UpdatePasswordAndRevokeSessions(ctx, u.UserID, "changed", time.Now()))
+	got, err = s.GetUserByID(ctx, u.UserID)
+	must(t, err)
+	if got.HashedPassword != "changed" {
+		t.Fatalf("after UpdatePasswordAndRevokeSessions got %+v", got)
+	}
+	rt, err := s.GetRefreshToken(ctx, refresh.TokenHash)
+	must(t, err)
+	if rt.RevokedAt == nil {
+		t.Fatal("UpdatePasswordAndRevokeSessions left a refresh token live")
+	}
+
+	wantErr(t, s.UpdatePasswordAndRevokeSessions(ctx, uuid.NewString(), "new", time.Now()), postgres.ErrInvalidUser)
+}
+
+func newTestRefreshToken(userID, familyID string) postgres.RefreshToken {
+	return postgres.RefreshToken{
+		ID:        uuid.NewString(),
+		UserID:    userID,
+		FamilyID:  familyID,
+		TokenHash: uuid.NewString(),
+		ExpiresAt: time.Now().Add(time.Hour),
+	}
+}
+
+func testStoreRefreshTokens(t *testing.T, s Store) {
+	ctx := context.Background()
+	u := newTestUser(t, s)
+	family := uuid.NewString()
+
+	first := newTestRefreshToken(u.UserID, family)
+	must(t, s.InsertRefreshToken(ctx, first))
+	if err := s.InsertRefreshToken(ctx, first); err == nil {
+		t.Fatal("inserting a refresh token twice succeeded")
+	}
+
+	got, err := s.GetRefreshToken(ctx, first.TokenHash)
+	must(t, err)
+	if got.ID != first.ID || got.FamilyID != family || got.RotatedAt != nil || got.RevokedAt != nil {
+		t.Fatalf("GetRefreshToken returned %+v", got)
+	}
+	_, err = s.GetRefreshToken(ctx, uuid.NewString())
+	wantErr(t, err, postgres.ErrInvalidRefreshToken)
+
+	second := newTestRefreshToken(u.UserID, family)
+	must(t, s.RotateRefreshToken(ctx, first.ID, second))
+	got, err = s.GetRefreshToken(ctx, first.TokenHash)
+	must(t, err)
+	if got.RotatedAt == nil {
+		t.Fatal("rotated token has no rotated_at")
+	}
+
+	// a replayed token must not mint another one
+	third := newTestRefreshToken(u.UserID, family)
+	wantErr(t, s.RotateRefreshToken(ctx, first.ID, third), postgres.ErrRefreshTokenReused)
+	_, err = s.GetRefreshToken(ctx, third.TokenHash)
+	wantErr(t, err, postgres.ErrInvalidRefreshToken)
+
+	must(t, s.RevokeRefreshTokenFamily(ctx, family))
+	wantErr(t, s.RotateRefreshToken(ctx, second.ID, third), postgres.ErrRefreshTokenReused)
+
+	other := newTestRefreshToken(u.UserID, uuid.NewString())
+	must(t, s.InsertRefreshToken(ctx, other))
+	must(t, s.RevokeUserRefreshTokens(ctx, u.UserID))
+	got, err = s.GetRefreshToken(ctx, other.TokenHash)
+	must(t, err)
+	if got.RevokedAt == nil {
+		t.Fatal("RevokeUserRefreshTokens left a token live")
+	}
+}
+
+func testStoreEmailVerification(t *testing.T, s Store) {
+	ctx := context.Background()
+	u := newTestUser(t, s)
+
+	sentAt, err := s.GetLastEmailVerificationSentAt(ctx, u.UserID)
+	must(t, err)
+	if !sentAt.IsZero() {
+		t.Fatalf("no token sent yet, got %v", sentAt)
+	}
+
+	expired := postgres.EmailVerificationToken{TokenHash: uuid.NewString(), UserID: u.UserID, ExpiresAt: time.Now().Add(-time.Minute)}
+	first := postgres.EmailVerificationToken{TokenHash: uuid.NewString(), UserID: u.UserID, ExpiresAt: time.Now().Add(time.Hour)}
+	second := postgres.EmailVerificationToken{TokenHash: uuid.NewString(), UserID: u.UserID, ExpiresAt: time.Now().Add(time.Hour)}
+	for _, token := range []postgres.EmailVerificationToken{expired, first, second} {
+		must(t, s.InsertEmailVerificationToken(ctx, token))
+	}
+
+	sentAt, err = s.GetLastEmailVerificationSentAt(ctx, u.UserID)
+	must(t, err)
+	if sentAt.IsZero() {
+		t.Fatal("GetLastEmailVerificationSentAt returned the zero time")
+	}
+
+	_, err = s.VerifyEmail(ctx, expired.TokenHash)
+	wantErr(t, err, postgres.ErrInvalidVerificationToken)
+
+	userID, err := s.VerifyEmail(ctx, first.TokenHash)
+	must(t, err)
+	if userID != u.UserID {
+		t.Fatalf("VerifyEmail returned %s, want %s", userID, u.UserID)
+	}
+	got, err := s.GetUserByID(ctx, u.UserID)
+	must(t, err)
+	if !got.EmailVerified || got.EmailVerifiedAt == nil {
+		t.Fatal("VerifyEmail did not mark the email as verified")
+	}
+
+	// verifying burns every other token of the user
+	_, err = s.VerifyEmail(ctx, first.TokenHash)
+	wantErr(t, err, postgres.ErrInvalidVerificationToken)
+	_, err = s.VerifyEmail(ctx, second.TokenHash)
+	wantErr(t, err, postgres.ErrInvalidVerificationToken)
+}
+
+func testStorePasswordReset(t *testing.T, s Store) {
+	ctx := context.Background()
+	u := newTestUser(t, s)
+
+	_, err := s.GetPasswordResetToken(ctx, uuid.NewString())
+	wantErr(t, err, postgres.ErrInvalidResetToken)
+
+	token := postgres.PasswordResetToken{TokenHash: uuid.NewString(), UserID: u.UserID, ExpiresAt: time.Now().Add(time.Hour)}
+	other := postgres.PasswordResetToken{TokenHash: uuid.NewString(), UserID: u.UserID, ExpiresAt: time.Now().Add(time.Hour)}
+	must(t, s.InsertPasswordResetToken(ctx, token))
+	must(t, s.InsertPasswordResetToken(ctx, other))
+
+	got, err := s.GetPasswordResetToken(ctx, token.TokenHash)
+	must(t, err)
+	if got.UserID != u.UserID || got.UsedAt != nil {
+		t.Fatalf("GetPasswordResetToken returned %+v", got)
+	}
+
+	refresh := newTestRefreshToken(u.UserID, uuid.NewString())
+	must(t, s.InsertRefreshToken(ctx, refresh))
+	_, err = s.FlagBreachedPassword(ctx, u.UserID)
+	must(t, err)
+
+	userID, err := s.ResetPassword(ctx, token.TokenHash, "reset", time.Now())
+	must(t, err)
+	if userID != u.UserID {
+		t.Fatalf("ResetPassword returned %s, want %s", userID, u.UserID)
+	}
+
+	user, err := s.GetUserByID(ctx, u.UserID)
+	must(t, err)
+	if user.HashedPassword != "reset" || user.PasswordBreachedAt != nil {
+		t.Fatalf("after ResetPassword got %+v", user)
+	}
+	rt, err := s.GetRefreshToken(ctx, refresh.TokenHash)
+	must(t, err)
+	if rt.RevokedAt == nil {
+		t.Fatal("ResetPassword left a refresh token live")
+	}
+
+	_, err = s.ResetPassword(ctx, token.TokenHash, "again", time.Now())
+	wantErr(t, err, postgres.ErrInvalidResetToken)
+	_, err = s.ResetPassword(ctx, other.TokenHash, "again", time.Now())
+	wantErr(t, err, postgres.ErrInvalidResetToken)
+
+	expired := postgres.PasswordResetToken{TokenHash: uuid.NewString(), UserID: u.UserID, ExpiresAt: time.Now().Add(-time.Minute)}
+	must(t, s.InsertPasswordResetToken(ctx, expired))
+	_, err = s.ResetPassword(ctx, expired.TokenHash, "again", time.Now())
+	wantErr(t, err, postgres.ErrInvalidResetToken)
+}
+
+func testStoreTOTP(t *testing.T, s Store) {
+	ctx := context.Background()
+	u := newTestUser(t, s)
+
+	_, err := s.GetTOTP(ctx, u.UserID)
+	wantErr(t, err, postgres.ErrTOTPNotFound)
+	wantErr(t, s.UseTOTPStep(ctx, u.UserID, 1), postgres.ErrTOTPCodeReused)
+
+	must(t, s.UpsertPendingTOTP(ctx, u.UserID, []byte("first")))
+	must(t, s.UpsertPendingTOTP(ctx, u.UserID, []byte("second")))
+	c, err := s.GetTOTP(ctx, u.UserID)
+	must(t, err)
+	if string(c.Secret) != "second" || c.ConfirmedAt != nil {
+		t.Fatalf("GetTOTP returned %+v", c)
+	}
+
+	// codes are only accepted once the authenticator is confirmed
+	wantErr(t, s.UseTOTPStep(ctx, u.UserID, 5), postgres.ErrTOTPCodeReused)
+
+	must(t, s.ConfirmTOTP(ctx, u.UserID, 10))
+	wantErr(t, s.ConfirmTOTP(ctx, u.UserID, 11), postgres.ErrTOTPNotFound)
+	wantErr(t, s.UpsertPendingTOTP(ctx, u.UserID, []byte("third")), postgres.ErrTOTPAlreadyEnabled)
+
+	wantErr(t, s.UseTOTPStep(ctx, u.UserID, 10), postgres.ErrTOTPCodeReused)
+	must(t, s.UseTOTPStep(ctx, u.UserID, 11))
+	wantErr(t, s.UseTOTPStep(ctx, u.UserID, 11), postgres.ErrTOTPCodeReused)
+	wantErr(t, s.UseTOTPStep(ctx, u.UserID, 9), postgres.ErrTOTPCodeReused)
+
+	must(t, s.DeleteTOTP(ctx, u.UserID))
+	_, err = s.GetTOTP(ctx, u.UserID)
+	wantErr(t, err, postgres.ErrTOTPNotFound)
+	must(t, s.UpsertPendingTOTP(ctx, u.UserID, []byte("fourth")))
+}
+
+func testStoreMFAChallenges(t *testing.T, s Store) {
+	ctx := context.Background()
+	u := newTestUser(t, s)
+
+	_, err := s.GetMFAChallenge(ctx, uuid.NewString())
+	wantErr(t, err, postgres.ErrInvalidMFAChallenge)
+
+	c := postgres.MFAChallenge{TokenHash: uuid.NewString(), UserID: u.UserID, Nonce: "nonce", ExpiresAt: time.Now().Add(time.Minute)}
+	must(t, s.InsertMFAChallenge(ctx, c))
+
+	for want := 1; want <= 2; want++ {
+		claimed, err := s.ClaimMFAChallengeAttempt(ctx, c.TokenHash, 3)
+		must(t, err)
+		if claimed.UserID != u.UserID || claimed.Attempts != want {
+			t.Fatalf("ClaimMFAChallengeAttempt returned %+v, want %d attempts", claimed, want)
+		}
+	}
+
+	got, err := s.GetMFAChallenge(ctx, c.TokenHash)
+	must(t, err)
+	if got.UserID != u.UserID || got.Nonce != "nonce" || got.Attempts != 2 || got.ConsumedAt != nil {
+		t.Fatalf("GetMFAChallenge returned %+v", got)
+	}
+
+	must(t, s.ConsumeMFAChallenge(ctx, c.TokenHash))
+	wantErr(t, s.ConsumeMFAChallenge(ctx, c.TokenHash), postgres.ErrInvalidMFAChallenge)
+	_, err = s.ClaimMFAChallengeAttempt(ctx, c.TokenHash, 3)
+	wantErr(t, err, postgres.ErrInvalidMFAChallenge)
+
+	exhausted := postgres.MFAChallenge{TokenHash: uuid.NewString(), UserID: u.UserID, ExpiresAt: time.Now().Add(time.Minute)}
+	must(t, s.InsertMFAChallenge(ctx, exhausted))
+	_, err = s.ClaimMFAChallengeAttempt(ctx, exhausted.TokenHash, 1)
+	must(t, err)
+	_, err = s.ClaimMFAChallengeAttempt(ctx, exhausted.TokenHash, 1)
+	wantErr(t, err, postgres.ErrInvalidMFAChallenge)
+
+	expired := postgres.MFAChallenge{TokenHash: uuid.NewString(), UserID: u.UserID, ExpiresAt: time.Now().Add(-time.Minute)}
+	must(t, s.InsertMFAChallenge(ctx, expired))
+	_, err = s.ClaimMFAChallengeAttempt(ctx, expired.TokenHash, 3)
+	wantErr(t, err, postgres.ErrInvalidMFAChallenge)
+	wantErr(t, s.ConsumeMFAChallenge(ctx, expired.TokenHash), postgres.ErrInvalidMFAChallenge)
+}
+
+func testStoreRecoveryCodes(t *testing.T, s Store) {
+	ctx := context.Background()
+	u := newTestUser(t, s)
+
+	must(t, s.ReplaceRecoveryCodes(ctx, u.UserID, []string{"a", "b", "c"}))
+	must(t, s.UseRecoveryCode(ctx, u.UserID, "a"))
+	wantErr(t, s.UseRecoveryCode(ctx, u.UserID, "a"), postgres.ErrInvalidRecoveryCode)
+	wantErr(t, s.UseRecoveryCode(ctx, u.UserID, "z"), postgres.ErrInvalidRecoveryCode)
+
+	count, err := s.CountUnusedRecoveryCodes(ctx, u.UserID)
+	must(t, err)
+	if count != 2 {
+		t.Fatalf("unused recovery codes %d, want 2", count)
+	}
+
+	// a new set replaces the old one entirely
+	must(t, s.ReplaceRecoveryCodes(ctx, u.UserID, []string{"a", "d"}))
+	must(t, s.UseRecoveryCode(ctx, u.UserID, "a"))
+	wantErr(t, s.UseRecoveryCode(ctx, u.UserID, "b"), postgres.ErrInvalidRecoveryCode)
+
+	must(t, s.DeleteRecoveryCodes(ctx, u.UserID))
+	count, err = s.CountUnusedRecoveryCodes(ctx, u.UserID)
+	must(t, err)
+	if count != 0 {
+		t.Fatalf("unused recovery codes %d after delete, want 0", count)
+	}
+}
+
+func testStoreWebAuthn(t *testing.T, s Store) {
+	ctx := context.Background()
+	u, other := newTestUser(t, s), newTestUser(t, s)
+
+	first := postgres.WebAuthnCredential{ID: uuid.NewString(), UserID: u.UserID, Name: "first", PublicKey: []byte("key")}
+	second := postgres.WebAuthnCredential{ID: uuid.NewString(), UserID: u.UserID, Name: "second", PublicKey: []byte("key"), SignCount: 5}
+	must(t, s.InsertWebAuthnCredential(ctx, first))
+	time.Sleep(time.Millisecond)
+	must(t, s.InsertWebAuthnCredential(ctx, second))
+	wantErr(t, s.InsertWebAuthnCredential(ctx, first), postgres.ErrWebAuthnCredentialExists)
+
+	credentials, err := s.GetWebAuthnCredentials(ctx, u.UserID)
+	must(t, err)
+	if len(credentials) != 2 || credentials[0].ID != first.ID || credentials[1].ID != second.ID {
+		t.Fatalf("GetWebAuthnCredentials returned %+v", credentials)
+	}
+	_, err = s.GetWebAuthnCredential(ctx, uuid.NewString())
+	wantErr(t, err, postgres.ErrWebAuthnCredentialNotFound)
+
+	// counterless authenticators keep reporting zero
+	must(t, s.UpdateWebAuthnSignCount(ctx, first.ID, 0))
+	must(t, s.UpdateWebAuthnSignCount(ctx, first.ID, 0))
+	must(t, s.UpdateWebAuthnSignCount(ctx, second.ID, 6))
+	wantErr(t, s.UpdateWebAuthnSignCount(ctx, second.ID, 6), postgres.ErrWebAuthnSignCount)
+	wantErr(t, s.UpdateWebAuthnSignCount(ctx, second.ID, 0), postgres.ErrWebAuthnSignCount)
+
+	got, err := s.GetWebAuthnCredential(ctx, second.ID)
+	must(t, err)
+	if got.SignCount != 6 || got.LastUsedAt == nil {
+		t.Fatalf("GetWebAuthnCredential returned %+v", got)
+	}
+
+	wantErr(t, s.DeleteWebAuthnCredential(ctx, other.UserID, first.ID), postgres.ErrWebAuthnCredentialNotFound)
+	must(t, s.DeleteWebAuthnCredential(ctx, u.UserID, first.ID))
+	_, err = s.GetWebAuthnCredential(ctx, first.ID)
+	wantErr(t, err, postgres.ErrWebAuthnCredentialNotFound)
+
+	challenge := postgres.WebAuthnChallenge{
+		ChallengeHash: uuid.NewString(),
+		Ceremony:      postgres.WebAuthnCeremonyLogin,
+		Nonce:         "nonce",
+		ExpiresAt:     time.Now().Add(time.Minute),
+	}
+	must(t, s.InsertWebAuthnChallenge(ctx, challenge))
+	_, err = s.ConsumeWebAuthnChallenge(ctx, challenge.ChallengeHash, postgres.WebAuthnCeremonyRegistration)
+	wantErr(t, err, postgres.ErrInvalidWebAuthnChallenge)
+
+	c, err := s.ConsumeWebAuthnChallenge(ctx, challenge.ChallengeHash, postgres.WebAuthnCeremonyLogin)
+	must(t, err)
+	if c.UserID != "" || c.Nonce != "nonce" {
+		t.Fatalf("ConsumeWebAuthnChallenge returned %+v", c)
+	}
+	_, err = s.ConsumeWebAuthnChallenge(ctx, challenge.ChallengeHash, postgres.WebAuthnCeremonyLogin)
+	wantErr(t, err, postgres.ErrInvalidWebAuthnChallenge)
+
+	expired := postgres.WebAuthnChallenge{
+		ChallengeHash: uuid.NewString(),
+		UserID:        u.UserID,
+		Ceremony:      postgres.WebAuthnCeremonyMFA,
+		ExpiresAt:     time.Now().Add(-time.Minute),
+	}
+	must(t, s.InsertWebAuthnChallenge(ctx, expired))
+	_, err = s.ConsumeWebAuthnChallenge(ctx, expired.ChallengeHash, postgres.WebAuthnCeremonyMFA)
+	wantErr(t, err, postgres.ErrInvalidWebAuthnChallenge)
+}
+
+func testStorePasswordless(t *testing.T, s Store) {
+	ctx := context.Background()
+	u := newTestUser(t, s)
+
+	jti := uuid.NewString()
+	must(t, s.RedeemMagicLink(ctx, jti, u.UserID, time.Now().Add(time.Minute)))
+	wantErr(t, s.RedeemMagicLink(ctx, jti, u.UserID, time.Now().Add(time.Minute)), postgres.ErrMagicLinkUsed)
+
+	_, err := s.ClaimEmailOTPAttempt(ctx, u.UserID, 3)
+	wantErr(t, err, postgres.ErrInvalidEmailOTP)
+
+	otp := postgres.EmailOTP{UserID: u.UserID, CodeHash: "first", ExpiresAt: time.Now().Add(time.Minute)}
+	must(t, s.UpsertEmailOTP(ctx, otp, time.Minute))
+	otp.CodeHash = "second"
+	wantErr(t, s.UpsertEmailOTP(ctx, otp, time.Minute), postgres.ErrEmailOTPCooldown)
+	must(t, s.UpsertEmailOTP(ctx, otp, 0))
+
+	for range 3 {
+		codeHash, err := s.ClaimEmailOTPAttempt(ctx, u.UserID, 3)
+		must(t, err)
+		if codeHash != "second" {
+			t.Fatalf("claimed code %q, want the newest", codeHash)
+		}
+	}
+	_, err = s.ClaimEmailOTPAttempt(ctx, u.UserID, 3)
+	wantErr(t, err, postgres.ErrInvalidEmailOTP)
+
+	// a new code starts with fresh attempts
+	otp.CodeHash = "third"
+	must(t, s.UpsertEmailOTP(ctx, otp, 0))
+	_, err = s.ClaimEmailOTPAttempt(ctx, u.UserID, 3)
+	must(t, err)
+
+	wantErr(t, s.ConsumeEmailOTP(ctx, u.UserID, "second"), postgres.ErrInvalidEmailOTP)
+	must(t, s.ConsumeEmailOTP(ctx, u.UserID, "third"))
+	wantErr(t, s.ConsumeEmailOTP(ctx, u.UserID, "third"), postgres.ErrInvalidEmailOTP)
+
+	expired := postgres.EmailOTP{UserID: u.UserID, CodeHash: "expired", ExpiresAt: time.Now().Add(-time.Minute)}
+	must(t, s.UpsertEmailOTP(ctx, expired, 0))
+	_, err = s.ClaimEmailOTPAttempt(ctx, u.UserID, 3)
+	wantErr(t, err, postgres.ErrInvalidEmailOTP)
+}
+
+func testStoreLockout(t *testing.T, s Store) {
+	ctx := context.Background()
+	u := newTestUser(t, s)
+	policy := LockoutPolicy{Threshold: 3, Window: time.Hour, BaseDuration: time.Minute, MaxDuration: time.Hour}
+
+	lockedUntil, err := s.GetLockedUntil(ctx, u.UserID)
+	must(t, err)
+	if lockedUntil != nil {
+		t.Fatal("new user is locked")
+	}
+
+	for i := 1; i <= 2; i++ {
+		lockedUntil, err := s.RecordFailedLogin(ctx, u.UserID, policy.RecordFailure)
+		must(t, err)
+		if lockedUntil != nil {
+			t.Fatalf("failure %d locked the account", i)
+		}
+	}
+	lockedUntil, err = s.RecordFailedLogin(ctx, u.UserID, policy.RecordFailure)
+	must(t, err)
+	if lockedUntil == nil || time.Until(*lockedUntil) > time.Minute {
+		t.Fatalf("third failure locked until %v, want a minute from now", lockedUntil)
+	}
+
+	stored, err := s.GetLockedUntil(ctx, u.UserID)
+	must(t, err)
+	if stored == nil || !stored.Equal(*lockedUntil) {
+		t.Fatalf("GetLockedUntil returned %v, want %v", stored, lockedUntil)
+	}
+
+	// a failure that does not lock keeps the current lock
+	_, err = s.RecordFailedLogin(ctx, u.UserID, policy.RecordFailure)
+	must(t, err)
+	stored, err = s.GetLockedUntil(ctx, u.UserID)
+	must(t, err)
+	if stored == nil {
+		t.Fatal("a later failure lifted the lock")
+	}
+
+	must(t, s.ResetFailedLogins(ctx, u.UserID))
+	stored, err = s.GetLockedUntil(ctx, u.UserID)
+	must(t, err)
+	if stored != nil {
+		t.Fatal("ResetFailedLogins left the account locked")
+	}
+}
+
+func testStoreRevocation(t *testing.T, s Store) {
+	ctx := context.Background()
+	u := newTestUser(t, s)
+	now := time.Now().Truncate(time.Second)
+
+	isRevoked := func(jti, userID string, issuedAt time.Time) bool {
+		t.Helper()
+		revoked, err := s.IsRevoked(ctx, jti, userID, issuedAt)
+		must(t, err)
+		return revoked
+	}
+
+	jti, expired := uuid.NewString(), uuid.NewString()
+	if isRevoked(jti, u.UserID, now) {
+		t.Fatal("token revoked before Revoke")
+	}
+	must(t, s.Revoke(ctx, jti, u.UserID, now.Add(time.Hour)))
+	must(t, s.Revoke(ctx, jti, u.UserID, now.Add(time.Hour)))
+	must(t, s.Revoke(ctx, expired, u.UserID, now.Add(-time.Minute)))
+	if !isRevoked(jti, u.UserID, now) {
+		t.Fatal("Revoke did not revoke the token")
+	}
+	if isRevoked(expired, u.UserID, now) || isRevoked(uuid.NewString(), u.UserID, now) {
+		t.Fatal("expired or unknown jti reported revoked")
+	}
+
+	must(t, s.RevokeSessions(ctx, u.UserID, now))
+	// an earlier cutoff does not replace a later one
+	must(t, s.RevokeSessions(ctx, u.UserID, now.Add(-time.Hour)))
+	if !isRevoked(uuid.NewString(), u.UserID, now.Add(-time.Second)) {
+		t.Fatal("token issued before the cutoff not revoked")
+	}
+	if isRevoked(uuid.NewString(), u.UserID, now) {
+		t.Fatal("token issued at the cutoff revoked")
+	}
+
+	// password changes that end all sessions store the cutoff with the change
+	other := newTestUser(t, s)
+	must(t, s.UpdatePasswordAndRevokeSessions(ctx, other.UserID, "changed", now))
+	if !isRevoked(uuid.NewString(), other.UserID, now.Add(-time.Second)) {
+		t.Fatal("UpdatePasswordAndRevokeSessions did not revoke older tokens")
+	}
+
+	reset := newTestUser(t, s)
+	token := postgres.PasswordResetToken{TokenHash: uuid.NewString(), UserID: reset.UserID, ExpiresAt: time.Now().Add(time.Hour)}
+	must(t, s.InsertPasswordResetToken(ctx, token))
+	_, err := s.ResetPassword(ctx, token.TokenHash, "reset", now)
+	must(t, err)
+	if !isRevoked(uuid.NewString(), reset.UserID, now.Add(-time.Second)) {
+		t.Fatal("ResetPassword did not revoke older tokens")
+	}
+	if isRevoked(uuid.NewString(), u.UserID+"-other", now.Add(-time.Second)) {
+		t.Fatal("cutoff applied to another user")
+	}
+}
+
+func testStoreOutbox(t *testing.T, s Store) {
+	ctx := context.Background()
+
+	// other tests may have left events behind in a shared database, only the
+	// ones marked with this run count
+	marker := uuid.NewString()
+	event := func(n int) postgres.OutboxEvent {
+		return postgres.OutboxEvent{
+			Exchange:   "test.exchange",
+			RoutingKey: "test.queue",
+			Payload:    []byte(fmt.Sprintf(`{"marker": %q, "n": %d}`, marker, n)),
+		}
+	}
+
+	id := uuid.NewString()
+	email := id + "@example.com"
+	verification := postgres.EmailVerificationToken{TokenHash: uuid.NewString(), UserID: id, ExpiresAt: time.Now().Add(time.Hour)}
+	must(t, s.InsertUser(postgres.User{UserID: id, Email: email, HashedPassword: "hash"}, &verification, event(1), event(2)))
+
+	// nothing of a failed insert is kept
+	err := s.InsertUser(postgres.User{UserID: uuid.NewString(), Email: email, HashedPassword: "hash"}, nil, event(99))
+	wantErr(t, err, postgres.ErrUserExists)
+
+	userID, err := s.VerifyEmail(ctx, verification.TokenHash)
+	must(t, err)
+	if userID != id {
+		t.Fatalf("VerifyEmail returned %s, want %s", userID, id)
+	}
+
+	var published []int
+	failOn, maxAttempts := 2, 5
+	publish := func(e postgres.OutboxEvent) error {
+		var payload struct {
+			Marker string `json:"marker"`
+			N      int    `json:"n"`
+		}
+		if err := json.Unmarshal(e.Payload, &payload); err != nil || payload.Marker != marker {
+			return nil
+		}
+		if e.Exchange != "test.exchange" || e.RoutingKey != "test.queue" {
+			t.Errorf("event %d went to %s/%s", payload.N, e.Exchange, e.RoutingKey)
+		}
+		if payload.N == failOn {
+			return errors.New("broker unavailable")
+		}
+		published = append(published, payload.N)
+		return nil
+	}
+	relay := func() error {
+		for {
+			sent, err := s.RelayOutboxEvents(ctx, 10, maxAttempts, publish)
+			if err != nil || sent < 10 {
+				return err
+			}
+		}
+	}
+
+	if err := relay(); err == nil {
+		t.Fatal("relay succeeded although publishing failed")
+	}
+
+	// a later event must wait for the failed one
+	resent := postgres.EmailVerificationToken{TokenHash: uuid.NewString(), UserID: id, ExpiresAt: time.Now().Add(time.Hour)}
+	must(t, s.InsertEmailVerificationToken(ctx, resent, event(3)))
+	reset := postgres.PasswordResetToken{TokenHash: uuid.NewString(), UserID: id, ExpiresAt: time.Now().Add(time.Hour)}
+	must(t, s.InsertPasswordResetToken(ctx, reset, event(4)))
+	must(t, s.InsertOutboxEvents(ctx, event(5)))
+	otp := postgres.EmailOTP{UserID: id, CodeHash: "hash", ExpiresAt: time.Now().Add(time.Hour)}
+	must(t, s.UpsertEmailOTP(ctx, otp, time.Hour, event(6)))
+	// a code kept by the cooldown is not mailed again
+	wantErr(t, s.UpsertEmailOTP(ctx, otp, time.Hour, event(99)), postgres.ErrEmailOTPCooldown)
+	if err := relay(); err == nil {
+		t.Fatal("relay succeeded although publishing failed")
+	}
+	if !slices.Equal(published, []int{1}) {
+		t.Fatalf("published %v while event 2 failed, want [1]", published)
+	}
+
+	failOn = 0
+	must(t, relay())
+	must(t, relay())
+	if !slices.Equal(published, []int{1, 2, 3, 4, 5, 6}) {
+		t.Fatalf("published %v, want [1 2 3 4 5 6] once each", published)
+	}
+
+	// an event that keeps failing is marked dead after maxAttempts and no
+	// longer holds up the ones behind it
+	must(t, s.InsertOutboxEvents(ctx, event(7), event(8)))
+	failOn = 7
+	if err := relay(); err == nil {
+		t.Fatal("relay succeeded although publishing failed")
+	}
+	maxAttempts = 2
+	must(t, relay())
+	failOn = 0
+	must(t, relay())
+	if !slices.Equal(published, []int{1, 2, 3, 4, 5, 6, 8}) {
+		t.Fatalf("published %v, want event 7 given up on and 8 sent", published)
+	}
+}
+
+func testStoreAuthEvents(t *testing.T, s Store) {
+	ctx := context.Background()
+	u := newTestUser(t, s)
+
+	events := []postgres.AuthEvent{
+		{Type: "register", Outcome: "success"},
+		{Type: "login", Outcome: "failure", Reason: "invalid_credentials", ClientIP: "192.0.2.1"},
+		{Type: "login", Outcome: "challenge", Reason: "mfa_required"},
+		{Type: "login_mfa", Outcome: "success", UserAgent: "test", ServiceName: "gateway", RequestID: "req-1"},
+		{Type: "logout", Outcome: "success"},
+	}
+	for _, e := range events {
+		e.UserID, e.Email = u.UserID, u.Email
+		must(t, s.InsertAuthEvent(ctx, e))
+	}
+
+	types := func(events []postgres.AuthEvent) []string {
+		var types []string
+		for _, e := range events {
+			types = append(types, e.Type)
+		}
+		return types
+	}
+
+	got, err := s.GetAuthEvents(ctx, postgres.AuthEventFilter{UserID: u.UserID, Limit: 10})
+	must(t, err)
+	if want := []string{"logout", "login_mfa", "login", "login", "register"}; !slices.Equal(types(got), want) {
+		t.Fatalf("GetAuthEvents returned %v, want %v", types(got), want)
+	}
+	if e := got[1]; e.Email != u.Email || e.UserAgent != "test" || e.ServiceName != "gateway" || e.RequestID != "req-1" || e.CreatedAt.IsZero() {
+		t.Fatalf("stored event has unexpected fields %+v", e)
+	}
+
+	got, err = s.GetAuthEvents(ctx, postgres.AuthEventFilter{Email: u.Email, Type: "login", Outcome: "failure", ClientIP: "192.0.2.1", Limit: 10})
+	must(t, err)
+	if len(got) != 1 || got[0].Reason != "invalid_credentials" {
+		t.Fatalf("filtered GetAuthEvents returned %+v, want the failed login", got)
+	}
+
+	// pages continue below the last ID of the previous one
+	var paged []postgres.AuthEvent
+	filter := postgres.AuthEventFilter{UserID: u.UserID, Limit: 2}
+	for {
+		page, err := s.GetAuthEvents(ctx, filter)
+		must(t, err)
+		paged = append(paged, page...)
+		if len(page) < filter.Limit {
+			break
+		}
+		filter.Before = page[len(page)-1].ID
+	}
+	if want := []string{"logout", "login_mfa", "login", "login", "register"}; !slices.Equal(types(paged), want) {
+		t.Fatalf("paging returned %v, want %v", types(paged), want)
+	}
+
+	got, err = s.GetAuthEvents(ctx, postgres.AuthEventFilter{UserID: u.UserID, Since: time.Now().Add(time.Hour), Limit: 10})
+	must(t, err)
+	if len(got) != 0 {
+		t.Fatalf("GetAuthEvents since an hour from now returned %d events", len(got))
+	}
+	got, err = s.GetAuthEvents(ctx, postgres.AuthEventFilter{UserID: u.UserID, Until: time.Now().Add(-time.Hour), Limit: 10})
+	must(t, err)
+	if len(got) != 0 {
+		t.Fatalf("GetAuthEvents until an hour ago returned %d events", len(got))
+	}
+}
+
+// testStoreConcurrentWrites races writers that only one of may win.
+func testStoreConcurrentWrites(t *testing.T, s Store) {
+	ctx := context.Background()
+	const writers = 8
+	email := uuid.NewString() + "@example.com"
+
+	u := newTestUser(t, s)
+	challenge := postgres.MFAChallenge{TokenHash: uuid.NewString(), UserID: u.UserID, ExpiresAt: time.Now().Add(time.Minute)}
+	must(t, s.InsertMFAChallenge(ctx, challenge))
+
+	var wg sync.WaitGroup
+	insertErrs := make([]error, writers)
+	consumeErrs := make([]error, writers)
+	for i := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			insertErrs[i] = s.InsertUser(postgres.User{UserID: uuid.NewString(), Email: email, HashedPassword: "hash"}, nil)
+			consumeErrs[i] = s.ConsumeMFAChallenge(ctx, challenge.TokenHash)
+		}()
+	}
+	wg.Wait()
+
+	for name, errs := range map[string][]error{"InsertUser": insertErrs, "ConsumeMFAChallenge": consumeErrs} {
+		won := 0
+		for _, err := range errs {
+			if err == nil {
+				won++
+			} else if !errors.Is(err, postgres.ErrUserExists) && !errors.Is(err, postgres.ErrInvalidMFAChallenge) {
+				t.Fatalf("%s: unexpected error %v", name, err)
+			}
+		}
+		if won != 1 {
+			t.Fatalf("%s succeeded %d times, want once", name, won)
+		}
+	}
+}
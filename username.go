@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Developer-s-Foundry/df-2.0-aima-auth-service/database/postgres"
+	"github.com/Developer-s-Foundry/df-2.0-aima-auth-service/database/rabbitmq"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	minUsernameLength = 3
+	maxUsernameLength = 30
+)
+
+// reservedUsernames cannot be claimed, as they could pass for the service or
+// its staff. USERNAMES_RESERVED adds more, separated by commas.
+var reservedUsernames = []string{
+	"admin", "administrator", "aimas", "api", "auth", "help", "info", "login",
+	"logout", "me", "mod", "moderator", "null", "register", "root", "security",
+	"staff", "support", "system", "undefined", "user", "username", "www",
+}
+
+var (
+	ErrUsernameLength   = errors.New("username must be between 3 and 30 characters long")
+	ErrUsernameCharset  = errors.New("username may only contain letters, digits, dots, hyphens and underscores, and must start and end with a letter or digit")
+	ErrUsernameReserved = errors.New("username is reserved")
+)
+
+// validateUsername checks a username against the length, charset and
+// reserved name rules. Usernames are ASCII and never contain "@", so that a
+// login identifier can always be told apart from an email address.
+func validateUsername(username string) error {
+	if len(username) < minUsernameLength || len(username) > maxUsernameLength {
+		return ErrUsernameLength
+	}
+
+	alnum := func(c byte) bool {
+		return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+	}
+	for i := 0; i < len(username); i++ {
+		c := username[i]
+		switch {
+		case alnum(c):
+		case c == '.' || c == '-' || c == '_':
+			// separators may not lead, trail or repeat
+			if i == 0 || i == len(username)-1 || !alnum(username[i-1]) {
+				return ErrUsernameCharset
+			}
+		default:
+			return ErrUsernameCharset
+		}
+	}
+
+	lower := strings.ToLower(username)
+	reserved := reservedUsernames
+	if extra := os.Getenv("USERNAMES_RESERVED"); extra != "" {
+		reserved = append(reserved[:len(reserved):len(reserved)], strings.Split(extra, ",")...)
+	}
+	for _, name := range reserved {
+		if lower == strings.ToLower(strings.TrimSpace(name)) {
+			return ErrUsernameReserved
+		}
+	}
+	return nil
+}
+
+// findLoginUser looks a user up by the identifier given at login, an email
+// address when it contains "@" and a username otherwise.
+func (h *AuthHandler) findLoginUser(r *http.Request, identifier string) (*postgres.User, error) {
+	if strings.Contains(identifier, "@") {
+		return h.DB.GetUser(r.Context(), lookupEmail(identifier))
+	}
+	return h.DB.GetUserByUsername(r.Context(), strings.TrimSpace(identifier))
+}
+
+// UpdateUsername sets, changes or, with an empty username, removes the
+// username of the logged in user.
+func (h *AuthHandler) UpdateUsername(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	claims := claimsFromContext(r.Context())
+
+	var body struct {
+		Username *string `json:"username"`
+	}
+
+	if err := readFromJson(r, &body); err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body.Username == nil {
+		writeErrorResponse(w, "username is required", http.StatusBadRequest)
+		return
+	}
+
+	username := strings.TrimSpace(*body.Username)
+	if username != "" {
+		if err := validateUsername(username); err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	previous, err := h.DB.UpdateUsername(r.Context(), claims.UserID, username)
+	if err != nil {
+		switch {
+		case errors.Is(err, postgres.ErrUsernameTaken):
+			writeErrorResponse(w, err.Error(), http.StatusConflict)
+		case errors.Is(err, postgres.ErrInvalidUser):
+			writeErrorResponse(w, "user no longer exists", http.StatusUnauthorized)
+		default:
+			log.Printf("unable to update username for user %s: %v", claims.UserID, err)
+			writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if previous != username {
+		userData := map[string]interface{}{
+			"data": map[string]string{
+				"type":              rabbitmq.NotifyUsernameChanged,
+				"id":                claims.UserID,
+				"username":          username,
+				"previous_username": previous,
+				"timestamp":         time.Now().String(),
+			},
+			"queue_name":    rabbitmq.UserQueue,
+			"exchange_name": rabbitmq.UserExchange,
+		}
+
+		go h.RabbMQ.PublishUserManagement(userData)
+	}
+
+	response := struct {
+		Username   string `json:"username"`
+		Message    string `json:"message"`
+		StatusCode int    `json:"status_code"`
+	}{
+		Username:   username,
+		Message:    "Username updated successfully",
+		StatusCode: http.StatusOK,
+	}
+	if username == "" {
+		response.Message = "Username removed successfully"
+	}
+	writeToJson(w, response, http.StatusOK)
+}
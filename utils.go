@@ -1,54 +1,55 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 
+	"github.com/Developer-s-Foundry/df-2.0-aima-auth-service/database/postgres"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
-	"golang.org/x/crypto/bcrypt"
 )
 
-func hashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 10)
-	return string(bytes), err
-}
+const accessTokenTTL = 24 * time.Hour
 
-func checkPasswordHash(password, hash string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	return err == nil
-}
+// defaultTokenScope is granted to every session token this service issues.
+const defaultTokenScope = "openid email"
 
 type CustomClaims struct {
-	UserID string `json:"user_id"`
+	UserID        string `json:"user_id"`
+	Scope         string `json:"scope,omitempty"`
+	EmailVerified bool   `json:"email_verified"`
 	jwt.RegisteredClaims
 }
 
-func generateJWToken(userID string) (string, error) {
-	secretKey := os.Getenv("JWT_SECRET")
-	if secretKey == "" {
-		return "", errors.New("missing JWT_SECRET environment variable")
-	}
-
-	issuer := os.Getenv("JWT_ISSUER")
+func generateJWToken(user *postgres.User) (string, error) {
+	issuer := publicBaseURL()
 
 	claims := CustomClaims{
-		UserID: userID,
+		UserID:        user.UserID,
+		Scope:         defaultTokenScope,
+		EmailVerified: user.EmailVerified,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
+			ID:        generateUuid(),
+			Subject:   user.UserID,
+			Audience:  tokenAudience(),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(accessTokenTTL)),
 			Issuer:    issuer,
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-
-	tokenString, err := token.SignedString([]byte(secretKey))
+	tokenString, err := signJWToken(claims)
 	if err != nil {
 		log.Printf("Error signing JWT: %v", err)
 		return "", errors.New("error generating JWT")
@@ -57,24 +58,62 @@ func generateJWToken(userID string) (string, error) {
 	return tokenString, nil
 }
 
-func VerifyJWToken(tokenString string) (*CustomClaims, error) {
-	secretKey := os.Getenv("JWT_SECRET")
-	if secretKey == "" {
-		return nil, errors.New("missing JWT_SECRET environment variable")
+// tokenAudience reads the comma separated JWT_AUDIENCE list of services the
+// tokens are meant for.
+func tokenAudience() jwt.ClaimStrings {
+	var audience jwt.ClaimStrings
+	for _, aud := range strings.Split(os.Getenv("JWT_AUDIENCE"), ",") {
+		if aud = strings.TrimSpace(aud); aud != "" {
+			audience = append(audience, aud)
+		}
 	}
+	return audience
+}
 
-	token, err := jwt.ParseWithClaims(tokenString, &CustomClaims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, errors.New("unexpected signing method")
-		}
-		return []byte(secretKey), nil
-	})
+// signJWToken signs claims with the active key of the keyring.
+func signJWToken(claims jwt.Claims) (string, error) {
+	key, err := jwtKeys.Active()
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(key.method(), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.PrivateKey)
+}
+
+// verificationKey resolves the key a token must be verified with from its kid
+// header. Only keys of the keyring are trusted; a shared secret would let
+// every service holding it mint session tokens.
+func verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := jwtKeys.Lookup(kid)
+	if !ok {
+		return nil, errors.New("unknown signing key")
+	}
+	if key.Algorithm != token.Method.Alg() {
+		return nil, errors.New("unexpected signing method")
+	}
+	return key.PublicKey, nil
+}
+
+func VerifyJWToken(tokenString string) (*CustomClaims, error) {
+	token, err := jwt.ParseWithClaims(
+		tokenString,
+		&CustomClaims{},
+		verificationKey,
+		jwt.WithValidMethods([]string{AlgRS256, AlgES256, AlgEdDSA}),
+	)
 
 	if err != nil {
 		return nil, err
 	}
 
 	if claims, ok := token.Claims.(*CustomClaims); ok && token.Valid {
+		// ID tokens and other tokens signed with the same keys carry no
+		// user_id and must not be usable as session tokens.
+		if claims.UserID == "" {
+			return nil, errors.New("invalid token")
+		}
 		return claims, nil
 	}
 
@@ -82,6 +121,7 @@ func VerifyJWToken(tokenString string) (*CustomClaims, error) {
 }
 
 func writeToJson(w http.ResponseWriter, data interface{}, statusCode int) error {
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
 	if err := json.NewEncoder(w).Encode(data); err != nil {
 		return err
@@ -102,10 +142,52 @@ func generateUuid() string {
 	return uuid.NewString()
 }
 
+// generateOpaqueToken returns a random, URL-safe token carrying 256 bits of
+// entropy. Only its hashToken digest should ever be persisted.
+func generateOpaqueToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// linkWithToken appends token as the token query parameter of the frontend
+// page base. It returns an empty string when base is not configured, in which
+// case notification consumers only get the raw token.
+func linkWithToken(base, token string) string {
+	if base == "" {
+		return ""
+	}
+
+	u, err := url.Parse(base)
+	if err != nil {
+		log.Printf("invalid link base %q: %v", base, err)
+		return ""
+	}
+	q := u.Query()
+	q.Set("token", token)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 type ErrorResponse struct {
 	Message string `json:"message"`
 }
 
+func writeErrorResponse(w http.ResponseWriter, message string, statusCode int) {
+	respErr := map[string]string{
+		"error":  message,
+		"status": http.StatusText(statusCode),
+	}
+	writeToJson(w, respErr, statusCode)
+}
+
 func writeJSONError(w http.ResponseWriter, statusCode int, message string) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
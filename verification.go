@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/Developer-s-Foundry/df-2.0-aima-auth-service/database/postgres"
+	"github.com/Developer-s-Foundry/df-2.0-aima-auth-service/database/rabbitmq"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	emailVerificationTTL      = 24 * time.Hour
+	emailVerificationCooldown = time.Minute
+)
+
+const (
+	// VerificationPolicyOff never restricts unverified accounts.
+	VerificationPolicyOff = "off"
+	// VerificationPolicyMark issues tokens but marks them as unverified.
+	VerificationPolicyMark = "mark"
+	// VerificationPolicyBlock refuses to log unverified accounts in.
+	VerificationPolicyBlock = "block"
+)
+
+// emailVerificationPolicy reads EMAIL_VERIFICATION_POLICY, defaulting to
+// VerificationPolicyMark.
+func emailVerificationPolicy() string {
+	switch policy := os.Getenv("EMAIL_VERIFICATION_POLICY"); policy {
+	case VerificationPolicyOff, VerificationPolicyBlock:
+		return policy
+	default:
+		return VerificationPolicyMark
+	}
+}
+
+// newEmailVerificationToken generates a single-use verification token for
+// userID and returns its plaintext value along with the row to store.
+func newEmailVerificationToken(userID string) (string, postgres.EmailVerificationToken, error) {
+	token, err := generateOpaqueToken()
+	if err != nil {
+		return "", postgres.EmailVerificationToken{}, err
+	}
+
+	return token, postgres.EmailVerificationToken{
+		TokenHash: hashToken(token),
+		UserID:    userID,
+		ExpiresAt: time.Now().Add(emailVerificationTTL),
+	}, nil
+}
+
+// issueEmailVerificationToken stores a new single-use verification token for
+// user and queues the mail that carries it in the same transaction, so the
+// token only reaches the broker sealed, through the outbox relay.
+func (h *AuthHandler) issueEmailVerificationToken(ctx context.Context, user *postgres.User) error {
+	token, t, err := newEmailVerificationToken(user.UserID)
+	if err != nil {
+		return err
+	}
+
+	userData := map[string]interface{}{
+		"data": map[string]string{
+			"type":               rabbitmq.NotifyEmailVerification,
+			"email":              user.Email,
+			"id":                 user.UserID,
+			"verification_token": token,
+			"verification_url":   emailVerificationURL(token),
+			"timestamp":          time.Now().String(),
+		},
+		"queue_name":    rabbitmq.NotificationQueue,
+		"exchange_name": rabbitmq.NotificationExchange,
+	}
+	notification, err := newOutboxEvent(rabbitmq.NotificationExchange, rabbitmq.NotificationQueue, userData)
+	if err != nil {
+		return err
+	}
+
+	return h.DB.InsertEmailVerificationToken(ctx, t, notification)
+}
+
+// emailVerificationURL builds the link the notification service mails out
+// from EMAIL_VERIFICATION_URL.
+func emailVerificationURL(token string) string {
+	return linkWithToken(os.Getenv("EMAIL_VERIFICATION_URL"), token)
+}
+
+func (h *AuthHandler) VerifyEmail(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var body struct {
+		Token string `json:"token"`
+	}
+
+	if err := readFromJson(r, &body); err != nil || body.Token == "" {
+		writeErrorResponse(w, "token is required", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := h.DB.VerifyEmail(r.Context(), hashToken(body.Token))
+	if err != nil {
+		if errors.Is(err, postgres.ErrInvalidVerificationToken) {
+			writeErrorResponse(w, "verification token is invalid or has expired", http.StatusBadRequest)
+			return
+		}
+		log.Printf("unable to verify email: %v", err)
+		writeErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		ID         string `json:"id"`
+		Message    string `json:"message"`
+		StatusCode int    `json:"status_code"`
+	}{
+		ID:         userID,
+		Message:    "Email verified successfully",
+		StatusCode: http.StatusOK,
+	}
+	writeToJson(w, response, http.StatusOK)
+}
+
+// ResendVerificationEmail always answers 202 so that it cannot be used to
+// find out which addresses have an account. A new token is only sent for
+// unverified accounts and at most once per cooldown period.
+func (h *AuthHandler) ResendVerificationEmail(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var body struct {
+		Email string `json:"email"`
+	}
+
+	if err := readFromJson(r, &body); err != nil || body.Email == "" {
+		writeErrorResponse(w, "email is required", http.StatusBadRequest)
+		return
+	}
+
+	response := struct {
+		Message    string `json:"message"`
+		StatusCode int    `json:"status_code"`
+	}{
+		Message:    "If the account exists and is unverified, a verification email has been sent",
+		StatusCode: http.StatusAccepted,
+	}
+
+	user, err := h.DB.GetUser(r.Context(), lookupEmail(body.Email))
+	if err != nil {
+		if !errors.Is(err, postgres.ErrInvalidUser) {
+			log.Printf("unable to get user from db: %v", err)
+		}
+		writeToJson(w, response, http.StatusAccepted)
+		return
+	}
+
+	if user.EmailVerified {
+		writeToJson(w, response, http.StatusAccepted)
+		return
+	}
+
+	lastSent, err := h.DB.GetLastEmailVerificationSentAt(r.Context(), user.UserID)
+	if err != nil {
+		log.Printf("unable to check verification cooldown for user %s: %v", user.UserID, err)
+		writeToJson(w, response, http.StatusAccepted)
+		return
+	}
+	if time.Since(lastSent) < emailVerificationCooldown {
+		writeToJson(w, response, http.StatusAccepted)
+		return
+	}
+
+	if err := h.issueEmailVerificationToken(r.Context(), user); err != nil {
+		log.Printf("unable to issue verification token for user %s: %v", user.UserID, err)
+		writeToJson(w, response, http.StatusAccepted)
+		return
+	}
+
+	writeToJson(w, response, http.StatusAccepted)
+}
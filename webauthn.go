@@ -0,0 +1,557 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Developer-s-Foundry/df-2.0-aima-auth-service/database/postgres"
+)
+
+const webAuthnChallengeTTL = 5 * time.Minute
+
+// COSE algorithm identifiers (RFC 9053) accepted for passkeys, in order of
+// preference.
+const (
+	coseAlgES256 int64 = -7
+	coseAlgEdDSA int64 = -8
+	coseAlgRS256 int64 = -257
+)
+
+var webAuthnAlgorithms = []int64{coseAlgES256, coseAlgEdDSA, coseAlgRS256}
+
+// authenticator data flags
+const (
+	authDataUserPresent  = 0x01
+	authDataUserVerified = 0x04
+	authDataAttested     = 0x40
+	authDataExtensions   = 0x80
+)
+
+// errInvalidWebAuthnResponse marks failures caused by what the client sent,
+// as opposed to failures of the service itself.
+var errInvalidWebAuthnResponse = errors.New("invalid webauthn response")
+
+func invalidWebAuthn(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", errInvalidWebAuthnResponse, fmt.Sprintf(format, args...))
+}
+
+// webAuthnRPID is the relying party ID passkeys are scoped to. It defaults to
+// the host of AUTH_PUBLIC_URL.
+func webAuthnRPID() string {
+	if id := os.Getenv("WEBAUTHN_RP_ID"); id != "" {
+		return id
+	}
+	u, err := url.Parse(publicBaseURL())
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+func webAuthnRPName() string {
+	if name := os.Getenv("WEBAUTHN_RP_NAME"); name != "" {
+		return name
+	}
+	return "AIMAS"
+}
+
+// webAuthnOrigins lists the origins ceremonies may run on, read from the
+// comma-separated WEBAUTHN_ORIGINS.
+func webAuthnOrigins() []string {
+	var origins []string
+	for _, origin := range strings.Split(os.Getenv("WEBAUTHN_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, strings.TrimSuffix(origin, "/"))
+		}
+	}
+	if len(origins) == 0 {
+		origins = append(origins, "https://"+webAuthnRPID())
+	}
+	return origins
+}
+
+// decodeBase64URL decodes the base64url fields of WebAuthn JSON, with or
+// without padding.
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+type webAuthnDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type webAuthnCreationOptions struct {
+	Challenge string `json:"challenge"`
+	RP        struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"rp"`
+	User struct {
+		ID          string `json:"id"`
+		Name        string `json:"name"`
+		DisplayName string `json:"displayName"`
+	} `json:"user"`
+	PubKeyCredParams []struct {
+		Type string `json:"type"`
+		Alg  int64  `json:"alg"`
+	} `json:"pubKeyCredParams"`
+	Timeout                int                  `json:"timeout"`
+	Attestation            string               `json:"attestation"`
+	ExcludeCredentials     []webAuthnDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection struct {
+		ResidentKey      string `json:"residentKey"`
+		UserVerification string `json:"userVerification"`
+	} `json:"authenticatorSelection"`
+}
+
+type webAuthnRequestOptions struct {
+	Challenge        string               `json:"challenge"`
+	Timeout          int                  `json:"timeout"`
+	RPID             string               `json:"rpId"`
+	AllowCredentials []webAuthnDescriptor `json:"allowCredentials"`
+	UserVerification string               `json:"userVerification"`
+}
+
+// webAuthnCredentialJSON is a PublicKeyCredential as serialised by the
+// browser's toJSON(). Registration fills AttestationObject, authentication
+// fills AuthenticatorData, Signature and UserHandle.
+type webAuthnCredentialJSON struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+type collectedClientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+func parseClientData(raw []byte, ceremonyType string) (*collectedClientData, error) {
+	var clientData collectedClientData
+	if err := json.Unmarshal(raw, &clientData); err != nil {
+		return nil, invalidWebAuthn("malformed client data")
+	}
+	if clientData.Type != ceremonyType {
+		return nil, invalidWebAuthn("unexpected client data type %q", clientData.Type)
+	}
+	if clientData.Challenge == "" {
+		return nil, invalidWebAuthn("missing challenge")
+	}
+	if clientData.CrossOrigin || !slices.Contains(webAuthnOrigins(), clientData.Origin) {
+		return nil, invalidWebAuthn("origin %q is not allowed", clientData.Origin)
+	}
+	return &clientData, nil
+}
+
+type authenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+// parseAuthenticatorData splits the authenticator data of WebAuthn §6.1,
+// keeping the COSE public key of attested credential data undecoded.
+func parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, invalidWebAuthn("authenticator data too short")
+	}
+
+	a := &authenticatorData{
+		RPIDHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	rest := data[37:]
+
+	if a.Flags&authDataAttested != 0 {
+		if len(rest) < 18 {
+			return nil, invalidWebAuthn("attested credential data too short")
+		}
+		idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if len(rest) < idLen {
+			return nil, invalidWebAuthn("attested credential data too short")
+		}
+		a.CredentialID, rest = rest[:idLen], rest[idLen:]
+
+		_, after, err := cborDecode(rest)
+		if err != nil {
+			return nil, invalidWebAuthn("malformed credential public key: %v", err)
+		}
+		a.PublicKey, rest = rest[:len(rest)-len(after)], after
+	}
+
+	if a.Flags&authDataExtensions != 0 {
+		_, after, err := cborDecode(rest)
+		if err != nil {
+			return nil, invalidWebAuthn("malformed extensions: %v", err)
+		}
+		rest = after
+	}
+
+	if len(rest) != 0 {
+		return nil, invalidWebAuthn("trailing bytes in authenticator data")
+	}
+	return a, nil
+}
+
+func (a *authenticatorData) check(requireUserVerification bool) error {
+	rpIDHash := sha256.Sum256([]byte(webAuthnRPID()))
+	if !bytes.Equal(a.RPIDHash, rpIDHash[:]) {
+		return invalidWebAuthn("relying party ID mismatch")
+	}
+	if a.Flags&authDataUserPresent == 0 {
+		return invalidWebAuthn("user was not present")
+	}
+	if requireUserVerification && a.Flags&authDataUserVerified == 0 {
+		return invalidWebAuthn("user was not verified")
+	}
+	return nil
+}
+
+// parseCOSEKey decodes a COSE_Key (RFC 9052) holding one of
+// webAuthnAlgorithms.
+func parseCOSEKey(data []byte) (crypto.PublicKey, int64, error) {
+	decoded, rest, err := cborDecode(data)
+	if err != nil || len(rest) != 0 {
+		return nil, 0, invalidWebAuthn("malformed credential public key")
+	}
+	m, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, 0, invalidWebAuthn("malformed credential public key")
+	}
+
+	intParam := func(label int64) int64 {
+		v, _ := m[label].(int64)
+		return v
+	}
+	bytesParam := func(label int64) []byte {
+		v, _ := m[label].([]byte)
+		return v
+	}
+
+	kty, alg := intParam(1), intParam(3)
+	switch {
+	case alg == coseAlgES256 && kty == 2 && intParam(-1) == 1:
+		x, y := bytesParam(-2), bytesParam(-3)
+		if len(x) != 32 || len(y) != 32 {
+			return nil, 0, invalidWebAuthn("invalid P-256 public key")
+		}
+		point := append(append([]byte{4}, x...), y...)
+		key, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), point)
+		if err != nil {
+			return nil, 0, invalidWebAuthn("invalid P-256 public key")
+		}
+		return key, alg, nil
+	case alg == coseAlgEdDSA && kty == 1 && intParam(-1) == 6:
+		x := bytesParam(-2)
+		if len(x) != ed25519.PublicKeySize {
+			return nil, 0, invalidWebAuthn("invalid Ed25519 public key")
+		}
+		return ed25519.PublicKey(x), alg, nil
+	case alg == coseAlgRS256 && kty == 3:
+		n, e := new(big.Int).SetBytes(bytesParam(-1)), new(big.Int).SetBytes(bytesParam(-2))
+		if n.BitLen() < 2048 || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, 0, invalidWebAuthn("invalid RSA public key")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, alg, nil
+	default:
+		return nil, 0, invalidWebAuthn("unsupported credential algorithm %d", alg)
+	}
+}
+
+func verifyCOSESignature(coseKey, signed, signature []byte) error {
+	key, alg, err := parseCOSEKey(coseKey)
+	if err != nil {
+		return err
+	}
+
+	digest := sha256.Sum256(signed)
+	var ok bool
+	switch alg {
+	case coseAlgES256:
+		ok = ecdsa.VerifyASN1(key.(*ecdsa.PublicKey), digest[:], signature)
+	case coseAlgEdDSA:
+		ok = ed25519.Verify(key.(ed25519.PublicKey), signed, signature)
+	case coseAlgRS256:
+		ok = rsa.VerifyPKCS1v15(key.(*rsa.PublicKey), crypto.SHA256, digest[:], signature) == nil
+	}
+	if !ok {
+		return invalidWebAuthn("signature verification failed")
+	}
+	return nil
+}
+
+// newWebAuthnChallenge stores a fresh challenge for ceremony and returns it
+// base64url encoded, which is also how the browser echoes it back in the
+// client data.
+func (h *AuthHandler) newWebAuthnChallenge(ctx context.Context, userID, ceremony, nonce string) (string, error) {
+	challenge, err := generateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	err = h.DB.InsertWebAuthnChallenge(ctx, postgres.WebAuthnChallenge{
+		ChallengeHash: hashToken(challenge),
+		UserID:        userID,
+		Ceremony:      ceremony,
+		Nonce:         nonce,
+		ExpiresAt:     time.Now().Add(webAuthnChallengeTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+	return challenge, nil
+}
+
+func (h *AuthHandler) webAuthnDescriptors(ctx context.Context, userID string) ([]webAuthnDescriptor, error) {
+	credentials, err := h.DB.GetWebAuthnCredentials(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	descriptors := make([]webAuthnDescriptor, len(credentials))
+	for i, c := range credentials {
+		descriptors[i] = webAuthnDescriptor{Type: "public-key", ID: c.ID}
+	}
+	return descriptors, nil
+}
+
+func (h *AuthHandler) webAuthnCreationOptions(ctx context.Context, user *postgres.User) (*webAuthnCreationOptions, error) {
+	exclude, err := h.webAuthnDescriptors(ctx, user.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	challenge, err := h.newWebAuthnChallenge(ctx, user.UserID, postgres.WebAuthnCeremonyRegistration, "")
+	if err != nil {
+		return nil, err
+	}
+
+	options := &webAuthnCreationOptions{
+		Challenge:          challenge,
+		Timeout:            int(webAuthnChallengeTTL.Milliseconds()),
+		Attestation:        "none",
+		ExcludeCredentials: exclude,
+	}
+	options.RP.ID = webAuthnRPID()
+	options.RP.Name = webAuthnRPName()
+	options.User.ID = base64.RawURLEncoding.EncodeToString([]byte(user.UserID))
+	options.User.Name = user.Email
+	options.User.DisplayName = user.Email
+	for _, alg := range webAuthnAlgorithms {
+		options.PubKeyCredParams = append(options.PubKeyCredParams, struct {
+			Type string `json:"type"`
+			Alg  int64  `json:"alg"`
+		}{"public-key", alg})
+	}
+	options.AuthenticatorSelection.ResidentKey = "preferred"
+	options.AuthenticatorSelection.UserVerification = "preferred"
+	return options, nil
+}
+
+// webAuthnRequestOptions starts an authentication ceremony. An empty userID
+// leaves allowCredentials empty so the authenticator offers its discoverable
+// credentials.
+func (h *AuthHandler) webAuthnRequestOptions(ctx context.Context, userID, ceremony, nonce, userVerification string) (*webAuthnRequestOptions, error) {
+	allow := []webAuthnDescriptor{}
+	if userID != "" {
+		descriptors, err := h.webAuthnDescriptors(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+		allow = descriptors
+	}
+
+	challenge, err := h.newWebAuthnChallenge(ctx, userID, ceremony, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return &webAuthnRequestOptions{
+		Challenge:        challenge,
+		Timeout:          int(webAuthnChallengeTTL.Milliseconds()),
+		RPID:             webAuthnRPID(),
+		AllowCredentials: allow,
+		UserVerification: userVerification,
+	}, nil
+}
+
+// verifyWebAuthnRegistration runs the checks of WebAuthn §7.1 on a new
+// credential of userID. Attestation statements are not verified, in line
+// with the "none" conveyance the options ask for.
+func (h *AuthHandler) verifyWebAuthnRegistration(ctx context.Context, userID string, c *webAuthnCredentialJSON) (*postgres.WebAuthnCredential, error) {
+	if c.Type != "public-key" {
+		return nil, invalidWebAuthn("unexpected credential type %q", c.Type)
+	}
+
+	rawClientData, err := decodeBase64URL(c.Response.ClientDataJSON)
+	if err != nil {
+		return nil, invalidWebAuthn("malformed client data")
+	}
+	clientData, err := parseClientData(rawClientData, "webauthn.create")
+	if err != nil {
+		return nil, err
+	}
+
+	challenge, err := h.DB.ConsumeWebAuthnChallenge(ctx, hashToken(clientData.Challenge), postgres.WebAuthnCeremonyRegistration)
+	if err != nil {
+		if errors.Is(err, postgres.ErrInvalidWebAuthnChallenge) {
+			return nil, invalidWebAuthn("challenge is invalid or has expired")
+		}
+		return nil, err
+	}
+	if challenge.UserID != userID {
+		return nil, invalidWebAuthn("challenge was issued to another user")
+	}
+
+	rawAttestation, err := decodeBase64URL(c.Response.AttestationObject)
+	if err != nil {
+		return nil, invalidWebAuthn("malformed attestation object")
+	}
+	decoded, _, err := cborDecode(rawAttestation)
+	if err != nil {
+		return nil, invalidWebAuthn("malformed attestation object")
+	}
+	attestation, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, invalidWebAuthn("malformed attestation object")
+	}
+	rawAuthData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return nil, invalidWebAuthn("attestation object has no authenticator data")
+	}
+
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if err := authData.check(false); err != nil {
+		return nil, err
+	}
+	if authData.Flags&authDataAttested == 0 {
+		return nil, invalidWebAuthn("attestation has no credential data")
+	}
+
+	rawID, err := decodeBase64URL(c.RawID)
+	if err != nil || !bytes.Equal(rawID, authData.CredentialID) {
+		return nil, invalidWebAuthn("credential ID mismatch")
+	}
+	if _, _, err := parseCOSEKey(authData.PublicKey); err != nil {
+		return nil, err
+	}
+
+	return &postgres.WebAuthnCredential{
+		ID:        base64.RawURLEncoding.EncodeToString(authData.CredentialID),
+		UserID:    userID,
+		PublicKey: authData.PublicKey,
+		SignCount: int64(authData.SignCount),
+	}, nil
+}
+
+// verifyWebAuthnAssertion runs the checks of WebAuthn §7.2 on an answer to a
+// challenge of ceremony and records the new signature counter. Failures that
+// are the client's fault wrap errInvalidWebAuthnResponse.
+func (h *AuthHandler) verifyWebAuthnAssertion(ctx context.Context, c *webAuthnCredentialJSON, ceremony string, requireUserVerification bool) (*postgres.WebAuthnCredential, *postgres.WebAuthnChallenge, error) {
+	if c.Type != "public-key" {
+		return nil, nil, invalidWebAuthn("unexpected credential type %q", c.Type)
+	}
+
+	rawClientData, err := decodeBase64URL(c.Response.ClientDataJSON)
+	if err != nil {
+		return nil, nil, invalidWebAuthn("malformed client data")
+	}
+	clientData, err := parseClientData(rawClientData, "webauthn.get")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	challenge, err := h.DB.ConsumeWebAuthnChallenge(ctx, hashToken(clientData.Challenge), ceremony)
+	if err != nil {
+		if errors.Is(err, postgres.ErrInvalidWebAuthnChallenge) {
+			return nil, nil, invalidWebAuthn("challenge is invalid or has expired")
+		}
+		return nil, nil, err
+	}
+
+	rawID, err := decodeBase64URL(c.RawID)
+	if err != nil {
+		return nil, nil, invalidWebAuthn("malformed credential ID")
+	}
+	credential, err := h.DB.GetWebAuthnCredential(ctx, base64.RawURLEncoding.EncodeToString(rawID))
+	if err != nil {
+		if errors.Is(err, postgres.ErrWebAuthnCredentialNotFound) {
+			return nil, nil, invalidWebAuthn("unknown credential")
+		}
+		return nil, nil, err
+	}
+	if challenge.UserID != "" && challenge.UserID != credential.UserID {
+		return nil, nil, invalidWebAuthn("credential belongs to another user")
+	}
+	if c.Response.UserHandle != "" {
+		userHandle, err := decodeBase64URL(c.Response.UserHandle)
+		if err != nil || string(userHandle) != credential.UserID {
+			return nil, nil, invalidWebAuthn("user handle mismatch")
+		}
+	}
+
+	rawAuthData, err := decodeBase64URL(c.Response.AuthenticatorData)
+	if err != nil {
+		return nil, nil, invalidWebAuthn("malformed authenticator data")
+	}
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := authData.check(requireUserVerification); err != nil {
+		return nil, nil, err
+	}
+
+	signature, err := decodeBase64URL(c.Response.Signature)
+	if err != nil {
+		return nil, nil, invalidWebAuthn("malformed signature")
+	}
+	clientDataHash := sha256.Sum256(rawClientData)
+	signed := append(append([]byte{}, rawAuthData...), clientDataHash[:]...)
+	if err := verifyCOSESignature(credential.PublicKey, signed, signature); err != nil {
+		return nil, nil, err
+	}
+
+	if err := h.DB.UpdateWebAuthnSignCount(ctx, credential.ID, int64(authData.SignCount)); err != nil {
+		if errors.Is(err, postgres.ErrWebAuthnSignCount) {
+			return nil, nil, invalidWebAuthn("signature counter went backwards, the authenticator may be cloned")
+		}
+		return nil, nil, err
+	}
+
+	return credential, challenge, nil
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Developer-s-Foundry/df-2.0-aima-auth-service/database/postgres"
+)
+
+const (
+	testRPID   = "auth.example.com"
+	testOrigin = "https://auth.example.com"
+)
+
+// cborPair is a map entry for cborEncode. Maps are encoded from a slice so
+// that the bytes come out in a fixed order.
+type cborPair struct {
+	key, value interface{}
+}
+
+func cborHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n <= 0xff:
+		return []byte{major<<5 | 24, byte(n)}
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+	case n <= 0xffffffff:
+		return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64([]byte{major<<5 | 27}, n)
+	}
+}
+
+// cborEncode encodes the int64, []byte, string, []interface{} and
+// []cborPair values the tests need.
+func cborEncode(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	switch v := v.(type) {
+	case int64:
+		if v < 0 {
+			return cborHead(1, uint64(-1-v))
+		}
+		return cborHead(0, uint64(v))
+	case []byte:
+		return append(cborHead(2, uint64(len(v))), v...)
+	case string:
+		return append(cborHead(3, uint64(len(v))), v...)
+	case []interface{}:
+		out := cborHead(4, uint64(len(v)))
+		for _, item := range v {
+			out = append(out, cborEncode(t, item)...)
+		}
+		return out
+	case []cborPair:
+		out := cborHead(5, uint64(len(v)))
+		for _, p := range v {
+			out = append(out, cborEncode(t, p.key)...)
+			out = append(out, cborEncode(t, p.value)...)
+		}
+		return out
+	default:
+		t.Fatalf("cborEncode: unsupported type %T", v)
+		return nil
+	}
+}
+
+// softAuthenticator is an ES256 authenticator in software. The fields are
+// what it puts into its next response; tests change them to forge bad ones.
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	signCount    uint32
+	rpID         string
+	origin       string
+	flags        byte
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	must(t, err)
+	credentialID := make([]byte, 16)
+	_, err = rand.Read(credentialID)
+	must(t, err)
+
+	return &softAuthenticator{
+		key:          key,
+		credentialID: credentialID,
+		rpID:         testRPID,
+		origin:       testOrigin,
+		flags:        authDataUserPresent | authDataUserVerified,
+	}
+}
+
+func (a *softAuthenticator) coseKey(t *testing.T) []byte {
+	point, err := a.key.PublicKey.Bytes()
+	must(t, err)
+	return cborEncode(t, []cborPair{
+		{int64(1), int64(2)},
+		{int64(3), coseAlgES256},
+		{int64(-1), int64(1)},
+		{int64(-2), point[1:33]},
+		{int64(-3), point[33:]},
+	})
+}
+
+func (a *softAuthenticator) authData(flags byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	data := append(rpIDHash[:], flags)
+	return binary.BigEndian.AppendUint32(data, a.signCount)
+}
+
+func (a *softAuthenticator) clientData(t *testing.T, ceremonyType, challenge string) []byte {
+	raw, err := json.Marshal(collectedClientData{Type: ceremonyType, Challenge: challenge, Origin: a.origin})
+	must(t, err)
+	return raw
+}
+
+// create answers navigator.credentials.create with "none" attestation.
+func (a *softAuthenticator) create(t *testing.T, challenge string) *webAuthnCredentialJSON {
+	t.Helper()
+	authData := a.authData(a.flags | authDataAttested)
+	authData = append(authData, make([]byte, 16)...) // AAGUID
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(a.credentialID)))
+	authData = append(authData, a.credentialID...)
+	authData = append(authData, a.coseKey(t)...)
+
+	attestation := cborEncode(t, []cborPair{
+		{"fmt", "none"},
+		{"attStmt", []cborPair{}},
+		{"authData", authData},
+	})
+	return a.credential(a.clientData(t, "webauthn.create", challenge), func(c *webAuthnCredentialJSON) {
+		c.Response.AttestationObject = base64.RawURLEncoding.EncodeToString(attestation)
+	})
+}
+
+// get answers navigator.credentials.get, signing with the credential's key.
+func (a *softAuthenticator) get(t *testing.T, challenge, userID string) *webAuthnCredentialJSON {
+	t.Helper()
+	authData := a.authData(a.flags)
+	clientData := a.clientData(t, "webauthn.get", challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	must(t, err)
+
+	return a.credential(clientData, func(c *webAuthnCredentialJSON) {
+		c.Response.AuthenticatorData = base64.RawURLEncoding.EncodeToString(authData)
+		c.Response.Signature = base64.RawURLEncoding.EncodeToString(signature)
+		c.Response.UserHandle = base64.RawURLEncoding.EncodeToString([]byte(userID))
+	})
+}
+
+func (a *softAuthenticator) credential(clientData []byte, fill func(*webAuthnCredentialJSON)) *webAuthnCredentialJSON {
+	c := &webAuthnCredentialJSON{
+		ID:    base64.RawURLEncoding.EncodeToString(a.credentialID),
+		RawID: base64.RawURLEncoding.EncodeToString(a.credentialID),
+		Type:  "public-key",
+	}
+	c.Response.ClientDataJSON = base64.RawURLEncoding.EncodeToString(clientData)
+	fill(c)
+	return c
+}
+
+func newWebAuthnTestHandler(t *testing.T) (*AuthHandler, *postgres.User) {
+	t.Helper()
+	t.Setenv("WEBAUTHN_RP_ID", testRPID)
+	t.Setenv("WEBAUTHN_ORIGINS", testOrigin)
+
+	h := &AuthHandler{DB: NewMemoryStore()}
+	return h, newTestUser(t, h.DB)
+}
+
+// registerPasskey runs a registration ceremony for user and stores the
+// credential the way FinishPasskeyRegistration does.
+func registerPasskey(t *testing.T, h *AuthHandler, user *postgres.User, a *softAuthenticator) {
+	t.Helper()
+	ctx := context.Background()
+	options, err := h.webAuthnCreationOptions(ctx, user)
+	must(t, err)
+
+	credential, err := h.verifyWebAuthnRegistration(ctx, user.UserID, a.create(t, options.Challenge))
+	must(t, err)
+	must(t, h.DB.InsertWebAuthnCredential(ctx, *credential))
+}
+
+func beginPasskeyLogin(t *testing.T, h *AuthHandler, nonce string) string {
+	t.Helper()
+	options, err := h.webAuthnRequestOptions(context.Background(), "", postgres.WebAuthnCeremonyLogin, nonce, "required")
+	must(t, err)
+	return options.Challenge
+}
+
+// expiredWebAuthnChallenge stores a challenge for ceremony that has already
+// run out.
+func expiredWebAuthnChallenge(t *testing.T, h *AuthHandler, userID, ceremony string) string {
+	t.Helper()
+	challenge, err := generateOpaqueToken()
+	must(t, err)
+	must(t, h.DB.InsertWebAuthnChallenge(context.Background(), postgres.WebAuthnChallenge{
+		ChallengeHash: hashToken(challenge),
+		UserID:        userID,
+		Ceremony:      ceremony,
+		ExpiresAt:     time.Now().Add(-time.Second),
+	}))
+	return challenge
+}
+
+func TestWebAuthnRegistrationAndLogin(t *testing.T) {
+	h, user := newWebAuthnTestHandler(t)
+	ctx := context.Background()
+	a := newSoftAuthenticator(t)
+	registerPasskey(t, h, user, a)
+
+	for i := 0; i < 2; i++ {
+		a.signCount += 3
+		credential, challenge, err := h.verifyWebAuthnAssertion(ctx, a.get(t, beginPasskeyLogin(t, h, "nonce"), user.UserID), postgres.WebAuthnCeremonyLogin, true)
+		must(t, err)
+		if credential.UserID != user.UserID || challenge.Nonce != "nonce" {
+			t.Fatalf("login %d returned credential %+v and challenge %+v", i, credential, challenge)
+		}
+	}
+
+	stored, err := h.DB.GetWebAuthnCredential(ctx, base64.RawURLEncoding.EncodeToString(a.credentialID))
+	must(t, err)
+	if stored.SignCount != int64(a.signCount) || stored.LastUsedAt == nil {
+		t.Fatalf("stored credential %+v, want sign count %d", stored, a.signCount)
+	}
+}
+
+func TestWebAuthnRegistrationRejected(t *testing.T) {
+	tests := []struct {
+		name    string
+		respond func(t *testing.T, h *AuthHandler, user *postgres.User, a *softAuthenticator) *webAuthnCredentialJSON
+	}{
+		{"wrong origin", func(t *testing.T, h *AuthHandler, user *postgres.User, a *softAuthenticator) *webAuthnCredentialJSON {
+			a.origin = "https://evil.example.com"
+			return a.create(t, creationChallenge(t, h, user))
+		}},
+		{"wrong rp id hash", func(t *testing.T, h *AuthHandler, user *postgres.User, a *softAuthenticator) *webAuthnCredentialJSON {
+			a.rpID = "evil.example.com"
+			return a.create(t, creationChallenge(t, h, user))
+		}},
+		{"user not present", func(t *testing.T, h *AuthHandler, user *postgres.User, a *softAuthenticator) *webAuthnCredentialJSON {
+			a.flags = authDataUserVerified
+			return a.create(t, creationChallenge(t, h, user))
+		}},
+		{"replayed challenge", func(t *testing.T, h *AuthHandler, user *postgres.User, a *softAuthenticator) *webAuthnCredentialJSON {
+			challenge := creationChallenge(t, h, user)
+			_, err := h.verifyWebAuthnRegistration(context.Background(), user.UserID, a.create(t, challenge))
+			must(t, err)
+			return a.create(t, challenge)
+		}},
+		{"expired challenge", func(t *testing.T, h *AuthHandler, user *postgres.User, a *softAuthenticator) *webAuthnCredentialJSON {
+			return a.create(t, expiredWebAuthnChallenge(t, h, user.UserID, postgres.WebAuthnCeremonyRegistration))
+		}},
+		{"challenge of another user", func(t *testing.T, h *AuthHandler, user *postgres.User, a *softAuthenticator) *webAuthnCredentialJSON {
+			return a.create(t, creationChallenge(t, h, newTestUser(t, h.DB)))
+		}},
+		{"truncated attestation", func(t *testing.T, h *AuthHandler, user *postgres.User, a *softAuthenticator) *webAuthnCredentialJSON {
+			c := a.create(t, creationChallenge(t, h, user))
+			raw, err := decodeBase64URL(c.Response.AttestationObject)
+			must(t, err)
+			c.Response.AttestationObject = base64.RawURLEncoding.EncodeToString(raw[:len(raw)-1])
+			return c
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, user := newWebAuthnTestHandler(t)
+			c := tt.respond(t, h, user, newSoftAuthenticator(t))
+
+			_, err := h.verifyWebAuthnRegistration(context.Background(), user.UserID, c)
+			wantErr(t, err, errInvalidWebAuthnResponse)
+		})
+	}
+}
+
+func creationChallenge(t *testing.T, h *AuthHandler, user *postgres.User) string {
+	t.Helper()
+	options, err := h.webAuthnCreationOptions(context.Background(), user)
+	must(t, err)
+	return options.Challenge
+}
+
+func TestWebAuthnLoginRejected(t *testing.T) {
+	tests := []struct {
+		name    string
+		respond func(t *testing.T, h *AuthHandler, user *postgres.User, a *softAuthenticator) *webAuthnCredentialJSON
+	}{
+		{"wrong origin", func(t *testing.T, h *AuthHandler, user *postgres.User, a *softAuthenticator) *webAuthnCredentialJSON {
+			a.origin = "https://evil.example.com"
+			return a.get(t, beginPasskeyLogin(t, h, ""), user.UserID)
+		}},
+		{"wrong rp id hash", func(t *testing.T, h *AuthHandler, user *postgres.User, a *softAuthenticator) *webAuthnCredentialJSON {
+			a.rpID = "evil.example.com"
+			return a.get(t, beginPasskeyLogin(t, h, ""), user.UserID)
+		}},
+		{"user not present", func(t *testing.T, h *AuthHandler, user *postgres.User, a *softAuthenticator) *webAuthnCredentialJSON {
+			a.flags = authDataUserVerified
+			return a.get(t, beginPasskeyLogin(t, h, ""), user.UserID)
+		}},
+		{"user not verified", func(t *testing.T, h *AuthHandler, user *postgres.User, a *softAuthenticator) *webAuthnCredentialJSON {
+			a.flags = authDataUserPresent
+			return a.get(t, beginPasskeyLogin(t, h, ""), user.UserID)
+		}},
+		{"replayed challenge", func(t *testing.T, h *AuthHandler, user *postgres.User, a *softAuthenticator) *webAuthnCredentialJSON {
+			challenge := beginPasskeyLogin(t, h, "")
+			a.signCount++
+			_, _, err := h.verifyWebAuthnAssertion(context.Background(), a.get(t, challenge, user.UserID), postgres.WebAuthnCeremonyLogin, true)
+			must(t, err)
+			a.signCount++
+			return a.get(t, challenge, user.UserID)
+		}},
+		{"expired challenge", func(t *testing.T, h *AuthHandler, user *postgres.User, a *softAuthenticator) *webAuthnCredentialJSON {
+			return a.get(t, expiredWebAuthnChallenge(t, h, "", postgres.WebAuthnCeremonyLogin), user.UserID)
+		}},
+		{"sign count going backwards", func(t *testing.T, h *AuthHandler, user *postgres.User, a *softAuthenticator) *webAuthnCredentialJSON {
+			a.signCount = 10
+			_, _, err := h.verifyWebAuthnAssertion(context.Background(), a.get(t, beginPasskeyLogin(t, h, ""), user.UserID), postgres.WebAuthnCeremonyLogin, true)
+			must(t, err)
+			a.signCount = 9
+			return a.get(t, beginPasskeyLogin(t, h, ""), user.UserID)
+		}},
+		{"signed by another key", func(t *testing.T, h *AuthHandler, user *postgres.User, a *softAuthenticator) *webAuthnCredentialJSON {
+			a.key = newSoftAuthenticator(t).key
+			return a.get(t, beginPasskeyLogin(t, h, ""), user.UserID)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, user := newWebAuthnTestHandler(t)
+			a := newSoftAuthenticator(t)
+			registerPasskey(t, h, user, a)
+			c := tt.respond(t, h, user, a)
+
+			_, _, err := h.verifyWebAuthnAssertion(context.Background(), c, postgres.WebAuthnCeremonyLogin, true)
+			wantErr(t, err, errInvalidWebAuthnResponse)
+		})
+	}
+}
+
+func TestCBORDecode(t *testing.T) {
+	data := cborEncode(t, []cborPair{
+		{"fmt", "none"},
+		{int64(-7), []interface{}{int64(1), int64(-300), []byte{1, 2}}},
+	})
+	decoded, rest, err := cborDecode(append(data, 0xff))
+	must(t, err)
+	m, ok := decoded.(map[interface{}]interface{})
+	if !ok || m["fmt"] != "none" || len(rest) != 1 {
+		t.Fatalf("cborDecode returned %#v and %x", decoded, rest)
+	}
+	if items, ok := m[int64(-7)].([]interface{}); !ok || len(items) != 3 || items[1] != int64(-300) {
+		t.Fatalf("cborDecode returned %#v", m[int64(-7)])
+	}
+
+	for i := 0; i < len(data); i++ {
+		if _, _, err := cborDecode(data[:i]); err == nil {
+			t.Fatalf("cborDecode accepted %x truncated to %d bytes", data, i)
+		}
+	}
+}
+
+func TestCBORDecodeRejected(t *testing.T) {
+	nested := func(depth int) []byte {
+		data := make([]byte, depth, depth+1)
+		for i := range data {
+			data[i] = 0x81 // array of one item
+		}
+		return append(data, 0x00)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"byte string longer than the data", append(cborHead(2, 1<<32), 1, 2, 3)},
+		{"text string longer than the data", append(cborHead(3, 10), 'a')},
+		{"array longer than the data", append(cborHead(4, 1<<62), 0x00)},
+		{"map longer than the data", append(cborHead(5, 1<<62), 0x00, 0x00)},
+		{"integer overflowing int64", cborHead(0, 1<<63)},
+		{"missing length bytes", []byte{0x5a, 0x00, 0x01}},
+		{"indefinite length", []byte{0x9f, 0x00, 0xff}},
+		{"nested too deep", nested(cborMaxDepth + 2)},
+		{"duplicate map key", []byte{0xa2, 0x01, 0x00, 0x01, 0x00}},
+		{"unsupported map key", []byte{0xa1, 0x40, 0x00}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if decoded, _, err := cborDecode(tt.data); err == nil {
+				t.Fatalf("cborDecode accepted %x as %#v", tt.data, decoded)
+			}
+		})
+	}
+
+	if _, _, err := cborDecode(nested(cborMaxDepth)); err != nil {
+		t.Fatalf("cborDecode rejected %d nested arrays: %v", cborMaxDepth, err)
+	}
+	_, _, err := cborDecode(cborHead(2, 5))
+	wantErr(t, err, errCBORTruncated)
+}